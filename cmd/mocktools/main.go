@@ -0,0 +1,181 @@
+// Command mocktools is a local stand-in for a company's order system, serving
+// the kind of HTTP tools the AI calls while answering. It checks the bearer
+// token, logs every call and can be told to fail or stall so timeouts and
+// error handling can be watched end to end.
+//
+//	go run ./cmd/mocktools -print -company c1 -token secret > tools.json
+//	go run ./cmd/mocktools -addr :9191 -token secret -fail 0.2
+//
+// Start the server with TOOLS_FILE=tools.json and TOOLS_ALLOW_INSECURE=true.
+package main
+
+import (
+	"butter-socket/internal/llm"
+	"encoding/json"
+	"flag"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var statuses = []string{"processing", "shipped", "out_for_delivery", "delivered"}
+
+func main() {
+	addr := flag.String("addr", ":9191", "listen address")
+	token := flag.String("token", "", "bearer token callers must send; empty accepts any")
+	failRate := flag.Float64("fail", 0, "fraction of calls answered with 503")
+	delay := flag.Duration("delay", 0, "time to wait before answering")
+	printOnly := flag.Bool("print", false, "print a TOOLS_FILE registering these tools and exit")
+	company := flag.String("company", "", "company ID for -print")
+	flag.Parse()
+
+	if *printOnly {
+		printTools(os.Stdout, *company, *addr, *token)
+		return
+	}
+
+	var calls atomic.Int64
+	tool := func(name string, answer func(args map[string]any) (int, any)) {
+		http.HandleFunc("POST /"+name, func(w http.ResponseWriter, r *http.Request) {
+			n := calls.Add(1)
+			logger := slog.With(
+				"tool", name,
+				"call", n,
+				"conversation_id", r.Header.Get("X-Butter-Conversation"),
+				"tool_call_id", r.Header.Get("X-Butter-Tool-Call"),
+			)
+			if *token != "" && r.Header.Get("Authorization") != "Bearer "+*token {
+				logger.Warn("rejected call, bad token")
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			var args map[string]any
+			if err == nil {
+				err = json.Unmarshal(body, &args)
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "arguments must be a JSON object"})
+				return
+			}
+
+			time.Sleep(*delay)
+			if rand.Float64() < *failRate {
+				logger.Info("failing call on purpose")
+				writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "order system unavailable"})
+				return
+			}
+			status, out := answer(args)
+			logger.Info("tool called", "args", string(body), "status", status)
+			writeJSON(w, status, out)
+		})
+	}
+	tool("lookup_order", lookupOrder)
+	tool("cancel_order", cancelOrder)
+
+	slog.Info("mock tools listening", "addr", *addr, "fail_rate", *failRate)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		slog.Error("listen error", "error", err)
+		os.Exit(1)
+	}
+}
+
+// lookupOrder makes up a stable status for any order ID; IDs starting with
+// "X" don't exist
+func lookupOrder(args map[string]any) (int, any) {
+	id, _ := args["order_id"].(string)
+	if id == "" || strings.HasPrefix(strings.ToUpper(id), "X") {
+		return http.StatusNotFound, map[string]string{"error": "order not found"}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	sum := h.Sum32()
+	status := statuses[sum%uint32(len(statuses))]
+	out := map[string]any{
+		"order_id": id,
+		"status":   status,
+		"items":    1 + sum%4,
+	}
+	if status != "processing" {
+		out["carrier"] = "DHL"
+		out["tracking_number"] = "JD" + id
+	}
+	if status != "delivered" {
+		out["estimated_delivery"] = time.Now().AddDate(0, 0, int(1+sum%5)).Format(time.DateOnly)
+	}
+	return http.StatusOK, out
+}
+
+// cancelOrder accepts cancellations of orders that haven't shipped
+func cancelOrder(args map[string]any) (int, any) {
+	status, out := lookupOrder(args)
+	if status != http.StatusOK {
+		return status, out
+	}
+	order := out.(map[string]any)
+	if order["status"] != "processing" {
+		return http.StatusConflict, map[string]string{"error": "order already " + order["status"].(string) + ", it can only be returned"}
+	}
+	return http.StatusOK, map[string]any{"order_id": order["order_id"], "cancelled": true, "refund": "original payment method, 3-5 days"}
+}
+
+// printTools writes the registrations for these tools as a TOOLS_FILE
+func printTools(w io.Writer, company, addr, token string) {
+	base := "http://localhost" + addr
+	if !strings.HasPrefix(addr, ":") {
+		base = "http://" + addr
+	}
+	var headers map[string]string
+	if token != "" {
+		headers = map[string]string{"Authorization": "Bearer " + token}
+	}
+	orderID := map[string]any{"type": "string", "description": "The order number, e.g. 10452"}
+	tools := []llm.Tool{
+		{
+			CompanyID:   company,
+			Name:        "lookup_order",
+			Description: "Look up an order's status, carrier, tracking number and estimated delivery date.",
+			Parameters: map[string]any{
+				"type":                 "object",
+				"properties":           map[string]any{"order_id": orderID},
+				"required":             []any{"order_id"},
+				"additionalProperties": false,
+			},
+			URL:       base + "/lookup_order",
+			Headers:   headers,
+			TimeoutMS: 5000,
+		},
+		{
+			CompanyID:   company,
+			Name:        "cancel_order",
+			Description: "Cancel an order that has not shipped yet. Only call this after the customer confirms.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"order_id": orderID,
+					"reason":   map[string]any{"type": "string", "enum": []any{"changed_mind", "too_slow", "wrong_item", "other"}},
+				},
+				"required":             []any{"order_id", "reason"},
+				"additionalProperties": false,
+			},
+			URL:       base + "/cancel_order",
+			Headers:   headers,
+			TimeoutMS: 5000,
+		},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(tools)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"butter-socket/internal/llm"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOrders(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer func(map[string]any) (int, any)
+		args   map[string]any
+		status int
+	}{
+		{"lookup", lookupOrder, map[string]any{"order_id": "10452"}, http.StatusOK},
+		{"lookup unknown", lookupOrder, map[string]any{"order_id": "X1"}, http.StatusNotFound},
+		{"lookup without id", lookupOrder, map[string]any{}, http.StatusNotFound},
+		{"cancel unknown", cancelOrder, map[string]any{"order_id": "x9"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if status, out := tt.answer(tt.args); status != tt.status {
+			t.Errorf("%s: status %d (%v), want %d", tt.name, status, out, tt.status)
+		}
+	}
+
+	// the same order always has the same status, and only unshipped ones cancel
+	_, first := lookupOrder(map[string]any{"order_id": "10452"})
+	_, again := lookupOrder(map[string]any{"order_id": "10452"})
+	if first.(map[string]any)["status"] != again.(map[string]any)["status"] {
+		t.Error("order status changed between lookups")
+	}
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		_, order := lookupOrder(map[string]any{"order_id": id})
+		status, _ := cancelOrder(map[string]any{"order_id": id})
+		if want := order.(map[string]any)["status"] == "processing"; (status == http.StatusOK) != want {
+			t.Errorf("order %s %v: cancel status %d", id, order.(map[string]any)["status"], status)
+		}
+	}
+}
+
+func TestPrintedToolsRegister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tools.json")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printTools(f, "acme", ":9191", "secret")
+	f.Close()
+
+	r := llm.NewToolRegistry(true)
+	n, err := r.LoadFile(path)
+	if err != nil || n != 2 {
+		t.Fatalf("LoadFile = %d, %v", n, err)
+	}
+	if tools := r.Tools("acme"); tools[0].Name != "cancel_order" || tools[1].URL != "http://localhost:9191/lookup_order" {
+		t.Errorf("tools = %+v", tools)
+	}
+}
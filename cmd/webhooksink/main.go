@@ -0,0 +1,68 @@
+// Command webhooksink is a local stand-in for a company's webhook receiver. It
+// verifies signatures, logs every delivery and can be told to fail so retries
+// and circuit breaking can be watched end to end.
+//
+//	go run ./cmd/webhooksink -addr :9090 -secret whsec_... -fail 0.5
+//
+// Register it with WEBHOOKS_ALLOW_INSECURE=true and url http://localhost:9090/hook.
+package main
+
+import (
+	"butter-socket/internal/webhook"
+	"flag"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":9090", "listen address")
+	secret := flag.String("secret", "", "endpoint secret; empty skips signature checks")
+	failRate := flag.Float64("fail", 0, "fraction of deliveries answered with 503")
+	delay := flag.Duration("delay", 0, "time to wait before answering")
+	flag.Parse()
+
+	var received, rejected atomic.Int64
+	http.HandleFunc("POST /hook", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "read error", http.StatusBadRequest)
+			return
+		}
+		logger := slog.With(
+			"event", r.Header.Get("X-Butter-Event"),
+			"event_id", r.Header.Get("X-Butter-Event-Id"),
+			"delivery_id", r.Header.Get("X-Butter-Delivery"),
+		)
+
+		if *secret != "" {
+			if err := webhook.Verify(*secret, r.Header.Get(webhook.SignatureHeader), body, 5*time.Minute); err != nil {
+				rejected.Add(1)
+				logger.Warn("rejected delivery", "error", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		time.Sleep(*delay)
+		if rand.Float64() < *failRate {
+			logger.Info("failing delivery on purpose")
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		n := received.Add(1)
+		logger.Info("delivery received", "received", n, "rejected", rejected.Load(), "body", string(body))
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	slog.Info("webhook sink listening", "addr", *addr, "fail_rate", *failRate)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		slog.Error("listen error", "error", err)
+		os.Exit(1)
+	}
+}
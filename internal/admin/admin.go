@@ -0,0 +1,466 @@
+// Package admin is the operator HTTP API for inspecting and steering the live hub.
+package admin
+
+import (
+	"butter-socket/internal/handler"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/knowledge"
+	"butter-socket/internal/llm"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"butter-socket/internal/usage"
+	"butter-socket/internal/webhook"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API serves the admin endpoints under /admin/
+type API struct {
+	hub      *hub.Hub
+	token    string
+	usage    *usage.Tracker
+	webhooks *webhook.Manager
+	kb       *knowledge.Base
+	tools    *llm.ToolRegistry
+}
+
+// New creates the admin API. Every request must carry "Authorization: Bearer <token>".
+func New(h *hub.Hub, token string, tracker *usage.Tracker) *API {
+	return &API{hub: h, token: token, usage: tracker}
+}
+
+// UseWebhooks mounts the webhook endpoint, delivery log and replay routes
+func (a *API) UseWebhooks(m *webhook.Manager) {
+	a.webhooks = m
+}
+
+// UseKnowledge mounts the knowledge base document and search routes
+func (a *API) UseKnowledge(kb *knowledge.Base) {
+	a.kb = kb
+}
+
+// UseTools mounts the AI tool registration and call audit routes
+func (a *API) UseTools(r *llm.ToolRegistry) {
+	a.tools = r
+}
+
+// Handler returns the authenticated admin routes
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/agents", a.listAgents)
+	mux.HandleFunc("GET /admin/sessions", a.listSessions)
+	mux.HandleFunc("GET /admin/transfers", a.listTransfers)
+	mux.HandleFunc("GET /admin/usage", a.getUsage)
+	mux.HandleFunc("DELETE /admin/connections/{connID}", a.disconnect)
+	mux.HandleFunc("POST /admin/conversations/{conversationID}/reassign", a.reassign)
+	mux.HandleFunc("GET /admin/broadcasts", a.listBroadcasts)
+	mux.HandleFunc("POST /admin/broadcasts", a.createBroadcast)
+	mux.HandleFunc("GET /admin/broadcasts/{broadcastID}", a.getBroadcast)
+	mux.HandleFunc("GET /admin/supervision", a.listSupervision)
+	if a.webhooks != nil {
+		mux.HandleFunc("GET /admin/webhooks", a.listWebhooks)
+		mux.HandleFunc("POST /admin/webhooks", a.createWebhook)
+		mux.HandleFunc("DELETE /admin/webhooks/{endpointID}", a.deleteWebhook)
+		mux.HandleFunc("GET /admin/webhooks/{endpointID}/deliveries", a.listDeliveries)
+		mux.HandleFunc("POST /admin/webhooks/{endpointID}/deliveries/{deliveryID}/replay", a.replayDelivery)
+	}
+	if a.kb != nil {
+		mux.HandleFunc("GET /admin/knowledge/documents", a.listDocuments)
+		mux.HandleFunc("POST /admin/knowledge/documents", a.ingestDocument)
+		mux.HandleFunc("DELETE /admin/knowledge/documents/{documentID}", a.deleteDocument)
+		mux.HandleFunc("GET /admin/knowledge/search", a.searchKnowledge)
+	}
+	if a.tools != nil {
+		mux.HandleFunc("GET /admin/tools", a.listTools)
+		mux.HandleFunc("POST /admin/tools", a.createTool)
+		mux.HandleFunc("DELETE /admin/tools/{toolID}", a.deleteTool)
+		mux.HandleFunc("GET /admin/tools/calls", a.listToolCalls)
+	}
+	return a.authenticate(mux)
+}
+
+func (a *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			metrics.AuthFailures.WithLabelValues("admin", "unauthorized").Inc()
+			slog.Warn("admin request rejected", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET /admin/agents?company_id=&department_id=
+func (a *API) listAgents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	writeJSON(w, http.StatusOK, a.hub.OnlineAgents(q.Get("company_id"), q.Get("department_id")))
+}
+
+// GET /admin/sessions?company_id=&status=
+func (a *API) listSessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	writeJSON(w, http.StatusOK, a.hub.Sessions(q.Get("company_id"), q.Get("status")))
+}
+
+// GET /admin/transfers?company_id=
+func (a *API) listTransfers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.hub.Sessions(r.URL.Query().Get("company_id"), hub.StatusPendingTransfer))
+}
+
+type usageResponse struct {
+	CompanyID string       `json:"company_id"`
+	Budget    usage.Budget `json:"budget"`
+	Today     usage.Totals `json:"today"`
+	Month     usage.Totals `json:"month"`
+	Total     usage.Totals `json:"total"`
+}
+
+// GET /admin/usage?company_id=
+func (a *API) getUsage(w http.ResponseWriter, r *http.Request) {
+	companyID := r.URL.Query().Get("company_id")
+	if companyID == "" {
+		writeError(w, http.StatusBadRequest, "company_id is required")
+		return
+	}
+	if a.usage == nil {
+		writeError(w, http.StatusNotFound, "usage accounting is disabled")
+		return
+	}
+
+	now := time.Now()
+	writeJSON(w, http.StatusOK, usageResponse{
+		CompanyID: companyID,
+		Budget:    a.usage.Budget(companyID),
+		Today:     a.usage.DayTotals(companyID, now),
+		Month:     a.usage.MonthTotals(companyID, now),
+		Total:     a.usage.CompanyTotals(companyID),
+	})
+}
+
+// ofCompany reports whether something of companyID is within the request's
+// optional company_id scope
+func ofCompany(r *http.Request, companyID string) bool {
+	scope := r.URL.Query().Get("company_id")
+	return scope == "" || scope == companyID
+}
+
+// DELETE /admin/connections/{connID}?company_id=
+func (a *API) disconnect(w http.ResponseWriter, r *http.Request) {
+	connID := r.PathValue("connID")
+	client := a.hub.GetClientByConnId(connID)
+	if client == nil || !ofCompany(r, client.CompanyID()) {
+		writeError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+
+	client.Logger().Warn("connection force-disconnected by operator", logging.KeyEvent, "admin_disconnect", "remote_addr", r.RemoteAddr)
+	a.hub.Disconnect(client, "disconnected by operator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type reassignRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// POST /admin/conversations/{conversationID}/reassign?company_id= {"user_id": "..."}
+func (a *API) reassign(w http.ResponseWriter, r *http.Request) {
+	conversationID := r.PathValue("conversationID")
+
+	var req reassignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		writeError(w, http.StatusBadRequest, "body must be {\"user_id\": \"...\"}")
+		return
+	}
+	if customer := a.hub.GetClientByConversationId(conversationID); customer != nil && !ofCompany(r, customer.CompanyID()) {
+		writeError(w, http.StatusNotFound, handler.ErrConversationNotFound.Error())
+		return
+	}
+
+	err := handler.ReassignChat(a.hub, conversationID, req.UserID)
+	switch {
+	case errors.Is(err, handler.ErrConversationNotFound), errors.Is(err, handler.ErrUserNotOnline):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case errors.Is(err, handler.ErrCompanyMismatch):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	slog.Info("chat reassigned by operator",
+		logging.KeyEvent, "admin_reassign",
+		logging.KeyConversation, conversationID,
+		logging.KeyUser, req.UserID,
+		"remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type broadcastRequest struct {
+	hub.Scope
+	Content     string `json:"content"`
+	ContentType string `json:"content_type"`
+}
+
+// GET /admin/broadcasts?company_id=
+func (a *API) listBroadcasts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.hub.Broadcasts(r.URL.Query().Get("company_id")))
+}
+
+// POST /admin/broadcasts {"company_id": "...", "department_id": "...", "segment": "...", "audience": "all|customers|agents", "content": "..."}
+func (a *API) createBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req broadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.Content == "" {
+		writeError(w, http.StatusBadRequest, "content is required")
+		return
+	}
+
+	id, err := handler.Broadcast(a.hub, req.Scope, "admin", req.Content, req.ContentType)
+	switch {
+	case errors.Is(err, hub.ErrInvalidScope):
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	slog.Info("broadcast sent by operator",
+		logging.KeyEvent, "admin_broadcast",
+		logging.KeyCompany, req.CompanyID,
+		"broadcast_id", id,
+		"remote_addr", r.RemoteAddr)
+	report, _ := a.hub.BroadcastReport(id)
+	writeJSON(w, http.StatusAccepted, report)
+}
+
+// GET /admin/broadcasts/{broadcastID}
+func (a *API) getBroadcast(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.hub.BroadcastReport(r.PathValue("broadcastID"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "broadcast not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// GET /admin/supervision?company_id=
+func (a *API) listSupervision(w http.ResponseWriter, r *http.Request) {
+	actions, err := a.hub.Supervision(r.Context(), r.URL.Query().Get("company_id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, actions)
+}
+
+// GET /admin/webhooks?company_id=
+func (a *API) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.webhooks.Endpoints(r.URL.Query().Get("company_id")))
+}
+
+// POST /admin/webhooks {"company_id": "...", "url": "https://...", "events": [...], "secret": "..."}
+func (a *API) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhook.Endpoint
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	ep, err := a.webhooks.Register(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("webhook endpoint created by operator",
+		logging.KeyEvent, "admin_webhook_create",
+		logging.KeyCompany, ep.CompanyID,
+		"endpoint_id", ep.ID,
+		"remote_addr", r.RemoteAddr)
+	writeJSON(w, http.StatusCreated, ep)
+}
+
+// DELETE /admin/webhooks/{endpointID}
+func (a *API) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := a.webhooks.Remove(r.PathValue("endpointID")); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /admin/webhooks/{endpointID}/deliveries
+func (a *API) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := a.webhooks.Deliveries(r.PathValue("endpointID"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// POST /admin/webhooks/{endpointID}/deliveries/{deliveryID}/replay
+func (a *API) replayDelivery(w http.ResponseWriter, r *http.Request) {
+	d, err := a.webhooks.Replay(r.PathValue("endpointID"), r.PathValue("deliveryID"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	slog.Info("webhook delivery replayed by operator",
+		logging.KeyEvent, "admin_webhook_replay",
+		"endpoint_id", d.EndpointID,
+		"delivery_id", d.ReplayOf,
+		"remote_addr", r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, d)
+}
+
+// GET /admin/knowledge/documents?company_id=
+func (a *API) listDocuments(w http.ResponseWriter, r *http.Request) {
+	companyID := r.URL.Query().Get("company_id")
+	if companyID == "" {
+		writeError(w, http.StatusBadRequest, "company_id is required")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.kb.Documents(companyID))
+}
+
+// POST /admin/knowledge/documents {"company_id": "...", "title": "...", "format": "markdown", "content": "..."}
+func (a *API) ingestDocument(w http.ResponseWriter, r *http.Request) {
+	var req knowledge.Document
+	body := http.MaxBytesReader(w, r.Body, 2*knowledge.MaxDocument)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	info, err := a.kb.Ingest(r.Context(), req)
+	switch {
+	case errors.Is(err, knowledge.ErrInvalid):
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	slog.Info("knowledge document ingested by operator",
+		logging.KeyEvent, "admin_knowledge_ingest",
+		logging.KeyCompany, info.CompanyID,
+		"document_id", info.ID,
+		"chunks", info.Chunks,
+		"remote_addr", r.RemoteAddr)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// DELETE /admin/knowledge/documents/{documentID}
+func (a *API) deleteDocument(w http.ResponseWriter, r *http.Request) {
+	if err := a.kb.Remove(r.PathValue("documentID")); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /admin/knowledge/search?company_id=&q=&k=
+//
+// Shows the passages the AI would be given for a customer question
+func (a *API) searchKnowledge(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("company_id") == "" || q.Get("q") == "" {
+		writeError(w, http.StatusBadRequest, "company_id and q are required")
+		return
+	}
+	k := 4
+	if raw := q.Get("k"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 50 {
+			writeError(w, http.StatusBadRequest, "k must be between 1 and 50")
+			return
+		}
+		k = n
+	}
+
+	passages, err := a.kb.Search(r.Context(), q.Get("company_id"), q.Get("q"), k)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if passages == nil {
+		passages = []knowledge.Passage{}
+	}
+	writeJSON(w, http.StatusOK, passages)
+}
+
+// GET /admin/tools?company_id=
+func (a *API) listTools(w http.ResponseWriter, r *http.Request) {
+	companyID := r.URL.Query().Get("company_id")
+	if companyID == "" {
+		writeError(w, http.StatusBadRequest, "company_id is required")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.tools.Tools(companyID))
+}
+
+// POST /admin/tools {"company_id": "...", "name": "lookup_order", "description": "...",
+// "parameters": {...}, "url": "https://...", "headers": {...}, "timeout_ms": 5000}
+func (a *API) createTool(w http.ResponseWriter, r *http.Request) {
+	var req llm.Tool
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	t, err := a.tools.Register(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("tool registered by operator",
+		logging.KeyEvent, "admin_tool_create",
+		logging.KeyCompany, t.CompanyID,
+		"tool_id", t.ID,
+		"tool", t.Name,
+		"remote_addr", r.RemoteAddr)
+	writeJSON(w, http.StatusCreated, t)
+}
+
+// DELETE /admin/tools/{toolID}
+func (a *API) deleteTool(w http.ResponseWriter, r *http.Request) {
+	if err := a.tools.Remove(r.PathValue("toolID")); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /admin/tools/calls?company_id=
+func (a *API) listToolCalls(w http.ResponseWriter, r *http.Request) {
+	companyID := r.URL.Query().Get("company_id")
+	if companyID == "" {
+		writeError(w, http.StatusBadRequest, "company_id is required")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.tools.Calls(companyID))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,312 @@
+package admin
+
+import (
+	"butter-socket/internal/handler"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/knowledge"
+	"butter-socket/internal/llm"
+	"butter-socket/internal/store"
+	"butter-socket/internal/webhook"
+	"butter-socket/models"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testToken = "s3cret"
+
+func TestMain(m *testing.M) {
+	// every route logs what the operator did; keep test output readable
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testAPI serves the admin API with every optional route mounted, next to
+// the customer socket
+type testAPI struct {
+	t   *testing.T
+	hub *hub.Hub
+	srv *httptest.Server
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	h := hub.NewHub()
+	h.UseStore(store.NewMemory())
+	webhooks := webhook.NewManager(false)
+	t.Cleanup(webhooks.Close)
+
+	api := New(h, testToken, nil)
+	api.UseWebhooks(webhooks)
+	api.UseKnowledge(knowledge.NewBase())
+	api.UseTools(llm.NewToolRegistry(false))
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", api.Handler())
+	mux.HandleFunc("/ws/customer", func(w http.ResponseWriter, r *http.Request) { handler.WsHandler(h, w, r) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &testAPI{t: t, hub: h, srv: srv}
+}
+
+// do sends an authenticated request and decodes a JSON answer into out, if set
+func (a *testAPI) do(method, path, body string, out any) int {
+	a.t.Helper()
+	req, _ := http.NewRequest(method, a.srv.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			a.t.Fatalf("%s %s: decode answer: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// connectCustomer opens a customer socket and returns it with the hub's client
+func (a *testAPI) connectCustomer(customerID, companyID string) (*websocket.Conn, *hub.Client) {
+	a.t.Helper()
+	url := "ws" + strings.TrimPrefix(a.srv.URL, "http") + "/ws/customer?company_id=" + companyID + "&customer_id=" + customerID
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	a.t.Cleanup(func() { conn.Close() })
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if c := a.hub.GetCustomerConn(customerID); c != nil {
+			return conn, c
+		}
+	}
+	a.t.Fatalf("customer %s never registered", customerID)
+	return nil, nil
+}
+
+// connectAgent registers an agent without a socket; frames for them stay queued
+func (a *testAPI) connectAgent(userID, companyID string) *hub.Client {
+	agent := &hub.Client{
+		ID:   "conn-" + userID,
+		Type: "user",
+		Hub:  a.hub,
+		Send: hub.NewSendQueue(16, hub.SendPolicy{}),
+		User: &models.User{UserID: userID, CompanyID: companyID},
+	}
+	a.hub.RegisterClient(agent)
+	return agent
+}
+
+func TestAuthentication(t *testing.T) {
+	a := newTestAPI(t)
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"not a bearer token", "Basic " + testToken, http.StatusUnauthorized},
+		{"right token", "Bearer " + testToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, a.srv.URL+"/admin/sessions", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	a := newTestAPI(t)
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/admin/usage", "", http.StatusBadRequest},
+		{"POST", "/admin/conversations/c1/reassign", `{}`, http.StatusBadRequest},
+		{"POST", "/admin/conversations/c1/reassign", `not json`, http.StatusBadRequest},
+		{"POST", "/admin/broadcasts", `{`, http.StatusBadRequest},
+		{"POST", "/admin/broadcasts", `{"company_id":"acme"}`, http.StatusBadRequest},
+		{"POST", "/admin/broadcasts", `{"audience":"robots","content":"hi"}`, http.StatusBadRequest},
+		{"POST", "/admin/webhooks", `[]`, http.StatusBadRequest},
+		{"POST", "/admin/webhooks", `{"company_id":"acme","url":"http://hooks.example.com"}`, http.StatusBadRequest},
+		{"POST", "/admin/webhooks", `{"url":"https://hooks.example.com"}`, http.StatusBadRequest},
+		{"GET", "/admin/knowledge/documents", "", http.StatusBadRequest},
+		{"POST", "/admin/knowledge/documents", `{`, http.StatusBadRequest},
+		{"POST", "/admin/knowledge/documents", `{"company_id":"acme"}`, http.StatusBadRequest},
+		{"GET", "/admin/knowledge/search?company_id=acme", "", http.StatusBadRequest},
+		{"GET", "/admin/knowledge/search?company_id=acme&q=refund&k=99", "", http.StatusBadRequest},
+		{"GET", "/admin/tools", "", http.StatusBadRequest},
+		{"GET", "/admin/tools/calls", "", http.StatusBadRequest},
+		{"POST", "/admin/tools", `{`, http.StatusBadRequest},
+		{"POST", "/admin/tools", `{"company_id":"acme","name":"bad name","url":"https://tools.example.com"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var answer map[string]string
+		if status := a.do(tt.method, tt.path, tt.body, &answer); status != tt.status || answer["error"] == "" {
+			t.Errorf("%s %s %s: status %d, answer %v, want %d with an error", tt.method, tt.path, tt.body, status, answer, tt.status)
+		}
+	}
+}
+
+func TestCompanyScope(t *testing.T) {
+	a := newTestAPI(t)
+	conn, customer := a.connectCustomer("cust-1", "acme")
+	a.connectAgent("agent-1", "acme")
+	a.connectAgent("agent-2", "globex")
+	conversation := "/admin/conversations/" + customer.Conversation.Id + "/reassign"
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"disconnect another company's session", "DELETE", "/admin/connections/" + customer.ID + "?company_id=globex", "", http.StatusNotFound},
+		{"reassign another company's chat", "POST", conversation + "?company_id=globex", `{"user_id":"agent-2"}`, http.StatusNotFound},
+		{"reassign to another company's agent", "POST", conversation, `{"user_id":"agent-2"}`, http.StatusConflict},
+		{"reassign to an agent who is offline", "POST", conversation, `{"user_id":"agent-9"}`, http.StatusNotFound},
+		{"reassign an unknown chat", "POST", "/admin/conversations/nope/reassign", `{"user_id":"agent-1"}`, http.StatusNotFound},
+		{"reassign within the company", "POST", conversation + "?company_id=acme", `{"user_id":"agent-1"}`, http.StatusNoContent},
+		{"disconnect within the company", "DELETE", "/admin/connections/" + customer.ID + "?company_id=acme", "", http.StatusNoContent},
+		{"disconnect an unknown connection", "DELETE", "/admin/connections/nope", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if status := a.do(tt.method, tt.path, tt.body, nil); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+
+	if got := customer.Snapshot().AssignedTo; got != "agent-1" {
+		t.Errorf("conversation assigned to %q, want agent-1", got)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("socket ended with %v, want a policy violation close", err)
+			}
+			break
+		}
+	}
+}
+
+func TestBroadcastRoutes(t *testing.T) {
+	a := newTestAPI(t)
+	a.connectAgent("agent-1", "acme")
+
+	var report hub.BroadcastReport
+	if status := a.do("POST", "/admin/broadcasts", `{"company_id":"acme","audience":"agents","content":"system update at noon"}`, &report); status != http.StatusAccepted || report.ID == "" {
+		t.Fatalf("create broadcast: status %d, report %+v", status, report)
+	}
+	var got hub.BroadcastReport
+	if status := a.do("GET", "/admin/broadcasts/"+report.ID, "", &got); status != http.StatusOK || got.ID != report.ID {
+		t.Errorf("get broadcast: status %d, report %+v", status, got)
+	}
+	var list []hub.BroadcastReport
+	if status := a.do("GET", "/admin/broadcasts?company_id=acme", "", &list); status != http.StatusOK || len(list) != 1 {
+		t.Errorf("list broadcasts: status %d, %d reports", status, len(list))
+	}
+	if status := a.do("GET", "/admin/broadcasts/nope", "", nil); status != http.StatusNotFound {
+		t.Errorf("unknown broadcast: status %d", status)
+	}
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	a := newTestAPI(t)
+
+	var ep webhook.Endpoint
+	if status := a.do("POST", "/admin/webhooks", `{"company_id":"acme","url":"https://hooks.example.com/butter","events":["chat.accepted"]}`, &ep); status != http.StatusCreated || ep.ID == "" || ep.Secret == "" {
+		t.Fatalf("create webhook: status %d, endpoint %+v", status, ep)
+	}
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/admin/webhooks?company_id=acme", http.StatusOK},
+		{"GET", "/admin/webhooks/" + ep.ID + "/deliveries", http.StatusOK},
+		{"GET", "/admin/webhooks/nope/deliveries", http.StatusNotFound},
+		{"POST", "/admin/webhooks/" + ep.ID + "/deliveries/nope/replay", http.StatusNotFound},
+		{"DELETE", "/admin/webhooks/" + ep.ID, http.StatusNoContent},
+		{"DELETE", "/admin/webhooks/" + ep.ID, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if status := a.do(tt.method, tt.path, "", nil); status != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, status, tt.status)
+		}
+	}
+	var left []webhook.EndpointInfo
+	a.do("GET", "/admin/webhooks?company_id=acme", "", &left)
+	if len(left) != 0 {
+		t.Errorf("endpoints left after delete: %+v", left)
+	}
+}
+
+func TestKnowledgeRoutes(t *testing.T) {
+	a := newTestAPI(t)
+
+	var doc knowledge.DocumentInfo
+	body := `{"company_id":"acme","title":"Refunds","format":"markdown","content":"# Refunds\n\nRefunds reach your card within 5 working days."}`
+	if status := a.do("POST", "/admin/knowledge/documents", body, &doc); status != http.StatusCreated || doc.ID == "" || doc.Chunks == 0 {
+		t.Fatalf("ingest: status %d, document %+v", status, doc)
+	}
+
+	var passages []knowledge.Passage
+	if status := a.do("GET", "/admin/knowledge/search?company_id=acme&q=refund+card&k=2", "", &passages); status != http.StatusOK || len(passages) != 1 {
+		t.Errorf("search: status %d, passages %+v", status, passages)
+	}
+	var other []knowledge.Passage
+	if status := a.do("GET", "/admin/knowledge/search?company_id=globex&q=refund+card", "", &other); status != http.StatusOK || len(other) != 0 {
+		t.Errorf("search of another company: status %d, passages %+v", status, other)
+	}
+	var docs []knowledge.DocumentInfo
+	if status := a.do("GET", "/admin/knowledge/documents?company_id=acme", "", &docs); status != http.StatusOK || len(docs) != 1 {
+		t.Errorf("list: status %d, documents %+v", status, docs)
+	}
+	if status := a.do("DELETE", "/admin/knowledge/documents/"+doc.ID, "", nil); status != http.StatusNoContent {
+		t.Errorf("delete: status %d", status)
+	}
+	if status := a.do("DELETE", "/admin/knowledge/documents/"+doc.ID, "", nil); status != http.StatusNotFound {
+		t.Errorf("delete again: status %d", status)
+	}
+}
+
+func TestToolRoutes(t *testing.T) {
+	a := newTestAPI(t)
+
+	var tool llm.Tool
+	body := `{"company_id":"acme","name":"lookup_order","description":"Look up an order","url":"https://tools.example.com/orders",
+		"parameters":{"type":"object","properties":{"order_id":{"type":"string"}},"required":["order_id"]}}`
+	if status := a.do("POST", "/admin/tools", body, &tool); status != http.StatusCreated || tool.ID == "" {
+		t.Fatalf("register: status %d, tool %+v", status, tool)
+	}
+
+	var tools []llm.Tool
+	if status := a.do("GET", "/admin/tools?company_id=acme", "", &tools); status != http.StatusOK || len(tools) != 1 {
+		t.Errorf("list: status %d, tools %+v", status, tools)
+	}
+	if status := a.do("GET", "/admin/tools/calls?company_id=acme", "", nil); status != http.StatusOK {
+		t.Errorf("calls: status %d", status)
+	}
+	if status := a.do("DELETE", "/admin/tools/"+tool.ID, "", nil); status != http.StatusNoContent {
+		t.Errorf("delete: status %d", status)
+	}
+	if status := a.do("DELETE", "/admin/tools/"+tool.ID, "", nil); status != http.StatusNotFound {
+		t.Errorf("delete again: status %d", status)
+	}
+}
@@ -0,0 +1,102 @@
+// Package authz decides what an employee may do with a conversation, by role.
+package authz
+
+import (
+	"butter-socket/models"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Employee roles. Agents work the chats of their departments that are
+// assigned to them. Supervisors may also take over their departments' chats
+// from other agents, and watch, whisper into and barge in on any chat of
+// their company. Admins may act on any chat of their company.
+const (
+	RoleAgent      = "agent"
+	RoleSupervisor = "supervisor"
+	RoleAdmin      = "admin"
+)
+
+// Actions an employee takes on a conversation
+const (
+	Accept  = "accept"   // -> take the chat, from the AI or from another employee
+	Message = "message"  // -> write to the customer
+	Monitor = "monitor"  // -> watch the chat, read-only
+	Whisper = "whisper"  // -> write to the assigned agent only
+	BargeIn = "barge_in" // -> take the chat over from whoever has it
+	Note    = "note"     // -> leave an internal note for colleagues
+)
+
+// ErrForbidden is returned for actions the employee's role doesn't allow
+var ErrForbidden = errors.New("not allowed")
+
+// Role returns the user's role. Anything the auth service sends that isn't a
+// known role counts as an agent.
+func Role(u *models.User) string {
+	if u == nil {
+		return ""
+	}
+	switch role := strings.ToLower(strings.TrimSpace(u.Role)); role {
+	case RoleSupervisor, RoleAdmin:
+		return role
+	}
+	return RoleAgent
+}
+
+// HasRole reports whether the user has one of roles
+func HasRole(u *models.User, roles ...string) bool {
+	return u != nil && slices.Contains(roles, Role(u))
+}
+
+// Check returns nil when the user may take action on conv, or an error
+// wrapping ErrForbidden that says why not
+func Check(u *models.User, action string, conv *models.Conversation) error {
+	if u == nil || conv == nil {
+		return ErrForbidden
+	}
+	if u.CompanyID != conv.CompanyId {
+		return fmt.Errorf("%w: the conversation belongs to another company", ErrForbidden)
+	}
+	role := Role(u)
+	if role == RoleAdmin {
+		return nil
+	}
+
+	switch action {
+	case Accept:
+		if !InDepartment(u, conv.DepartmentId) {
+			return fmt.Errorf("%w: the conversation is routed to another department", ErrForbidden)
+		}
+		if conv.AssignedTo != "" && conv.AssignedTo != u.UserID && role != RoleSupervisor {
+			return fmt.Errorf("%w: the conversation is assigned to someone else", ErrForbidden)
+		}
+	case Message:
+		// whoever the chat was handed to may answer it, whatever their department
+		if conv.AssignedTo != u.UserID {
+			return fmt.Errorf("%w: the conversation is not assigned to you", ErrForbidden)
+		}
+	case Note:
+		// colleagues of the department may leave context too
+		if conv.AssignedTo != u.UserID && role != RoleSupervisor && !InDepartment(u, conv.DepartmentId) {
+			return fmt.Errorf("%w: the conversation is routed to another department", ErrForbidden)
+		}
+	case Monitor, Whisper, BargeIn:
+		if role != RoleSupervisor {
+			return fmt.Errorf("%w: %s is for supervisors", ErrForbidden, action)
+		}
+	default:
+		return fmt.Errorf("%w: unknown action %q", ErrForbidden, action)
+	}
+	return nil
+}
+
+// InDepartment reports whether the user works in a department. A
+// conversation not routed to any department is open to the whole company.
+func InDepartment(u *models.User, departmentID string) bool {
+	if departmentID == "" {
+		return true
+	}
+	return slices.ContainsFunc(u.Departments, func(d models.Department) bool { return d.DepartmentID == departmentID })
+}
@@ -0,0 +1,88 @@
+package authz
+
+import (
+	"butter-socket/models"
+	"errors"
+	"testing"
+)
+
+func user(id, role string, departments ...string) *models.User {
+	u := &models.User{UserID: id, CompanyID: "acme", Role: role}
+	for _, d := range departments {
+		u.Departments = append(u.Departments, models.Department{DepartmentID: d})
+	}
+	return u
+}
+
+func TestRole(t *testing.T) {
+	tests := []struct {
+		user *models.User
+		want string
+	}{
+		{nil, ""},
+		{user("u1", ""), RoleAgent},
+		{user("u1", "owner"), RoleAgent}, // -> unknown roles get the least
+		{user("u1", " Supervisor "), RoleSupervisor},
+		{user("u1", "ADMIN"), RoleAdmin},
+	}
+	for _, tt := range tests {
+		if got := Role(tt.user); got != tt.want {
+			t.Errorf("Role(%+v) = %q, want %q", tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	agent := user("agent-1", RoleAgent, "billing")
+	colleague := user("agent-2", RoleAgent, "billing")
+	outsider := user("agent-3", RoleAgent, "sales")
+	supervisor := user("super-1", RoleSupervisor, "billing")
+	admin := user("admin-1", RoleAdmin)
+	rival := &models.User{UserID: "admin-2", CompanyID: "globex", Role: RoleAdmin}
+
+	waiting := &models.Conversation{CompanyId: "acme", DepartmentId: "billing"}
+	unrouted := &models.Conversation{CompanyId: "acme"}
+	assigned := &models.Conversation{CompanyId: "acme", DepartmentId: "billing", AssignedTo: "agent-1"}
+
+	tests := []struct {
+		name    string
+		user    *models.User
+		action  string
+		conv    *models.Conversation
+		allowed bool
+	}{
+		{"no user", nil, Accept, waiting, false},
+		{"no conversation", agent, Accept, nil, false},
+		{"another company, even as admin", rival, Monitor, waiting, false},
+		{"admin does anything", admin, BargeIn, assigned, true},
+		{"unknown action", agent, "delete", assigned, false},
+
+		{"accept in own department", agent, Accept, waiting, true},
+		{"accept unrouted", outsider, Accept, unrouted, true},
+		{"accept in another department", outsider, Accept, waiting, false},
+		{"accept from a colleague", colleague, Accept, assigned, false},
+		{"supervisor takes over", supervisor, Accept, assigned, true},
+		{"accept own chat again", agent, Accept, assigned, true},
+
+		{"message own chat", agent, Message, assigned, true},
+		{"message a colleague's chat", colleague, Message, assigned, false},
+		{"message an unassigned chat", agent, Message, waiting, false},
+
+		{"note own chat", agent, Note, assigned, true},
+		{"note in own department", colleague, Note, assigned, true},
+		{"note in another department", outsider, Note, assigned, false},
+		{"supervisor notes anywhere", user("super-2", RoleSupervisor, "sales"), Note, assigned, true},
+
+		{"agent monitors", agent, Monitor, assigned, false},
+		{"agent whispers", agent, Whisper, assigned, false},
+		{"supervisor monitors", supervisor, Monitor, assigned, true},
+		{"supervisor whispers", supervisor, Whisper, assigned, true},
+		{"supervisor barges in elsewhere", user("super-2", RoleSupervisor, "sales"), BargeIn, assigned, true},
+	}
+	for _, tt := range tests {
+		err := Check(tt.user, tt.action, tt.conv)
+		if tt.allowed && err != nil || !tt.allowed && !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: Check = %v, want allowed %v", tt.name, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package bus carries hub events between server instances.
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when publishing on a closed bus
+var ErrClosed = errors.New("bus closed")
+
+// Envelope is one event travelling between nodes
+type Envelope struct {
+	Kind   string `json:"kind"`
+	Origin string `json:"origin"`           // node that published it
+	Target string `json:"target,omitempty"` // node it is for; empty means every other node
+
+	ClientType string          `json:"client_type,omitempty"` // customer or user
+	ClientID   string          `json:"client_id,omitempty"`   // customer ID, user ID or connection ID depending on Kind
+	CompanyID  string          `json:"company_id,omitempty"`  // company of company scoped kinds
+	Payload    json.RawMessage `json:"payload,omitempty"`
+}
+
+// Bus moves envelopes between nodes
+type Bus interface {
+	// Publish sends env to env.Target, or to every other node when Target is empty
+	Publish(ctx context.Context, env Envelope) error
+
+	// Subscribe delivers envelopes addressed to nodeID, in publish order, until
+	// the bus is closed. Envelopes published by nodeID itself are skipped.
+	Subscribe(nodeID string, handle func(Envelope)) error
+
+	Close() error
+}
+
+// Local is an in-process bus, used for a single instance and for running
+// several hubs inside one process
+type Local struct {
+	mu     sync.RWMutex
+	subs   map[string]chan Envelope
+	closed bool
+}
+
+// NewLocal creates an in-process bus
+func NewLocal() *Local {
+	return &Local{subs: make(map[string]chan Envelope)}
+}
+
+// Publish hands env to the subscribers it is addressed to
+func (l *Local) Publish(ctx context.Context, env Envelope) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+
+	for nodeID, ch := range l.subs {
+		if nodeID == env.Origin || (env.Target != "" && env.Target != nodeID) {
+			continue
+		}
+		select {
+		case ch <- env:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Subscribe registers nodeID and starts delivering to handle
+func (l *Local) Subscribe(nodeID string, handle func(Envelope)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if _, ok := l.subs[nodeID]; ok {
+		return errors.New("bus: node " + nodeID + " already subscribed")
+	}
+
+	ch := make(chan Envelope, 1024)
+	l.subs[nodeID] = ch
+	go func() {
+		for env := range ch {
+			handle(env)
+		}
+	}()
+	return nil
+}
+
+// Close stops every subscriber
+func (l *Local) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	for _, ch := range l.subs {
+		close(ch)
+	}
+	return nil
+}
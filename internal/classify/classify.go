@@ -0,0 +1,170 @@
+// Package classify sorts conversations into a company's taxonomy of intents
+// and topics, and reads their language, sentiment and urgency.
+package classify
+
+import (
+	"butter-socket/internal/llm"
+	"butter-socket/internal/usage"
+	"butter-socket/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maxCustomerText bounds the customer's words sent to the model; the
+// earliest are kept, they usually state the issue
+const maxCustomerText = 8 << 10
+
+// maxTopic bounds a free-form topic
+const maxTopic = 40
+
+var (
+	// ErrOverBudget is returned when the company has no AI budget left
+	ErrOverBudget = errors.New("company is over its AI budget")
+
+	// ErrBadReply is returned when the model's answer can't be read
+	ErrBadReply = errors.New("unreadable classification")
+)
+
+// Classifier classifies conversations with the LLM and books the tokens to
+// the conversation's company
+type Classifier struct {
+	cfg   Config
+	model string
+	usage *usage.Tracker
+}
+
+// New creates a classifier using model, or llm.DefaultModel when empty. A nil
+// tracker skips budgets and accounting.
+func New(cfg Config, model string, tracker *usage.Tracker) *Classifier {
+	return &Classifier{cfg: cfg, model: model, usage: tracker}
+}
+
+// Classify reads the customer's side of a conversation. It returns nil when
+// the customer hasn't written anything yet.
+func (c *Classifier) Classify(ctx context.Context, conv models.Conversation) (*models.Classification, error) {
+	text := customerText(conv.Messages)
+	if text == "" {
+		return nil, nil
+	}
+	taxonomy := c.cfg.Taxonomy(conv.CompanyId)
+
+	req := llm.Request{Model: c.model, Input: text, Instructions: instructions(taxonomy)}
+	if c.usage != nil && req.Model == "" {
+		decision := c.usage.Decide(conv.CompanyId)
+		if decision.Handoff {
+			return nil, ErrOverBudget
+		}
+		req.Model = decision.Model
+	}
+
+	out, used, err := llm.Complete(ctx, req)
+	if c.usage != nil {
+		c.usage.Record(usage.Record{
+			CompanyID:      conv.CompanyId,
+			ConversationID: conv.Id,
+			Model:          used.Model,
+			InputTokens:    used.InputTokens,
+			OutputTokens:   used.OutputTokens,
+			Latency:        used.Latency,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parse(out, taxonomy)
+}
+
+// instructions asks for one JSON object with a label from each list
+func instructions(t Taxonomy) string {
+	var b strings.Builder
+	b.WriteString("You classify customer support conversations. Read the customer's messages and reply with only a JSON object, no prose:\n")
+	b.WriteString(`{"intent": "...", "topic": "...", "language": "...", "sentiment": "...", "urgency": "..."}` + "\n")
+	fmt.Fprintf(&b, "intent: one of %s.\n", strings.Join(t.Intents, ", "))
+	if len(t.Topics) > 0 {
+		fmt.Fprintf(&b, "topic: one of %s, or other.\n", strings.Join(t.Topics, ", "))
+	} else {
+		b.WriteString("topic: the product or subject, in at most three lower case words joined by underscores.\n")
+	}
+	b.WriteString("language: the ISO 639-1 code of the language the customer writes in.\n")
+	fmt.Fprintf(&b, "sentiment: one of %s.\n", strings.Join(Sentiments, ", "))
+	fmt.Fprintf(&b, "urgency: one of %s; high for outages, safety, money already lost or a customer threatening to leave.\n", strings.Join(Urgencies, ", "))
+	return b.String()
+}
+
+// parse reads the model's JSON, forcing every label into the taxonomy
+func parse(reply string, t Taxonomy) (*models.Classification, error) {
+	start := strings.IndexByte(reply, '{')
+	end := strings.LastIndexByte(reply, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%w: no JSON object", ErrBadReply)
+	}
+	var raw struct {
+		Intent    string `json:"intent"`
+		Topic     string `json:"topic"`
+		Language  string `json:"language"`
+		Sentiment string `json:"sentiment"`
+		Urgency   string `json:"urgency"`
+	}
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadReply, err)
+	}
+
+	out := &models.Classification{
+		Intent:    pick(raw.Intent, t.Intents, "other"),
+		Topic:     normalize(raw.Topic),
+		Language:  language(raw.Language),
+		Sentiment: pick(raw.Sentiment, Sentiments, "neutral"),
+		Urgency:   pick(raw.Urgency, Urgencies, "normal"),
+	}
+	switch {
+	case len(t.Topics) > 0:
+		out.Topic = pick(out.Topic, t.Topics, "other")
+	case out.Topic == "":
+		out.Topic = "other"
+	case len(out.Topic) > maxTopic:
+		out.Topic = strings.TrimRight(out.Topic[:maxTopic], "_")
+	}
+	out.DepartmentID = t.department(out.Intent, out.Topic)
+	return out, nil
+}
+
+// pick keeps a label the list allows, or falls back
+func pick(label string, allowed []string, fallback string) string {
+	label = normalize(label)
+	if slices.Contains(allowed, label) {
+		return label
+	}
+	return fallback
+}
+
+// language keeps a two letter language code, or "und" for undetermined
+func language(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) == 2 && code[0] >= 'a' && code[0] <= 'z' && code[1] >= 'a' && code[1] <= 'z' {
+		return code
+	}
+	return "und"
+}
+
+// customerText joins what the customer wrote, earliest first
+func customerText(messages []models.Message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		if m.SenderType != "customer" {
+			continue
+		}
+		content := strings.Join(strings.Fields(m.Content), " ")
+		if content == "" {
+			continue
+		}
+		if b.Len()+len(content) > maxCustomerText {
+			break
+		}
+		b.WriteString(content + "\n")
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,117 @@
+package classify
+
+import (
+	"butter-socket/models"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	free := Config{}.Taxonomy("acme")
+	shop := Taxonomy{
+		Intents:     []string{"refund_request", "order_status"},
+		Topics:      []string{"shoes", "bags"},
+		Departments: map[string]string{"refund_request": "billing", "bags": "accessories"},
+	}
+	tests := []struct {
+		name     string
+		reply    string
+		taxonomy Taxonomy
+		want     models.Classification
+	}{
+		{
+			"labels kept",
+			`{"intent":"refund_request","topic":"shoes","language":"de","sentiment":"negative","urgency":"high"}`, shop,
+			models.Classification{Intent: "refund_request", Topic: "shoes", Language: "de", Sentiment: "negative", Urgency: "high", DepartmentID: "billing"},
+		},
+		{
+			"labels normalized, prose around the JSON",
+			"Sure! Here it is:\n```json\n{\"intent\":\"Order Status\",\"topic\":\"BAGS\",\"language\":\" EN \",\"sentiment\":\"Positive\",\"urgency\":\"LOW\"}\n```", shop,
+			models.Classification{Intent: "order_status", Topic: "bags", Language: "en", Sentiment: "positive", Urgency: "low", DepartmentID: "accessories"},
+		},
+		{
+			"unknown labels fall back",
+			`{"intent":"chit_chat","topic":"hats","language":"english","sentiment":"furious","urgency":"asap"}`, shop,
+			models.Classification{Intent: "other", Topic: "other", Language: "und", Sentiment: "neutral", Urgency: "normal"},
+		},
+		{
+			"missing labels fall back",
+			`{}`, free,
+			models.Classification{Intent: "other", Topic: "other", Language: "und", Sentiment: "neutral", Urgency: "normal"},
+		},
+		{
+			"free topic normalized and cut",
+			`{"intent":"billing","topic":"Premium Subscription Renewal Invoice Copy Request"}`, free,
+			models.Classification{Intent: "billing", Topic: "premium_subscription_renewal_invoice_cop", Language: "und", Sentiment: "neutral", Urgency: "normal"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parse(tt.reply, tt.taxonomy)
+		if err != nil || *got != tt.want {
+			t.Errorf("%s: parse = %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseBadReply(t *testing.T) {
+	for _, reply := range []string{
+		"",
+		"I can't classify this conversation.",
+		`{"intent": "refund_request"`,
+		`} backwards {`,
+		`{"intent": ["refund_request"]}`,
+	} {
+		if got, err := parse(reply, Config{}.Taxonomy("acme")); !errors.Is(err, ErrBadReply) {
+			t.Errorf("parse(%q) = %+v, %v, want ErrBadReply", reply, got, err)
+		}
+	}
+}
+
+func TestTaxonomy(t *testing.T) {
+	cfg := Config{
+		Default:   Taxonomy{Topics: []string{"shoes"}},
+		Companies: map[string]Taxonomy{"acme": {Intents: []string{"refund_request"}}},
+	}
+	tests := []struct {
+		companyID string
+		intents   string
+		topics    string
+	}{
+		{"acme", "refund_request", ""},
+		{"globex", strings.Join(DefaultIntents, ","), "shoes"}, // -> the default taxonomy with the default intents
+	}
+	for _, tt := range tests {
+		got := cfg.Taxonomy(tt.companyID)
+		if strings.Join(got.Intents, ",") != tt.intents || strings.Join(got.Topics, ",") != tt.topics {
+			t.Errorf("Taxonomy(%s) = %+v, want intents %s, topics %q", tt.companyID, got, tt.intents, tt.topics)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		file    string
+		wantErr string
+	}{
+		{`{"default":{"intents":["refund_request"],"departments":{"refund_request":"billing"}}}`, ""},
+		{`{"default":{"intents":["Refund Request"]}}`, `default taxonomy: label "Refund Request" must be lower case snake_case`},
+		{`{"companies":{"acme":{"topics":["shoes"],"departments":{"shoes":""}}}}`, `taxonomy for company acme: label "shoes" routes to an empty department`},
+		{`{"default":`, "parse taxonomy file"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "taxonomy.json")
+		if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("LoadConfig(%s) = %v, want %q", tt.file, err, tt.wantErr)
+		}
+	}
+	if cfg, err := LoadConfig(""); err != nil || len(cfg.Taxonomy("acme").Intents) != len(DefaultIntents) {
+		t.Errorf("LoadConfig without a file = %+v, %v, want the default intents", cfg, err)
+	}
+}
@@ -0,0 +1,113 @@
+package classify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// DefaultIntents are offered to the model when a company lists none
+var DefaultIntents = []string{
+	"question", "order_status", "refund_request", "cancellation", "complaint",
+	"technical_issue", "account_access", "billing", "purchase", "feedback", "other",
+}
+
+// Fixed scales every company shares
+var (
+	Sentiments = []string{"positive", "neutral", "negative"}
+	Urgencies  = []string{"low", "normal", "high"}
+)
+
+// Taxonomy is the labels a company wants its conversations sorted into and
+// where each should be routed
+type Taxonomy struct {
+	Intents     []string          `json:"intents,omitempty"`     // -> empty uses DefaultIntents
+	Topics      []string          `json:"topics,omitempty"`      // -> empty lets the model name one freely
+	Departments map[string]string `json:"departments,omitempty"` // -> intent or topic, department ID; intents win
+}
+
+// Config is the taxonomy file: a default taxonomy and per company overrides
+type Config struct {
+	Default   Taxonomy            `json:"default"`
+	Companies map[string]Taxonomy `json:"companies"`
+}
+
+// LoadConfig reads a taxonomy file. An empty path yields the default intents only.
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("read taxonomy file: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parse taxonomy file: %w", err)
+		}
+	}
+
+	if err := cfg.Default.validate(); err != nil {
+		return cfg, fmt.Errorf("default taxonomy: %w", err)
+	}
+	for companyID, t := range cfg.Companies {
+		if err := t.validate(); err != nil {
+			return cfg, fmt.Errorf("taxonomy for company %s: %w", companyID, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Taxonomy returns the company's taxonomy, or the default one
+func (c Config) Taxonomy(companyID string) Taxonomy {
+	t, ok := c.Companies[companyID]
+	if !ok {
+		t = c.Default
+	}
+	if len(t.Intents) == 0 {
+		t.Intents = DefaultIntents
+	}
+	return t
+}
+
+func (t Taxonomy) validate() error {
+	for _, label := range slices.Concat(t.Intents, t.Topics) {
+		if label != normalize(label) {
+			return fmt.Errorf("label %q must be lower case snake_case", label)
+		}
+	}
+	for label, dept := range t.Departments {
+		if dept == "" {
+			return fmt.Errorf("label %q routes to an empty department", label)
+		}
+	}
+	return nil
+}
+
+// department is where the taxonomy routes an intent or topic, or ""
+func (t Taxonomy) department(intent, topic string) string {
+	if d, ok := t.Departments[intent]; ok {
+		return d
+	}
+	return t.Departments[topic]
+}
+
+// normalize turns a label into lower case snake_case, e.g. "Order Status" to "order_status"
+func normalize(label string) string {
+	label = strings.ToLower(strings.TrimSpace(label))
+	var b strings.Builder
+	underscore := false
+	for _, r := range label {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			if underscore && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			underscore = false
+			b.WriteRune(r)
+		default:
+			underscore = true
+		}
+	}
+	return b.String()
+}
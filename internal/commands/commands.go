@@ -0,0 +1,90 @@
+// Package commands defines the instructions backend systems send into live chats.
+package commands
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Command types
+const (
+	SendMessage       = "send_message"       // -> message a customer in their conversation
+	NotifyAgent       = "notify_agent"       // -> notification for one agent
+	CloseConversation = "close_conversation" // -> end a customer's conversation
+	BroadcastCompany  = "broadcast_company"  // -> message the customers and agents of a company, optionally narrowed
+)
+
+// MaxContent bounds the text a command may carry
+const MaxContent = 4096
+
+// ErrInvalid marks a command that can never succeed, so it is not retried
+var ErrInvalid = errors.New("invalid command")
+
+// Command is one instruction from a backend system, e.g. the order service
+// telling a customer their refund was processed
+type Command struct {
+	ID             string `json:"id"`
+	Type           string `json:"type"`
+	Source         string `json:"source,omitempty"` // -> sending system, e.g. "crm"
+	CompanyID      string `json:"company_id"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	CustomerID     string `json:"customer_id,omitempty"` // -> used when ConversationID is empty
+	UserID         string `json:"user_id,omitempty"`
+	Content        string `json:"content,omitempty"`
+	ContentType    string `json:"content_type,omitempty"`
+
+	// broadcast_company only; empty fields don't narrow the audience
+	DepartmentID string `json:"department_id,omitempty"`
+	Segment      string `json:"segment,omitempty"`
+	Audience     string `json:"audience,omitempty"` // -> all, customers or agents
+}
+
+// Validate checks the command carries what its type needs
+func (c Command) Validate() error {
+	if c.ID == "" {
+		return invalid("missing id")
+	}
+	if c.CompanyID == "" {
+		return invalid("missing company_id")
+	}
+	if len(c.Content) > MaxContent {
+		return invalid("content longer than %d bytes", MaxContent)
+	}
+
+	switch c.Type {
+	case SendMessage:
+		if c.ConversationID == "" && c.CustomerID == "" {
+			return invalid("send_message needs conversation_id or customer_id")
+		}
+		if c.Content == "" {
+			return invalid("send_message needs content")
+		}
+	case NotifyAgent:
+		if c.UserID == "" {
+			return invalid("notify_agent needs user_id")
+		}
+		if c.Content == "" {
+			return invalid("notify_agent needs content")
+		}
+	case CloseConversation:
+		if c.ConversationID == "" && c.CustomerID == "" {
+			return invalid("close_conversation needs conversation_id or customer_id")
+		}
+	case BroadcastCompany:
+		if c.Content == "" {
+			return invalid("broadcast_company needs content")
+		}
+		switch c.Audience {
+		case "", "all", "customers", "agents":
+		default:
+			return invalid("unknown audience %q", c.Audience)
+		}
+	default:
+		return invalid("unknown type %q", c.Type)
+	}
+	return nil
+}
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
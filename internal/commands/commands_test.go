@@ -0,0 +1,40 @@
+package commands
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     Command
+		wantErr string // -> empty when the command is valid
+	}{
+		{"message by conversation", Command{ID: "1", Type: SendMessage, CompanyID: "acme", ConversationID: "c1", Content: "refund sent"}, ""},
+		{"message by customer", Command{ID: "1", Type: SendMessage, CompanyID: "acme", CustomerID: "cust-1", Content: "refund sent"}, ""},
+		{"notify", Command{ID: "1", Type: NotifyAgent, CompanyID: "acme", UserID: "agent-1", Content: "VIP waiting"}, ""},
+		{"close", Command{ID: "1", Type: CloseConversation, CompanyID: "acme", CustomerID: "cust-1"}, ""},
+		{"broadcast", Command{ID: "1", Type: BroadcastCompany, CompanyID: "acme", Content: "maintenance", Audience: "agents"}, ""},
+
+		{"no id", Command{Type: CloseConversation, CompanyID: "acme", CustomerID: "cust-1"}, "missing id"},
+		{"no company", Command{ID: "1", Type: CloseConversation, CustomerID: "cust-1"}, "missing company_id"},
+		{"unknown type", Command{ID: "1", Type: "reboot", CompanyID: "acme"}, `unknown type "reboot"`},
+		{"no type", Command{ID: "1", CompanyID: "acme"}, `unknown type ""`},
+		{"content too long", Command{ID: "1", Type: SendMessage, CompanyID: "acme", CustomerID: "cust-1", Content: strings.Repeat("a", MaxContent+1)}, "content longer than"},
+		{"message nobody", Command{ID: "1", Type: SendMessage, CompanyID: "acme", Content: "hi"}, "needs conversation_id or customer_id"},
+		{"empty message", Command{ID: "1", Type: SendMessage, CompanyID: "acme", CustomerID: "cust-1"}, "send_message needs content"},
+		{"notify nobody", Command{ID: "1", Type: NotifyAgent, CompanyID: "acme", Content: "hi"}, "needs user_id"},
+		{"empty notification", Command{ID: "1", Type: NotifyAgent, CompanyID: "acme", UserID: "agent-1"}, "notify_agent needs content"},
+		{"close nothing", Command{ID: "1", Type: CloseConversation, CompanyID: "acme"}, "needs conversation_id or customer_id"},
+		{"empty broadcast", Command{ID: "1", Type: BroadcastCompany, CompanyID: "acme"}, "broadcast_company needs content"},
+		{"unknown audience", Command{ID: "1", Type: BroadcastCompany, CompanyID: "acme", Content: "hi", Audience: "robots"}, `unknown audience "robots"`},
+	}
+	for _, tt := range tests {
+		err := tt.cmd.Validate()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (!errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: Validate = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
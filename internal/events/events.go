@@ -0,0 +1,86 @@
+// Package events defines the domain events raised by chats and where they are published.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Domain event types, also the first words of the routing key
+const (
+	ConversationStarted    = "conversation.started"
+	MessageCreated         = "message.created"
+	NoteCreated            = "note.created" // -> an internal note, for agents only
+	ChatTransferred        = "chat.transferred"
+	ChatAccepted           = "chat.accepted"
+	ConversationClosed     = "conversation.closed"
+	ConversationSummarized = "conversation.summarized"
+	ConversationClassified = "conversation.classified"
+	MessageModerated       = "message.moderated"
+	ChatMonitored          = "chat.monitored"
+	ChatUnmonitored        = "chat.unmonitored"
+	ChatWhispered          = "chat.whispered"
+	ChatBargedIn           = "chat.barged_in"
+)
+
+// Event is one thing that happened in a conversation
+type Event struct {
+	ID             string          `json:"id"`
+	Type           string          `json:"type"`
+	OccurredAt     time.Time       `json:"occurred_at"`
+	CompanyID      string          `json:"company_id"`
+	ConversationID string          `json:"conversation_id"`
+	Data           json.RawMessage `json:"data,omitempty"`
+}
+
+// New builds an event with a fresh ID
+func New(eventType, companyID, conversationID string, data any) Event {
+	raw, _ := json.Marshal(data)
+	return Event{
+		ID:             uuid.New().String(),
+		Type:           eventType,
+		OccurredAt:     time.Now().UTC(),
+		CompanyID:      companyID,
+		ConversationID: conversationID,
+		Data:           raw,
+	}
+}
+
+// RoutingKey is "<type>.<company>", e.g. "message.created.acme", so consumers
+// can bind on "message.created.*" or "#.acme"
+func (e Event) RoutingKey() string {
+	return e.Type + "." + e.CompanyID
+}
+
+// Publisher delivers events to a broker
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// Discard is a Publisher that drops every event, for running without a broker
+var Discard Publisher = discard{}
+
+type discard struct{}
+
+func (discard) Publish(ctx context.Context, e Event) error { return nil }
+
+// All publishes to each publisher in turn and stops at the first error, so a
+// retried event is not published twice to the ones before it. Publishers that
+// never fail belong last.
+func All(pubs ...Publisher) Publisher {
+	return all(pubs)
+}
+
+type all []Publisher
+
+func (a all) Publish(ctx context.Context, e Event) error {
+	for _, p := range a {
+		if err := p.Publish(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
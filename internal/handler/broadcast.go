@@ -0,0 +1,20 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/models"
+	"encoding/json"
+)
+
+// Broadcast sends an announcement to every client in scope, on every node,
+// and returns the ID of its delivery report
+func Broadcast(h *hub.Hub, scope hub.Scope, source, content, contentType string) (string, error) {
+	frame, err := json.Marshal(models.WSMessage{
+		Type:    "broadcast",
+		Payload: systemMessage(source, "", content, contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return h.Broadcast(scope, frame, source)
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/internal/llm"
+	"butter-socket/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunk coalescing defaults, used when Services leaves them zero
+const (
+	defaultChunkWindow   = 50 * time.Millisecond
+	defaultChunkMaxBytes = 512
+)
+
+// ChunkBatching controls how streamed AI tokens are merged into message_chunk
+// frames. A negative Window sends every token in its own frame.
+type ChunkBatching struct {
+	Window   time.Duration // -> longest a token waits for company
+	MaxBytes int           // -> flush as soon as this much text is waiting
+}
+
+// chunkBatcher merges the tokens of one AI reply into message_chunk frames.
+// The first token goes out on its own so the customer sees the reply start
+// right away; later tokens wait up to Window or until MaxBytes pile up.
+// Under moderation every batch is moderated first, and the tail of the reply
+// is held back until the rest arrives so nothing masked or blocked slips out
+// between two chunks.
+type chunkBatcher struct {
+	client     *hub.Client
+	messageID  string
+	cfg        ChunkBatching
+	moderation *llm.Stream // -> nil without moderation
+
+	mu      sync.Mutex
+	pending strings.Builder
+	timer   *time.Timer
+	started bool
+}
+
+func newChunkBatcher(client *hub.Client, messageID string, cfg ChunkBatching) *chunkBatcher {
+	if cfg.Window == 0 {
+		cfg.Window = defaultChunkWindow
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultChunkMaxBytes
+	}
+	b := &chunkBatcher{client: client, messageID: messageID, cfg: cfg}
+	if services.Moderation != nil {
+		b.moderation = services.Moderation.Stream(client.CompanyID())
+	}
+	return b
+}
+
+// add queues a token, sending it now when it is the first, batching is off
+// or the batch is full
+func (b *chunkBatcher) add(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending.WriteString(token)
+	if !b.started || b.cfg.Window < 0 || b.pending.Len() >= b.cfg.MaxBytes {
+		b.started = true
+		b.flushLocked(false)
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.cfg.Window, b.flush)
+	}
+}
+
+// flush sends whatever is waiting, short of the tail moderation holds back
+func (b *chunkBatcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked(false)
+}
+
+// finish sends everything left once the reply has ended
+func (b *chunkBatcher) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked(true)
+}
+
+func (b *chunkBatcher) flushLocked(final bool) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	text := b.pending.String()
+	b.pending.Reset()
+	if b.moderation != nil {
+		// a blocked reply streams no further; the whole reply is retracted once it ends
+		text, _ = b.moderation.Next(text, final)
+	}
+	if text == "" {
+		return
+	}
+	sendMessage(b.client, "message_chunk", models.MsgInOut{
+		MessageId:   b.messageID,
+		SenderType:  "AI-AGENT",
+		Content:     text,
+		ContentType: "text",
+	})
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/models"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// chunks takes the message_chunk contents queued for client, in order
+func chunks(t *testing.T, client *hub.Client) []string {
+	t.Helper()
+	frames, _ := client.Send.Take()
+	var got []string
+	for _, data := range frames {
+		var frame struct {
+			Type    string          `json:"type"`
+			Payload models.MsgInOut `json:"payload"`
+		}
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != "message_chunk" || frame.Payload.MessageId != "msg-1" {
+			t.Fatalf("unexpected frame %s", data)
+		}
+		got = append(got, frame.Payload.Content)
+	}
+	return got
+}
+
+func TestChunkBatcher(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    ChunkBatching
+		tokens []string
+		want   []string // -> the frames, the final flush included
+	}{
+		{"first token alone, the rest by size", ChunkBatching{Window: time.Hour, MaxBytes: 8}, []string{"Hi", " there", " how", " are", " you", "?"}, []string{"Hi", " there how", " are you", "?"}},
+		{"final flush", ChunkBatching{Window: time.Hour}, []string{"a", "b", "c"}, []string{"a", "bc"}},
+		{"batching off", ChunkBatching{Window: -1}, []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"nothing streamed", ChunkBatching{}, nil, nil},
+	}
+	for _, tt := range tests {
+		client := queued(nil, "c1", fromCustomer)
+		b := newChunkBatcher(client, "msg-1", tt.cfg)
+		for _, token := range tt.tokens {
+			b.add(token)
+		}
+		b.finish()
+		if got := chunks(t, client); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: sent %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChunkBatcherWindow(t *testing.T) {
+	client := queued(nil, "c1", fromCustomer)
+	b := newChunkBatcher(client, "msg-1", ChunkBatching{Window: 10 * time.Millisecond})
+	b.add("Hello")
+	b.add(",")
+	b.add(" world")
+
+	var got []string
+	for deadline := time.Now().Add(time.Second); len(got) < 2 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		got = append(got, chunks(t, client)...)
+	}
+	if want := []string{"Hello", ", world"}; !slices.Equal(got, want) {
+		t.Fatalf("sent %q once the window passed, want %q", got, want)
+	}
+
+	// finish sends what is still waiting and stops its window
+	b.add("!")
+	b.finish()
+	if got := chunks(t, client); !slices.Equal(got, []string{"!"}) {
+		t.Errorf("final flush sent %q, want the last token", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := chunks(t, client); len(got) != 0 {
+		t.Errorf("sent %q after the reply ended", got)
+	}
+}
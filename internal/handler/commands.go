@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"butter-socket/internal/commands"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
+	"butter-socket/models"
+	"log/slog"
+	"time"
+)
+
+// RunCommand carries out a backend command against the hub. The command must
+// already be valid.
+func RunCommand(h *hub.Hub, cmd commands.Command) error {
+	logger := slog.Default().With(
+		logging.KeyEvent, cmd.Type,
+		logging.KeyCompany, cmd.CompanyID,
+		"command_id", cmd.ID,
+		"source", cmd.Source,
+	)
+
+	switch cmd.Type {
+	case commands.SendMessage:
+		customer, err := commandCustomer(h, cmd)
+		if err != nil {
+			return err
+		}
+		msg := commandMessage(cmd, customer.Customer.Id)
+		sendMessage(customer, "message", msg)
+
+		// the agent handling the chat sees what the backend said
+		if customer.Status() == hub.StatusWithAgent {
+			if agent := h.GetUserConnByUserId(customer.Agent().UserID); agent != nil {
+				sendMessage(agent, "message", msg)
+			}
+		}
+		h.SaveMessage(customer, msg)
+		logger.Info("command delivered", logging.KeyConversation, customer.Conversation.Id)
+
+	case commands.NotifyAgent:
+		agent := h.GetUserConnByUserId(cmd.UserID)
+		if agent == nil {
+			return ErrUserNotOnline
+		}
+		if agent.CompanyID() != cmd.CompanyID {
+			return ErrCompanyMismatch
+		}
+		sendMessage(agent, "notification", commandMessage(cmd, cmd.UserID))
+		logger.Info("command delivered", logging.KeyUser, cmd.UserID)
+
+	case commands.CloseConversation:
+		customer, err := commandCustomer(h, cmd)
+		if err != nil {
+			return err
+		}
+		closing := commandMessage(cmd, customer.Customer.Id)
+		if closing.Content == "" {
+			closing.Content = "this conversation has been closed"
+		}
+		sendMessage(customer, "conversation_closed", closing)
+		if assigned := customer.Agent(); assigned != nil {
+			if agent := h.GetUserConnByUserId(assigned.UserID); agent != nil {
+				sendMessage(agent, "conversation_closed", customer.Snapshot())
+			}
+		}
+		h.CloseConversation(customer, "conversation closed")
+
+	case commands.BroadcastCompany:
+		scope := hub.Scope{
+			CompanyID:    cmd.CompanyID,
+			DepartmentID: cmd.DepartmentID,
+			Segment:      cmd.Segment,
+			Audience:     cmd.Audience,
+		}
+		id, err := Broadcast(h, scope, cmd.Source, cmd.Content, cmd.ContentType)
+		if err != nil {
+			return err
+		}
+		logger.Info("command broadcast", "broadcast_id", id)
+	}
+	return nil
+}
+
+// commandCustomer finds the customer a command is about, by conversation or customer ID
+func commandCustomer(h *hub.Hub, cmd commands.Command) (*hub.Client, error) {
+	var customer *hub.Client
+	if cmd.ConversationID != "" {
+		customer = h.GetClientByConversationId(cmd.ConversationID)
+		if customer == nil {
+			return nil, ErrConversationNotFound
+		}
+	} else {
+		customer = h.GetCustomerConn(cmd.CustomerID)
+		if customer == nil {
+			return nil, ErrCustomerNotOnline
+		}
+	}
+	if customer.CompanyID() != cmd.CompanyID {
+		return nil, ErrCompanyMismatch
+	}
+	return customer, nil
+}
+
+func commandMessage(cmd commands.Command, receiverID string) models.MsgInOut {
+	return systemMessage(cmd.Source, receiverID, cmd.Content, cmd.ContentType)
+}
+
+// systemMessage is a message from a backend system or operator, sent as "system"
+// when sender is empty
+func systemMessage(sender, receiverID, content, contentType string) models.MsgInOut {
+	if sender == "" {
+		sender = "system"
+	}
+	if contentType == "" {
+		contentType = "text"
+	}
+	return models.MsgInOut{
+		SenderId:    sender,
+		SenderType:  "system",
+		ReceiverId:  receiverID,
+		Content:     content,
+		ContentType: contentType,
+		CreatedAt:   time.Now().Format(time.RFC3339),
+	}
+}
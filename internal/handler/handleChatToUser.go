@@ -1,19 +1,44 @@
 package handler
 
 import (
+	"butter-socket/internal/authz"
+	"butter-socket/internal/events"
 	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
 	"butter-socket/models"
-	"encoding/json"
-	"fmt"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrUserNotOnline        = errors.New("user is not online")
+	ErrCustomerNotOnline    = errors.New("customer is not online")
+	ErrCompanyMismatch      = errors.New("user belongs to another company")
+)
+
+// How long a transfer offer waits for the conversation to be classified and
+// to be summarized before going out without. Both run side by side, so a slow
+// summary doesn't eat into the classification that routes the offer.
+const (
+	transferClassifyTimeout = 5 * time.Second
+	transferSummaryTimeout  = 8 * time.Second
 )
 
 // trigger name: transfer_chat
-func handleChatTransferToUser(client *hub.Client, payload any) {
-	if !client.SosFlag {
-		client.SosFlag = true
-		fmt.Println("flag waving: ", client.SosFlag)
+//
+// Agents are offered the server's view of the conversation, classified and
+// summarized so far, rather than whatever the customer sent
+func handleChatTransferToUser(client *hub.Client, _ any) {
+	if client.RequestHuman() {
 		connList := client.Hub.GetAllUserConnByCompanyId(client.Conversation.CompanyId)
-		fmt.Println(len(connList))
+		client.Logger().Info("customer requested a human", logging.KeyEvent, "transfer_chat", "available_users", len(connList))
+		client.Hub.Emit(client, events.ChatTransferred, transferData{
+			CustomerID:     client.Customer.Id,
+			AvailableUsers: len(connList),
+		})
 		if len(connList) == 0 {
 			unavilableMsgPayload := models.MsgInOut{
 				SenderType: "system",
@@ -23,50 +48,177 @@ func handleChatTransferToUser(client *hub.Client, payload any) {
 			}
 			sendMessage(client, "connection_event", unavilableMsgPayload)
 		} else {
-			for _, conn := range connList {
-				sendMessage(conn, "transfer_chat", payload)
-			}
+			// summarizing takes a model call, keep it off the read loop
+			client.Hub.Go(func() { offerTransfer(client, connList) })
 		}
 	}
 
 }
 
+// offerTransfer classifies and summarizes the conversation for the agents
+// and offers it to those of the department it is routed to
+func offerTransfer(client *hub.Client, agents []*hub.Client) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), transferClassifyTimeout)
+		defer cancel()
+		if _, err := client.Hub.Classify(ctx, client, hub.StageHandoff); err != nil {
+			client.Logger().Warn("handoff classification failed, offering the chat to every department", logging.KeyEvent, "transfer_chat", "error", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), transferSummaryTimeout)
+		defer cancel()
+		if _, err := client.Hub.Summarize(ctx, client, hub.StageHandoff); err != nil {
+			client.Logger().Warn("handoff summary failed, offering the chat without it", logging.KeyEvent, "transfer_chat", "error", err)
+		}
+	}()
+	wg.Wait()
+
+	// with nobody of its department online the chat goes back to the company
+	// queue, so whichever agent accepts it is allowed to
+	offer := client.Snapshot()
+	routed := inDepartment(agents, offer.DepartmentId)
+	if len(routed) == 0 {
+		client.Logger().Info("no agent of the department online, offering the chat company wide",
+			logging.KeyEvent, "transfer_chat", "department_id", offer.DepartmentId)
+		offer = client.UpdateConversation(func(conv *models.Conversation) { conv.DepartmentId = "" })
+		routed = agents
+	}
+	for _, conn := range routed {
+		sendMessage(conn, "transfer_chat", offer)
+	}
+}
+
+// inDepartment narrows agents to those working in a department
+func inDepartment(agents []*hub.Client, departmentID string) []*hub.Client {
+	var out []*hub.Client
+	for _, a := range agents {
+		if authz.InDepartment(a.User, departmentID) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
 // trigger name: accept_chat (for users)
+//
+// The router has checked the user may take the chat; a supervisor taking it
+// over from another agent lets that agent know
 func handleHumanAcceptTheChat(client *hub.Client, payload any) {
-	payloadBytes, _ := json.Marshal(payload)
-	var transferPayload models.Conversation
-	json.Unmarshal(payloadBytes, &transferPayload)
+	transferPayload := payload.(models.Conversation)
 
-	if client.Hub.GetAllClients()[transferPayload.Customer.Id] != nil {
-		client.SosFlag = true
-		client.FlagRevealed = true
-		customer := client.Hub.GetAllClients()[transferPayload.Customer.Id]
-		customer.FlagRevealed = true
-		customer.User = client.User
+	if customer := client.Hub.GetCustomerConn(transferPayload.Customer.Id); customer != nil {
+		previous := client.Hub.AssignAgent(customer, client.User)
+		client.Logger().Info("human accepted the chat",
+			logging.KeyEvent, "accept_chat",
+			logging.KeyConversation, customer.Conversation.Id,
+			logging.KeyCustomer, customer.Customer.Id)
+		accepted := acceptData{CustomerID: customer.Customer.Id, UserID: client.User.UserID}
+		if previous != nil && previous.UserID != client.User.UserID {
+			accepted.PreviousUserID = previous.UserID
+			notifyReassigned(client.Hub, previous, customer.Conversation.Id)
+		}
+		client.Hub.Emit(customer, events.ChatAccepted, accepted)
 
 		unavilableMsgPayload := models.MsgInOut{
 			SenderId:   "system",
 			ReceiverId: transferPayload.Customer.Id,
 			Content:    "human communication started",
 		}
-		sendMessage(client.Hub.GetAllClients()[transferPayload.Customer.Id], "connection_event", unavilableMsgPayload)
+		sendMessage(customer, "connection_event", unavilableMsgPayload)
+	}
+}
+
+// ReassignChat hands a customer's conversation to another online user of the
+// same company and tells the customer and both users about it
+func ReassignChat(h *hub.Hub, conversationID, userID string) error {
+	customer := h.GetClientByConversationId(conversationID)
+	if customer == nil {
+		return ErrConversationNotFound
+	}
+	agent := h.GetUserConnByUserId(userID)
+	if agent == nil {
+		return ErrUserNotOnline
+	}
+	if agent.User.CompanyID != customer.CompanyID() {
+		return ErrCompanyMismatch
+	}
+
+	previous := h.AssignAgent(customer, agent.User)
+
+	customer.Logger().Info("chat reassigned",
+		logging.KeyEvent, "reassign_chat",
+		logging.KeyUser, agent.User.UserID)
+	accepted := acceptData{CustomerID: customer.Customer.Id, UserID: agent.User.UserID}
+	if previous != nil {
+		accepted.PreviousUserID = previous.UserID
+	}
+	h.Emit(customer, events.ChatAccepted, accepted)
+
+	sendMessage(agent, "chat_assigned", customer.Snapshot())
+	if previous != nil && previous.UserID != agent.User.UserID {
+		notifyReassigned(h, previous, conversationID)
+	}
+	sendMessage(customer, "connection_event", models.MsgInOut{
+		SenderId:   "system",
+		SenderType: "system",
+		ReceiverId: customer.Customer.Id,
+		Content:    "you are now chatting with another agent",
+	})
+	return nil
+}
+
+// notifyReassigned tells a user a conversation they had went to someone else
+func notifyReassigned(h *hub.Hub, previous *models.User, conversationID string) {
+	if old := h.GetUserConnByUserId(previous.UserID); old != nil {
+		sendMessage(old, "chat_reassigned", models.MsgInOut{
+			SenderId:   "system",
+			SenderType: "system",
+			ReceiverId: previous.UserID,
+			Content:    conversationID,
+		})
 	}
 }
 
 // trigger name: message
+//
+// Messages arrive moderated, so the other side gets the masked text the
+// conversation stores
 func handleConversationWithHuman(client *hub.Client, payload any) {
+	msgPayload := payload.(models.MsgInOut)
+
 	if client.Type == "customer" {
-		user := client.User
-		sendMessage(client.Hub.GetUserConnByUserId(user.UserID), "message", payload)
+		user := client.Agent()
+		msgPayload.ReceiverId = user.UserID
+		if conn := client.Hub.GetUserConnByUserId(user.UserID); conn != nil {
+			sendMessage(conn, "message", msgPayload)
+		}
+		client.Hub.SaveMessage(client, msgPayload)
 	} else {
-		payloadBytes, _ := json.Marshal(payload)
-		var msgPayload models.MsgInOut
-		json.Unmarshal(payloadBytes, &msgPayload)
-		customer := client.Hub.GetAllClients()[msgPayload.ReceiverId]
-		sendMessage(customer, "message", payload)
+		if customer := client.Hub.GetCustomerConn(msgPayload.ReceiverId); customer != nil {
+			sendMessage(customer, "message", msgPayload)
+			client.Hub.SaveMessage(customer, msgPayload)
+		}
 	}
 }
 
+// transferData is the payload of chat.transferred
+type transferData struct {
+	CustomerID     string `json:"customer_id"`
+	AvailableUsers int    `json:"available_users"`
+}
+
+// acceptData is the payload of chat.accepted
+type acceptData struct {
+	CustomerID     string `json:"customer_id"`
+	UserID         string `json:"user_id"`
+	PreviousUserID string `json:"previous_user_id,omitempty"`
+}
+
 // trigger name: typing
 // func typingUpdate(client *hub.Client, payload any) {
 // 	if client.Type == "customer" {
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/models"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// rendezvous classifies and summarizes, each only once the other has been
+// asked, so the two must run side by side
+type rendezvous struct {
+	classifying, summarizing chan struct{}
+}
+
+func (r rendezvous) Classify(ctx context.Context, conv models.Conversation) (*models.Classification, error) {
+	close(r.classifying)
+	select {
+	case <-r.summarizing:
+		return &models.Classification{Intent: "refund", DepartmentID: "billing"}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r rendezvous) Summarize(ctx context.Context, conv models.Conversation) (string, error) {
+	close(r.summarizing)
+	select {
+	case <-r.classifying:
+		return "wants a refund", nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func TestOfferTransfer(t *testing.T) {
+	h := hub.NewHub()
+	r := rendezvous{classifying: make(chan struct{}), summarizing: make(chan struct{})}
+	h.UseClassifier(r)
+	h.UseSummaries(r)
+
+	customer := &hub.Client{
+		ID:           "conn-1",
+		Type:         "customer",
+		Hub:          h,
+		Send:         hub.NewSendQueue(16, hub.SendPolicy{}),
+		Customer:     &models.Customer{Id: "cust-1", CompanyId: "acme"},
+		Conversation: &models.Conversation{Id: "conv-1", CompanyId: "acme"},
+	}
+	agent := func(id, department string) *hub.Client {
+		return &hub.Client{
+			ID:   "conn-" + id,
+			Type: "user",
+			Send: hub.NewSendQueue(16, hub.SendPolicy{}),
+			User: &models.User{UserID: id, CompanyID: "acme", Departments: []models.Department{{DepartmentID: department}}},
+		}
+	}
+	billing, sales := agent("agent-1", "billing"), agent("agent-2", "sales")
+
+	offerTransfer(customer, []*hub.Client{billing, sales})
+
+	frames, _ := billing.Send.Take()
+	if len(frames) != 1 {
+		t.Fatalf("billing agent got %d frames, want the offer", len(frames))
+	}
+	var offer struct {
+		Type    string              `json:"type"`
+		Payload models.Conversation `json:"payload"`
+	}
+	json.Unmarshal(frames[0], &offer)
+	if offer.Type != "transfer_chat" || offer.Payload.Summary != "wants a refund" || offer.Payload.DepartmentId != "billing" {
+		t.Errorf("offer %s, want it classified and summarized", frames[0])
+	}
+	if n := sales.Send.Len(); n != 0 {
+		t.Errorf("sales agent got %d frames for a billing chat", n)
+	}
+}
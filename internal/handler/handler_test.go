@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/models"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	// handlers log every event; keep test output readable
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testServer serves the customer socket and the health routes of h
+func testServer(t *testing.T, h *hub.Hub) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/customer", func(w http.ResponseWriter, r *http.Request) { WsHandler(h, w, r) })
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { ReadyHandler(h, w, r) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dialCustomer connects a customer of acme
+func dialCustomer(srv *httptest.Server, customerID string) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/customer?company_id=acme&customer_id=" + customerID
+	return websocket.DefaultDialer.Dial(url, nil)
+}
+
+// readUntil reads frames until one of type frameType arrives
+func readUntil(t *testing.T, conn *websocket.Conn, frameType string) models.WSMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg models.WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", frameType, err)
+		}
+		if msg.Type == frameType {
+			return msg
+		}
+	}
+}
+
+func send(t *testing.T, conn *websocket.Conn, frameType string, payload any) {
+	t.Helper()
+	data, _ := json.Marshal(models.WSMessage{Type: frameType, Payload: payload})
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"net/http"
+)
+
+// HealthHandler reports that the process is alive
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// ReadyHandler reports whether the server should receive new connections.
+// It fails as soon as shutdown starts so load balancers stop routing here.
+func ReadyHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if h.Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready"))
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestDrain checks a draining server fails readiness and turns new
+// connections away, while the ones it has are told to move and keep working
+// until they leave
+func TestDrain(t *testing.T) {
+	h := hub.NewHub()
+	srv := testServer(t, h)
+	ready := func() int {
+		resp, err := http.Get(srv.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	conn, _, err := dialCustomer(srv, "cust-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("ready before drain = %d", code)
+	}
+
+	h.Drain()
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("ready while draining = %d, want 503", code)
+	}
+	if _, resp, err := dialCustomer(srv, "cust-2"); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("new connection while draining: %v, %+v, want 503", err, resp)
+	}
+
+	readUntil(t, conn, "server_draining")
+	send(t, conn, "ping", nil)
+	readUntil(t, conn, "pong")
+
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Wait(ctx); err != nil {
+		t.Errorf("pumps still running after the client left: %v", err)
+	}
+}
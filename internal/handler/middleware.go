@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"butter-socket/internal/authz"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"butter-socket/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event rate defaults, used when Services leaves them zero
+const (
+	defaultEventRate  = 5
+	defaultEventBurst = 20
+)
+
+// maxContentBytes bounds the text of one chat message
+const maxContentBytes = 16 << 10
+
+// ErrInvalidEvent is returned by validators for payloads their handler can't use
+var ErrInvalidEvent = errors.New("invalid event")
+
+// recovering keeps a panicking handler from taking the server down with it
+func recovering(r route, next eventHandler) eventHandler {
+	return func(client *hub.Client, payload any) {
+		defer func() {
+			if p := recover(); p != nil {
+				client.Logger().Error("event handler panicked", logging.KeyEvent, r.Type, "panic", p, "stack", string(debug.Stack()))
+				sendError(client, "internal error")
+			}
+		}()
+		next(client, payload)
+	}
+}
+
+// logged logs every event and how long its handler took
+func logged(r route, next eventHandler) eventHandler {
+	return func(client *hub.Client, payload any) {
+		start := time.Now()
+		client.Logger().Debug("event received", logging.KeyEvent, r.Type)
+		next(client, payload)
+		client.Logger().Debug("event handled", logging.KeyEvent, r.Type, "duration", time.Since(start))
+	}
+}
+
+// counted counts every event of a known type, rejected or not
+func counted(r route, next eventHandler) eventHandler {
+	return func(client *hub.Client, payload any) {
+		metrics.EventsIn.WithLabelValues(r.Type).Inc()
+		next(client, payload)
+	}
+}
+
+// rateLimited drops events from a connection sending faster than
+// Services.EventRate allows
+func rateLimited(r route, next eventHandler) eventHandler {
+	return func(client *hub.Client, payload any) {
+		if !limiter.allow(client.ID, services.EventRate, time.Now()) {
+			reject(client, r, "rate_limited", "Too many messages, slow down")
+			return
+		}
+		next(client, payload)
+	}
+}
+
+// authorized keeps each event to the client types and roles it is meant for,
+// so a customer can't accept chats and an agent can't monitor them
+func authorized(r route, next eventHandler) eventHandler {
+	return func(client *hub.Client, payload any) {
+		if !r.allows(client) {
+			reject(client, r, "forbidden", r.Type+" is not allowed on this connection")
+			return
+		}
+		next(client, payload)
+	}
+}
+
+// validated hands the handler the payload its route's validator decoded
+func validated(r route, next eventHandler) eventHandler {
+	if r.Validate == nil {
+		return next
+	}
+	return func(client *hub.Client, payload any) {
+		decoded, err := r.Validate(client, payload)
+		if err != nil {
+			reject(client, r, "invalid", err.Error())
+			return
+		}
+		next(client, decoded)
+	}
+}
+
+// permitted checks an employee may act on the conversation an event names,
+// under their role. A conversation that can't be found can't be checked, so
+// events about customers who aren't online go no further.
+func permitted(r route, next eventHandler) eventHandler {
+	if r.Act == "" {
+		return next
+	}
+	return func(client *hub.Client, payload any) {
+		if client.Type != fromUser {
+			next(client, payload)
+			return
+		}
+		customer := customerOf(client.Hub, payload)
+		if customer == nil {
+			reject(client, r, "not_found", ErrConversationNotFound.Error())
+			return
+		}
+		conv := customer.Snapshot()
+		if err := authz.Check(client.User, r.Act, &conv); err != nil {
+			reject(client, r, "forbidden", err.Error())
+			return
+		}
+		next(client, payload)
+	}
+}
+
+// customerOf finds the customer connection a decoded payload is about
+func customerOf(h *hub.Hub, payload any) *hub.Client {
+	switch p := payload.(type) {
+	case models.MsgInOut:
+		return h.GetCustomerConn(p.ReceiverId)
+	case models.Conversation:
+		return h.GetCustomerConn(p.Customer.Id)
+	case conversationRef:
+		return h.GetClientByConversationId(p.ConversationID)
+	}
+	return nil
+}
+
+// moderated runs chat messages through the company's moderation policy, so
+// handlers only ever see what may be sent on and stored
+func moderated(r route, next eventHandler) eventHandler {
+	if !r.Moderate {
+		return next
+	}
+	return func(client *hub.Client, payload any) {
+		msg := payload.(models.MsgInOut)
+		customer := client
+		if client.Type == fromUser {
+			// the customer left after permitted found them; the handler drops it
+			if customer = customerOf(client.Hub, msg); customer == nil {
+				next(client, msg)
+				return
+			}
+		}
+		if !moderate(client, customer, &msg) {
+			return
+		}
+		next(client, msg)
+	}
+}
+
+// reject tells the client an event went no further and why
+func reject(client *hub.Client, r route, reason, errorMsg string) {
+	metrics.EventsRejected.WithLabelValues(r.Type, reason).Inc()
+	client.Logger().Warn("event rejected", logging.KeyEvent, r.Type, "reason", reason, "error", errorMsg)
+	sendError(client, errorMsg)
+}
+
+// validateMessage decodes a chat message and fills in who sent it; agents
+// must say which customer it is for
+func validateMessage(client *hub.Client, payload any) (any, error) {
+	var msg models.MsgInOut
+	if err := decodePayload(payload, &msg); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.TrimSpace(msg.Content) == "":
+		return nil, fmt.Errorf("%w: message needs content", ErrInvalidEvent)
+	case len(msg.Content) > maxContentBytes:
+		return nil, fmt.Errorf("%w: message is longer than %d bytes", ErrInvalidEvent, maxContentBytes)
+	}
+
+	if client.Type == fromUser {
+		if msg.ReceiverId == "" {
+			return nil, fmt.Errorf("%w: message needs a receiver_id", ErrInvalidEvent)
+		}
+		msg.SenderId = client.User.UserID
+		msg.SenderType = "user"
+	} else {
+		msg.SenderId = client.Customer.Id
+		msg.SenderType = "customer"
+	}
+	return msg, nil
+}
+
+// validateAccept decodes the conversation an agent accepts
+func validateAccept(_ *hub.Client, payload any) (any, error) {
+	var conv models.Conversation
+	if err := decodePayload(payload, &conv); err != nil {
+		return nil, err
+	}
+	if conv.Customer == nil || conv.Customer.Id == "" {
+		return nil, fmt.Errorf("%w: accept_chat needs a customer", ErrInvalidEvent)
+	}
+	return conv, nil
+}
+
+// conversationRef is the payload of events about a live conversation by its
+// ID: monitor_chat, unmonitor_chat, whisper, barge_in and internal_note
+type conversationRef struct {
+	ConversationID string `json:"conversation_id"`
+	Content        string `json:"content,omitempty"` // -> what to whisper or note
+}
+
+// conversationMessage is a message for agents only, about a conversation
+type conversationMessage struct {
+	ConversationID string `json:"conversation_id"`
+	models.MsgInOut
+}
+
+// validateConversationRef decodes an event naming a conversation
+func validateConversationRef(_ *hub.Client, payload any) (any, error) {
+	var ref conversationRef
+	if err := decodePayload(payload, &ref); err != nil {
+		return nil, err
+	}
+	if ref.ConversationID == "" {
+		return nil, fmt.Errorf("%w: a conversation_id is required", ErrInvalidEvent)
+	}
+	return ref, nil
+}
+
+// validateConversationText decodes an event naming a conversation that also
+// has something to say about it
+func validateConversationText(client *hub.Client, payload any) (any, error) {
+	decoded, err := validateConversationRef(client, payload)
+	if err != nil {
+		return nil, err
+	}
+	ref := decoded.(conversationRef)
+	switch {
+	case strings.TrimSpace(ref.Content) == "":
+		return nil, fmt.Errorf("%w: content is required", ErrInvalidEvent)
+	case len(ref.Content) > maxContentBytes:
+		return nil, fmt.Errorf("%w: content is longer than %d bytes", ErrInvalidEvent, maxContentBytes)
+	}
+	return ref, nil
+}
+
+// decodePayload reads an event's JSON payload into v
+func decodePayload(payload any, v any) error {
+	data, err := json.Marshal(payload)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: malformed payload", ErrInvalidEvent)
+	}
+	return nil
+}
+
+// RateLimit bounds how fast one connection may send events. Zero values use
+// the defaults; a negative Rate turns limiting off.
+type RateLimit struct {
+	Rate  float64 // -> events per second a connection earns back
+	Burst int     // -> events it may send back to back
+}
+
+// bucket is one connection's token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per connection
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*bucket)}
+
+// allow takes a token from the connection's bucket, reporting false when it is empty
+func (l *rateLimiter) allow(connID string, cfg RateLimit, now time.Time) bool {
+	if cfg.Rate < 0 {
+		return true
+	}
+	if cfg.Rate == 0 {
+		cfg.Rate = defaultEventRate
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = defaultEventBurst
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[connID]
+	if !ok {
+		b = &bucket{tokens: float64(cfg.Burst), last: now}
+		l.buckets[connID] = b
+	}
+	b.tokens = math.Min(float64(cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*cfg.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// forget drops the bucket of a connection that went away
+func (l *rateLimiter) forget(connID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, connID)
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/models"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queued is a client whose frames stay queued for the test to read
+func queued(h *hub.Hub, id, clientType string) *hub.Client {
+	c := &hub.Client{ID: id, Type: clientType, Hub: h, Send: hub.NewSendQueue(16, hub.SendPolicy{})}
+	if clientType == fromCustomer {
+		c.Customer = &models.Customer{Id: "cust-" + id, CompanyId: "acme"}
+		c.Conversation = &models.Conversation{Id: "conv-" + id, CompanyId: "acme"}
+	}
+	return c
+}
+
+// employee is a queued agent connection with a role
+func employee(h *hub.Hub, id, role string) *hub.Client {
+	c := queued(h, id, fromUser)
+	c.User = &models.User{UserID: "user-" + id, CompanyID: "acme", Role: role}
+	return c
+}
+
+// frame is one frame the server queued for a client
+type frame struct {
+	Type    string         `json:"type"`
+	Payload map[string]any `json:"payload"`
+}
+
+// errorText is what an error frame says, or ""
+func (f frame) errorText() string {
+	msg, _ := f.Payload["error"].(string)
+	return msg
+}
+
+// frames takes the frames queued for client
+func frames(t *testing.T, client *hub.Client) []frame {
+	t.Helper()
+	data, _ := client.Send.Take()
+	out := make([]frame, len(data))
+	for i, d := range data {
+		if err := json.Unmarshal(d, &out[i]); err != nil {
+			t.Fatalf("frame %s: %v", d, err)
+		}
+	}
+	return out
+}
+
+func TestAuthorized(t *testing.T) {
+	h := hub.NewHub()
+	conversation := map[string]string{"conversation_id": "conv-x", "content": "offer the refund"}
+	tests := []struct {
+		name      string
+		client    *hub.Client
+		eventType string
+		payload   any
+		want      string // -> the frame sent back
+		wantError string
+	}{
+		{"customer accepts a chat", queued(h, "a1", fromCustomer), "accept_chat", map[string]any{"customer": map[string]string{"id": "cust-a1"}}, "error", "accept_chat is not allowed on this connection"},
+		{"customer whispers", queued(h, "a2", fromCustomer), "whisper", conversation, "error", "whisper is not allowed on this connection"},
+		{"customer notes", queued(h, "a3", fromCustomer), "internal_note", conversation, "error", "internal_note is not allowed on this connection"},
+		{"agent whispers", employee(h, "a4", "agent"), "whisper", conversation, "error", "whisper is not allowed on this connection"},
+		{"agent asks for a human", employee(h, "a5", "agent"), "transfer_chat", nil, "error", "transfer_chat is not allowed on this connection"},
+		{"supervisor whispers", employee(h, "a6", "supervisor"), "whisper", conversation, "error", ErrConversationNotFound.Error()}, // -> past authorization
+		{"customer pings", queued(h, "a7", fromCustomer), "ping", nil, "pong", ""},
+		{"unknown event", queued(h, "a8", fromCustomer), "reboot", nil, "error", "Unknown message type"},
+	}
+	for _, tt := range tests {
+		inbound.dispatch(tt.client, tt.eventType, tt.payload)
+		got := frames(t, tt.client)
+		if len(got) != 1 || got[0].Type != tt.want || got[0].errorText() != tt.wantError {
+			t.Errorf("%s: sent %+v, want a %s frame %q", tt.name, got, tt.want, tt.wantError)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		cfg   RateLimit
+		after time.Duration // -> since the first event
+		sends int
+		want  int // -> events allowed
+	}{
+		{"burst", RateLimit{Rate: 2, Burst: 3}, 0, 4, 3},
+		{"refilled at the rate", RateLimit{Rate: 2, Burst: 3}, 500 * time.Millisecond, 2, 1},
+		{"refilled up to the burst", RateLimit{Rate: 2, Burst: 3}, time.Minute, 5, 3},
+	}
+	l := &rateLimiter{buckets: make(map[string]*bucket)}
+	for _, tt := range tests {
+		allowed := 0
+		for range tt.sends {
+			if l.allow("conn-1", tt.cfg, start.Add(tt.after)) {
+				allowed++
+			}
+		}
+		if allowed != tt.want {
+			t.Errorf("%s: allowed %d of %d events, want %d", tt.name, allowed, tt.sends, tt.want)
+		}
+	}
+
+	defaults, off := 0, 0
+	for range 100 {
+		if l.allow("conn-2", RateLimit{}, start) {
+			defaults++
+		}
+		if l.allow("conn-3", RateLimit{Rate: -1}, start) {
+			off++
+		}
+	}
+	if defaults != defaultEventBurst || off != 100 {
+		t.Errorf("allowed %d events by default and %d with limiting off, want %d and 100", defaults, off, defaultEventBurst)
+	}
+	l.forget("conn-2")
+	if !l.allow("conn-2", RateLimit{}, start) {
+		t.Error("a forgotten connection doesn't start over with a full bucket")
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	h := hub.NewHub()
+	customer, agent := queued(h, "v1", fromCustomer), employee(h, "v2", "agent")
+	tests := []struct {
+		name       string
+		client     *hub.Client
+		payload    any
+		wantSender string // -> empty when the message is rejected
+		wantType   string
+	}{
+		{"customer", customer, map[string]string{"content": "hi", "sender_id": "user-v2", "sender_type": "user"}, "cust-v1", "customer"},
+		{"agent", agent, map[string]string{"content": "hello", "receiver_id": "cust-v1"}, "user-v2", "user"},
+		{"agent without a receiver", agent, map[string]string{"content": "hello"}, "", ""},
+		{"empty", customer, map[string]string{"content": " \n\t"}, "", ""},
+		{"missing content", customer, map[string]string{}, "", ""},
+		{"oversized", customer, map[string]string{"content": strings.Repeat("a", maxContentBytes+1)}, "", ""},
+		{"malformed", customer, "hi", "", ""},
+	}
+	for _, tt := range tests {
+		decoded, err := validateMessage(tt.client, tt.payload)
+		if tt.wantSender == "" {
+			if !errors.Is(err, ErrInvalidEvent) {
+				t.Errorf("%s: validateMessage = %+v, %v, want ErrInvalidEvent", tt.name, decoded, err)
+			}
+			continue
+		}
+		msg, _ := decoded.(models.MsgInOut)
+		if err != nil || msg.SenderId != tt.wantSender || msg.SenderType != tt.wantType {
+			t.Errorf("%s: validateMessage = %+v, %v, want sent by %s %s", tt.name, decoded, err, tt.wantType, tt.wantSender)
+		}
+	}
+}
+
+func TestRecovering(t *testing.T) {
+	client := queued(hub.NewHub(), "r1", fromCustomer)
+	handled := false
+	panicking := recovering(route{Type: "message"}, func(*hub.Client, any) { panic("boom") })
+	calm := recovering(route{Type: "message"}, func(*hub.Client, any) { handled = true })
+
+	panicking(client, nil)
+	if got := frames(t, client); len(got) != 1 || got[0].errorText() != "internal error" {
+		t.Errorf("after a panic sent %+v, want an internal error", got)
+	}
+	calm(client, nil)
+	if got := frames(t, client); !handled || len(got) != 0 {
+		t.Errorf("handled %v and sent %+v, want the handler run quietly", handled, got)
+	}
+}
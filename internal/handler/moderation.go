@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/llm"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"butter-socket/models"
+
+	"github.com/google/uuid"
+)
+
+// moderationData is the payload of message.moderated
+type moderationData struct {
+	MessageID  string        `json:"message_id"`
+	SenderType string        `json:"sender_type"`
+	Blocked    bool          `json:"blocked"`
+	Findings   []llm.Finding `json:"findings"`
+}
+
+// blockedMessage tells a sender their message went no further
+type blockedMessage struct {
+	MessageId string   `json:"message_id"`
+	Reasons   []string `json:"reasons"` // -> kinds of content that blocked it
+}
+
+// moderate runs a message through the company's moderation policy before it
+// is sent on or stored, leaving the masked text in msg.Content. Findings are
+// recorded on the customer's conversation. It reports false for a blocked
+// message, after telling the sender unless sender is nil.
+func moderate(sender, customer *hub.Client, msg *models.MsgInOut) bool {
+	if services.Moderation == nil || msg.Content == "" {
+		return true
+	}
+	result := services.Moderation.Process(customer.CompanyID(), msg.Content)
+	if !result.Flagged() {
+		return true
+	}
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.New().String()
+	}
+	msg.Content = result.Text
+
+	var reasons []string
+	for _, f := range result.Findings {
+		metrics.ModerationFindings.WithLabelValues(f.Kind, f.Action).Add(float64(f.Count))
+		if f.Action == llm.ActionBlock {
+			reasons = append(reasons, f.Kind)
+		}
+	}
+	customer.Logger().Info("message moderated",
+		logging.KeyEvent, "moderation",
+		"message_id", msg.MessageId,
+		"sender_type", msg.SenderType,
+		"blocked", result.Blocked,
+		"findings", result.Findings)
+	customer.Hub.Emit(customer, events.MessageModerated, moderationData{
+		MessageID:  msg.MessageId,
+		SenderType: msg.SenderType,
+		Blocked:    result.Blocked,
+		Findings:   result.Findings,
+	})
+
+	if !result.Blocked {
+		return true
+	}
+	if sender != nil {
+		sendMessage(sender, "message_blocked", blockedMessage{MessageId: msg.MessageId, Reasons: reasons})
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
+	"butter-socket/models"
+)
+
+// trigger name: internal_note (for users)
+//
+// The note is kept on the conversation, marked internal, and goes to the
+// author, the agent handling the chat and supervisors monitoring it. The
+// customer never sees it.
+func handleInternalNote(client *hub.Client, payload any) {
+	ref := payload.(conversationRef)
+	customer := liveCustomer(client, ref)
+	if customer == nil {
+		return
+	}
+
+	note := models.MsgInOut{
+		SenderId:    client.User.UserID,
+		SenderType:  "user",
+		Content:     ref.Content,
+		ContentType: "text",
+	}
+	if !moderate(client, customer, &note) {
+		return
+	}
+	// watchers get it as a monitor_message when it is saved
+	note = client.Hub.AddNote(customer, note)
+	client.Logger().Info("internal note added",
+		logging.KeyEvent, "internal_note",
+		logging.KeyConversation, ref.ConversationID,
+		"message_id", note.MessageId)
+
+	frame := conversationMessage{ConversationID: ref.ConversationID, MsgInOut: note}
+	sendMessage(client, "internal_note", frame)
+	if assigned := customer.Agent(); assigned != nil && assigned.UserID != client.User.UserID {
+		if agent := client.Hub.GetUserConnByUserId(assigned.UserID); agent != nil {
+			sendMessage(agent, "internal_note", frame)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/store"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInternalNoteStaysWithAgents(t *testing.T) {
+	h := hub.NewHub()
+	s := store.NewMemory()
+	h.UseStore(s)
+	srv := testServer(t, h)
+	conn, _, err := dialCustomer(srv, "cust-n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var customer *hub.Client
+	for deadline := time.Now().Add(time.Second); customer == nil && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		customer = h.GetCustomerConn("cust-n1")
+	}
+	if customer == nil {
+		t.Fatal("customer never registered")
+	}
+
+	assigned, author, bystander := employee(h, "n1", "agent"), employee(h, "n2", "supervisor"), employee(h, "n3", "agent")
+	for _, agent := range []*hub.Client{assigned, author, bystander} {
+		h.RegisterClient(agent)
+	}
+	h.AssignAgent(customer, assigned.User)
+	frames(t, assigned) // -> whatever registering and assigning queued
+
+	const secret = "VIP, refund without asking"
+	inbound.dispatch(author, "internal_note", map[string]string{"conversation_id": customer.Conversation.Id, "content": secret})
+
+	for _, agent := range []*hub.Client{author, assigned} {
+		got := frames(t, agent)
+		if len(got) != 1 || got[0].Type != "internal_note" || got[0].Payload["content"] != secret {
+			t.Errorf("%s got %+v, want the note", agent.User.UserID, got)
+		}
+	}
+	if got := frames(t, bystander); len(got) != 0 {
+		t.Errorf("an agent outside the chat got %+v", got)
+	}
+
+	// up to a pong sent after the note, the customer hears nothing of it
+	send(t, conn, "ping", nil)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for pong: %v", err)
+		}
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("customer was sent the note: %s", data)
+		}
+		if strings.Contains(string(data), `"type":"pong"`) {
+			break
+		}
+	}
+
+	pending, _ := s.Pending(context.Background(), time.Now(), 100)
+	var raised []string
+	for _, e := range pending {
+		if strings.Contains(string(e.Event.Data), secret) {
+			raised = append(raised, e.Event.Type)
+		}
+	}
+	if len(raised) != 1 || raised[0] != events.NoteCreated {
+		t.Errorf("the note raised %v, want only %s", raised, events.NoteCreated)
+	}
+	conv, _, _ := s.Conversation(context.Background(), customer.Conversation.Id)
+	if n := len(conv.Messages); n != 1 || !conv.Messages[0].Internal {
+		t.Errorf("stored messages %+v, want the note marked internal", conv.Messages)
+	}
+}
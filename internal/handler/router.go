@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"butter-socket/internal/authz"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"slices"
+)
+
+// Client types an event can come from
+const (
+	fromCustomer = "customer"
+	fromUser     = "user"
+)
+
+// eventHandler handles one inbound event. Its payload is whatever the route's
+// validator made of it, or the raw JSON value when the route has none.
+type eventHandler func(client *hub.Client, payload any)
+
+// route is what the router knows about an inbound event type
+type route struct {
+	Type     string
+	From     []string                                           // -> client types allowed to send it
+	Roles    []string                                           // -> employee roles allowed to send it; nil allows every role
+	Validate func(client *hub.Client, payload any) (any, error) // -> checks and decodes the payload; nil takes it as is
+	Act      string                                             // -> authz action an employee takes on the conversation the payload names
+	Moderate bool                                               // -> the payload is a models.MsgInOut to moderate
+}
+
+// allows reports whether the client may send the event at all
+func (r route) allows(client *hub.Client) bool {
+	if !slices.Contains(r.From, client.Type) {
+		return false
+	}
+	return r.Roles == nil || client.Type != fromUser || authz.HasRole(client.User, r.Roles...)
+}
+
+// middleware wraps the handler of a route. It is applied once per route when
+// the route is registered, so it can look at the route to decide what to do.
+type middleware func(r route, next eventHandler) eventHandler
+
+// router dispatches inbound events to the handler registered for their type,
+// through the middlewares every route shares
+type router struct {
+	middlewares []middleware // -> outermost first
+	handlers    map[string]eventHandler
+}
+
+func newRouter(middlewares ...middleware) *router {
+	return &router{middlewares: middlewares, handlers: make(map[string]eventHandler)}
+}
+
+// handle registers h for r.Type, wrapped in the router's middlewares
+func (rt *router) handle(r route, h eventHandler) {
+	for i := len(rt.middlewares) - 1; i >= 0; i-- {
+		h = rt.middlewares[i](r, h)
+	}
+	rt.handlers[r.Type] = h
+}
+
+// dispatch runs the handler registered for eventType, telling the client
+// when there is none
+func (rt *router) dispatch(client *hub.Client, eventType string, payload any) {
+	h, ok := rt.handlers[eventType]
+	if !ok {
+		// client supplied types would explode metric cardinality
+		metrics.EventsIn.WithLabelValues("unknown").Inc()
+		client.Logger().Warn("unknown message type", logging.KeyEvent, eventType)
+		sendError(client, "Unknown message type")
+		return
+	}
+	h(client, payload)
+}
+
+// inbound routes the events customers and agents send over their sockets
+var inbound = newRouter(
+	recovering,
+	logged,
+	counted,
+	rateLimited,
+	authorized,
+	validated,
+	permitted,
+	moderated,
+)
+
+func init() {
+	inbound.handle(route{Type: "transfer_chat", From: []string{fromCustomer}}, handleChatTransferToUser)
+	inbound.handle(route{Type: "accept_chat", From: []string{fromUser}, Validate: validateAccept, Act: authz.Accept}, handleHumanAcceptTheChat)
+	inbound.handle(route{Type: "message", From: []string{fromCustomer, fromUser}, Validate: validateMessage, Act: authz.Message, Moderate: true}, handleMessage)
+	inbound.handle(route{Type: "stop_generation", From: []string{fromCustomer}}, handleStopGeneration)
+	inbound.handle(route{Type: "monitor_chat", From: []string{fromUser}, Roles: supervisors, Validate: validateConversationRef, Act: authz.Monitor}, handleMonitorChat)
+	inbound.handle(route{Type: "unmonitor_chat", From: []string{fromUser}, Roles: supervisors, Validate: validateConversationRef}, handleUnmonitorChat)
+	inbound.handle(route{Type: "whisper", From: []string{fromUser}, Roles: supervisors, Validate: validateConversationText, Act: authz.Whisper}, handleWhisper)
+	inbound.handle(route{Type: "barge_in", From: []string{fromUser}, Roles: supervisors, Validate: validateConversationRef, Act: authz.BargeIn}, handleBargeIn)
+	inbound.handle(route{Type: "internal_note", From: []string{fromUser}, Validate: validateConversationText, Act: authz.Note}, handleInternalNote)
+	inbound.handle(route{Type: "ping", From: []string{fromCustomer, fromUser}}, func(client *hub.Client, _ any) { sendPong(client) })
+}
+
+// trigger name: message
+//
+// Goes to the AI until a human has accepted the chat, then to the human
+func handleMessage(client *hub.Client, payload any) {
+	if client.Type == fromUser || client.Status() == hub.StatusWithAgent {
+		handleConversationWithHuman(client, payload)
+	} else {
+		handleChatStreamMessage(client, payload)
+	}
+}
+
+// trigger name: stop_generation
+func handleStopGeneration(client *hub.Client, _ any) {
+	client.CancelAI(hub.StopRequested)
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"butter-socket/internal/hub"
+	"butter-socket/internal/knowledge"
+	"butter-socket/internal/llm"
+	"butter-socket/internal/usage"
+)
+
+// Services are the shared dependencies handlers need besides the hub
+type Services struct {
+	// Usage accounts LLM spend and enforces budgets; nil disables both
+	Usage *usage.Tracker
+
+	// Send queue policies for customer and agent connections; zero values drop
+	// non-critical frames first
+	CustomerSendPolicy hub.SendPolicy
+	AgentSendPolicy    hub.SendPolicy
+
+	// How streamed AI tokens are merged into message_chunk frames
+	ChunkBatching ChunkBatching
+
+	// Company docs the AI answers from; nil answers without them
+	Knowledge *knowledge.Base
+
+	// Company HTTP tools the AI may call while answering; nil disables tool calling
+	Tools *llm.ToolRegistry
+
+	// How fast one connection may send events
+	EventRate RateLimit
+
+	// Moderates messages before they are sent on or stored; nil passes them untouched
+	Moderation *llm.Processor
+}
+
+var services Services
+
+// Configure installs the services used by every handler
+func Configure(s Services) {
+	services = s
+}
@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"butter-socket/internal/authz"
+	"butter-socket/internal/events"
+	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
+	"butter-socket/models"
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// transcriptTimeout bounds reading a monitored conversation from the store
+const transcriptTimeout = 2 * time.Second
+
+// supervisors are the roles allowed to watch, whisper and barge in
+var supervisors = []string{authz.RoleSupervisor, authz.RoleAdmin}
+
+// liveCustomer finds the customer of the conversation an event names,
+// telling the sender when it isn't live
+func liveCustomer(client *hub.Client, req conversationRef) *hub.Client {
+	customer := client.Hub.GetClientByConversationId(req.ConversationID)
+	if customer == nil {
+		sendError(client, ErrConversationNotFound.Error())
+	}
+	return customer
+}
+
+// audit records what a supervisor did to a customer's conversation
+func audit(client, customer *hub.Client, action, agentID, content string) {
+	client.Hub.Audit(customer, hub.SupervisorAction{
+		Action:  action,
+		UserID:  client.User.UserID,
+		Role:    authz.Role(client.User),
+		AgentID: agentID,
+		Content: content,
+	})
+}
+
+// trigger name: monitor_chat (for supervisors)
+//
+// The supervisor gets the conversation so far, then a monitor_message for
+// every message saved to it until they stop or it ends. Watching starts
+// before the transcript is read, so a message saved meanwhile may arrive in
+// both under the same message_id.
+func handleMonitorChat(client *hub.Client, payload any) {
+	req := payload.(conversationRef)
+	customer := liveCustomer(client, req)
+	if customer == nil {
+		return
+	}
+	client.Hub.Watch(req.ConversationID, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcriptTimeout)
+	defer cancel()
+	conv, err := client.Hub.Transcript(ctx, customer)
+	if err != nil {
+		client.Logger().Warn("transcript unavailable, monitoring without history",
+			logging.KeyEvent, "monitor_chat",
+			logging.KeyConversation, req.ConversationID,
+			"error", err)
+	}
+	sendMessage(client, "monitor_started", conv)
+	audit(client, customer, hub.SuperviseMonitor, conv.AssignedTo, "")
+}
+
+// trigger name: unmonitor_chat (for supervisors)
+func handleUnmonitorChat(client *hub.Client, payload any) {
+	req := payload.(conversationRef)
+	if !client.Hub.Unwatch(req.ConversationID, client) {
+		sendError(client, "not monitoring this conversation")
+		return
+	}
+	sendMessage(client, "monitor_ended", hub.MonitorEnded{ConversationID: req.ConversationID, Reason: "stopped"})
+	if customer := client.Hub.GetClientByConversationId(req.ConversationID); customer != nil {
+		audit(client, customer, hub.SuperviseUnmonitor, customer.Snapshot().AssignedTo, "")
+	}
+}
+
+// trigger name: whisper (for supervisors)
+//
+// Only the agent handling the chat gets it; it is audited, not stored with
+// the conversation
+func handleWhisper(client *hub.Client, payload any) {
+	req := payload.(conversationRef)
+	customer := liveCustomer(client, req)
+	if customer == nil {
+		return
+	}
+	assigned := customer.Agent()
+	if assigned == nil {
+		sendError(client, "no agent is handling this conversation")
+		return
+	}
+	agent := client.Hub.GetUserConnByUserId(assigned.UserID)
+	if agent == nil {
+		sendError(client, ErrUserNotOnline.Error())
+		return
+	}
+
+	whisper := conversationMessage{
+		ConversationID: req.ConversationID,
+		MsgInOut: models.MsgInOut{
+			MessageId:   uuid.New().String(),
+			SenderId:    client.User.UserID,
+			SenderType:  "supervisor",
+			ReceiverId:  agent.User.UserID,
+			Content:     req.Content,
+			ContentType: "text",
+			CreatedAt:   time.Now().Format(time.RFC3339),
+		},
+	}
+	sendMessage(agent, "whisper", whisper)
+	sendMessage(client, "whisper_sent", whisper)
+	audit(client, customer, hub.SuperviseWhisper, agent.User.UserID, req.Content)
+}
+
+// trigger name: barge_in (for supervisors)
+//
+// The supervisor takes the chat over from the AI or the agent handling it,
+// who is told it was reassigned
+func handleBargeIn(client *hub.Client, payload any) {
+	req := payload.(conversationRef)
+	customer := liveCustomer(client, req)
+	if customer == nil {
+		return
+	}
+
+	// they are in the chat now, messages reach them directly
+	client.Hub.Unwatch(req.ConversationID, client)
+	previous := client.Hub.AssignAgent(customer, client.User)
+	client.Logger().Info("supervisor barged in",
+		logging.KeyEvent, "barge_in",
+		logging.KeyConversation, req.ConversationID,
+		logging.KeyCustomer, customer.Customer.Id)
+
+	accepted := acceptData{CustomerID: customer.Customer.Id, UserID: client.User.UserID}
+	var agentID string
+	if previous != nil && previous.UserID != client.User.UserID {
+		agentID = previous.UserID
+		accepted.PreviousUserID = previous.UserID
+		notifyReassigned(client.Hub, previous, req.ConversationID)
+	}
+	client.Hub.Emit(customer, events.ChatAccepted, accepted)
+
+	sendMessage(client, "chat_assigned", customer.Snapshot())
+	sendMessage(customer, "connection_event", models.MsgInOut{
+		SenderId:   "system",
+		SenderType: "system",
+		ReceiverId: customer.Customer.Id,
+		Content:    "a supervisor joined the conversation",
+	})
+	audit(client, customer, hub.SuperviseBargeIn, agentID, "")
+}
@@ -2,9 +2,11 @@ package handler
 
 import (
 	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
 	"butter-socket/models"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -32,13 +34,23 @@ const (
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 512 * 1024 // 512KB
+
+	// Frames queued for a client before its send policy applies
+	sendQueueSize = 256
 )
 
 // WsHandler handles WebSocket connections
 func WsHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if h.Draining() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	logger := slog.Default().With(logging.KeyEvent, "connect", "remote_addr", r.RemoteAddr)
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Error while upgrading connection:", err)
+		logger.Warn("error while upgrading connection", "error", err)
 		return
 	}
 
@@ -47,10 +59,12 @@ func WsHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 	customerId := queryParams.Get("customer_id")
 	companyId := queryParams.Get("company_id")
 	source := queryParams.Get("source")
+	segment := queryParams.Get("segment")
 
 	// Validate required parameters
 	if customerId == "" {
-		log.Println("Missing required parameter: customer_id")
+		logger.Warn("missing required parameter", "param", "customer_id")
+		metrics.AuthFailures.WithLabelValues("customer", "missing_customer_id").Inc()
 		errMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Missing customer_id parameter")
 		conn.WriteMessage(websocket.CloseMessage, errMsg)
 		conn.Close()
@@ -58,7 +72,8 @@ func WsHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	if companyId == "" {
-		log.Println("Missing required parameter: company_id")
+		logger.Warn("missing required parameter", "param", "company_id", logging.KeyCustomer, customerId)
+		metrics.AuthFailures.WithLabelValues("customer", "missing_company_id").Inc()
 		errMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Missing company_id parameter")
 		conn.WriteMessage(websocket.CloseMessage, errMsg)
 		conn.Close()
@@ -75,14 +90,16 @@ func WsHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 
 	// Create a new client with parameters from query string
 	client := &hub.Client{
+		ID:   uuid.New().String(),
 		Type: "customer",
 		Hub:  h,
 		Conn: conn,
-		Send: make(chan []byte, 256),
+		Send: hub.NewSendQueue(sendQueueSize, services.CustomerSendPolicy),
 		Customer: &models.Customer{
 			Id:        customerId,
 			CompanyId: companyId,
 			Source:    source,
+			Segment:   segment,
 		},
 		Conversation: &models.Conversation{
 			Id:        uuid.New().String(),
@@ -92,12 +109,12 @@ func WsHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 				Id:        customerId,
 				CompanyId: companyId,
 				Source:    source,
+				Segment:   segment,
 			},
 		},
 	}
 
-	log.Printf("New WebSocket connection - Customer ID: %s, Company ID: %s, Source: %s",
-		customerId, companyId, source)
+	client.Logger().Info("new customer connection", logging.KeyEvent, "connect", "source", source)
 
 	// Register the client
 	client.Hub.RegisterClient(client)
@@ -106,8 +123,8 @@ func WsHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 	sendWelcomeMessage(client)
 
 	// Start goroutines for reading and writing
-	go writePump(client)
-	go readPump(client)
+	h.Go(func() { writePump(client) })
+	h.Go(func() { readPump(client) })
 }
 
 // readPump reads messages from the WebSocket connection
@@ -115,6 +132,7 @@ func readPump(client *hub.Client) {
 	defer func() {
 		client.Hub.UnregisterClient(client)
 		client.Conn.Close()
+		limiter.forget(client.ID)
 	}()
 
 	client.Conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -128,7 +146,7 @@ func readPump(client *hub.Client) {
 		_, message, err := client.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				client.Logger().Warn("websocket read error", logging.KeyEvent, "disconnect", "error", err)
 			}
 			break
 		}
@@ -148,25 +166,28 @@ func writePump(client *hub.Client) {
 
 	for {
 		select {
-		case message, ok := <-client.Send:
+		case <-client.Send.Ready():
+			frames, ok := client.Send.Take()
 			client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				// The hub closed the channel
+				// The hub closed the queue
 				client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
+			if len(frames) == 0 {
+				continue
+			}
 
 			w, err := client.Conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			w.Write(frames[0])
 
 			// Add queued messages to the current websocket message
-			n := len(client.Send)
-			for i := 0; i < n; i++ {
+			for _, frame := range frames[1:] {
 				w.Write([]byte{'\n'})
-				w.Write(<-client.Send)
+				w.Write(frame)
 			}
 
 			if err := w.Close(); err != nil {
@@ -182,30 +203,16 @@ func writePump(client *hub.Client) {
 	}
 }
 
-// handleIncomingMessage processes incoming messages from clients
+// handleIncomingMessage decodes an event and hands it to the inbound router
 func handleIncomingMessage(client *hub.Client, message []byte) {
 	var wsMsg models.WSMessage
 	if err := json.Unmarshal(message, &wsMsg); err != nil {
+		metrics.EventsIn.WithLabelValues("invalid").Inc()
+		client.Logger().Warn("invalid ws message", logging.KeyEvent, "invalid", "error", err)
 		sendError(client, "Invalid WS message format")
 		return
 	}
-
-	switch wsMsg.Type {
-	case "transfer_chat":
-		handleChatTransferToUser(client, wsMsg.Payload)
-	case "accept_chat":
-		handleHumanAcceptTheChat(client, wsMsg.Payload)
-	case "message":
-		if client.FlagRevealed == true {
-			handleConversationWithHuman(client, wsMsg.Payload)
-		} else { 
-			handleChatStreamMessage(client, wsMsg.Payload)
-		}
-	case "ping":
-		sendPong(client)
-	default:
-		sendError(client, "Unknown message type")
-	}
+	inbound.dispatch(client, wsMsg.Type, wsMsg.Payload)
 }
 
 // sendWelcomeMessage sends a welcome message to newly connected clients
@@ -244,14 +251,15 @@ func sendMessage(client *hub.Client, msgType string, payload interface{}) {
 
 	msgBytes, err := json.Marshal(wsMsg)
 	if err != nil {
-		log.Println("Error marshaling message:", err)
+		client.Logger().Error("error marshaling message", logging.KeyEvent, msgType, "error", err)
 		return
 	}
 
-	select {
-	case client.Send <- msgBytes:
-	default:
-		log.Println("Client send channel is full")
+	// the send queue counts what its policy drops
+	if client.Deliver(msgBytes) {
+		metrics.EventsOut.WithLabelValues(msgType).Inc()
+	} else {
+		client.Logger().Warn("client send queue is full, message lost", logging.KeyEvent, msgType, "policy", client.Send.Policy().Mode)
 	}
 }
 
@@ -2,55 +2,220 @@ package handler
 
 import (
 	"butter-socket/internal/hub"
+	"butter-socket/internal/knowledge"
 	"butter-socket/internal/llm"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"butter-socket/internal/usage"
 	"butter-socket/models"
 	"context"
-	"encoding/json"
+	"errors"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
+)
+
+// Knowledge retrieval limits for one AI reply
+const (
+	knowledgePassages = 4
+	knowledgeTimeout  = 2 * time.Second
 )
 
+// handleChatStreamMessage saves a customer message and starts the AI reply in
+// the background, so the read loop keeps serving pings, stop_generation and
+// transfer_chat while the model streams
 func handleChatStreamMessage(client *hub.Client, payload any) {
 
-	// 1. Parse user message
-	payloadBytes, _ := json.Marshal(payload)
-	var msgIn models.MsgInOut
-	json.Unmarshal(payloadBytes, &msgIn)
+	// 1. Save the customer's message, validated and moderated on its way in
+	msgIn := payload.(models.MsgInOut)
+	client.Hub.SaveMessage(client, msgIn)
 
-	// 2. Cancel previous AI if still running
-	if client.CancelAI != nil {
-		client.CancelAI()
+	// 2. Don't start new replies while the server is shutting down
+	if client.Hub.Draining() {
+		sendError(client, "server is restarting, please reconnect")
+		return
 	}
 
-	// 3. Create cancellable context
-	ctx, cancel := context.WithCancel(context.Background())
-	client.CancelAI = cancel
+	// 3. Check the company's AI budget
+	req := llm.Request{Input: msgIn.Content}
+	if services.Usage != nil {
+		decision := services.Usage.Decide(client.Conversation.CompanyId)
+		if decision.Handoff {
+			handleBudgetHandoff(client)
+			return
+		}
+		req.Model = decision.Model
+	}
 
-	// 4. Tell frontend: AI started typing
-	sendMessage(client, "typing_start", nil)
+	// 4. Create cancellable context, superseding the previous AI reply if still running
+	ctx, cancel := context.WithCancelCause(context.Background())
+	client.SetCancelAI(cancel)
 
-	var fullReply string
+	// 5. Stream off the read loop; shutdown waits for it like a pump
+	client.Hub.Go(func() {
+		defer cancel(nil)
+		streamAIReply(ctx, client, req)
+	})
+}
+
+// streamAIReply streams one AI reply to the customer until it completes or
+// its context is cancelled
+func streamAIReply(ctx context.Context, client *hub.Client, req llm.Request) {
 
-	// 5. Start streaming AI
-	err := llm.StreamButterAI(ctx, msgIn.Content, func(token string) {
+	// 1. Tell frontend: AI started typing
+	sendMessage(client, "typing_start", nil)
 
-		fullReply += token
+	// 2. Ground the reply in the company's knowledge base and let it call the company's tools
+	passages := retrieveKnowledge(ctx, client, req.Input)
+	req.Instructions = knowledge.Instructions(passages)
+	if services.Tools != nil {
+		req.Tools = services.Tools.For(client.CompanyID(), client.Conversation.Id)
+	}
 
-		// 6. Send token immediately
-		sendMessage(client, "message_chunk", models.MsgInOut{
-			SenderType:  "AI-AGENT",
-			Content:     token,
-			ContentType: "text",
-			CreatedAt:   time.Now().Format(time.RFC3339),
-		})
+	// 3. Stream the AI reply, merging tokens into fewer frames
+	reply := models.MsgInOut{
+		MessageId:   uuid.New().String(),
+		SenderType:  "AI-AGENT",
+		ReceiverId:  client.Customer.Id,
+		ContentType: "text",
+	}
+	var fullReply strings.Builder
+	chunks := newChunkBatcher(client, reply.MessageId, services.ChunkBatching)
+	used, err := llm.StreamButterAI(ctx, req, func(token string) {
+		fullReply.WriteString(token)
+		chunks.add(token)
 	})
+	chunks.finish()
+	reply.Content = fullReply.String()
+
+	// 4. Account for the tokens, even on a failed or cancelled stream
+	recordUsage(client, used)
 
 	if err != nil {
+		if ctx.Err() != nil {
+			handleInterruptedReply(client, reply, context.Cause(ctx))
+			return
+		}
+		client.Logger().Error("AI stream failed", logging.KeyEvent, "message", "model", used.Model, "error", err)
 		sendError(client, "AI error")
 		return
 	}
 
-	// 7. Tell frontend: AI finished
+	// 5. Send the whole reply under the ID its chunks carried, with its sources;
+	// a blocked reply is retracted instead
+	reply.CreatedAt = time.Now().Format(time.RFC3339)
+	reply.Citations = knowledge.Cite(passages, reply.Content)
+	allowed := moderate(client, client, &reply)
+	if allowed {
+		sendMessage(client, "message", reply)
+	}
+
+	// 6. Tell frontend: AI finished
 	sendMessage(client, "typing_end", nil)
 
-	// 8. Save fullReply to DB (later)
+	// 7. Save the whole reply
+	if allowed {
+		client.Hub.SaveMessage(client, reply)
+	}
+}
+
+// retrieveKnowledge finds the company's passages relevant to the customer's
+// question; retrieval problems only cost the reply its grounding
+func retrieveKnowledge(ctx context.Context, client *hub.Client, question string) []knowledge.Passage {
+	if services.Knowledge == nil || strings.TrimSpace(question) == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, knowledgeTimeout)
+	defer cancel()
+	passages, err := services.Knowledge.Search(ctx, client.CompanyID(), question, knowledgePassages)
+	if err != nil {
+		client.Logger().Warn("knowledge retrieval failed", logging.KeyEvent, "message", "error", err)
+		return nil
+	}
+	return passages
+}
+
+// interruptedReply tells the customer an AI reply stopped early and what of it
+// was already sent
+type interruptedReply struct {
+	MessageId string `json:"message_id"`
+	Content   string `json:"content"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"created_at"`
+}
+
+// handleInterruptedReply closes out a cancelled AI reply: the customer learns
+// it was cut short, and whatever was streamed is kept in the conversation
+func handleInterruptedReply(client *hub.Client, reply models.MsgInOut, cause error) {
+	reason := hub.StopReason("cancelled")
+	errors.As(cause, &reason)
+	client.Logger().Info("AI reply interrupted", logging.KeyEvent, "message", "reason", string(reason), "partial_bytes", len(reply.Content))
+
+	// what was streamed is moderated like a whole reply before anyone sees it again
+	allowed := reply.Content != "" && moderate(nil, client, &reply)
+	if !allowed {
+		reply.Content = ""
+	}
+
+	// a customer who left has nobody to tell
+	if reason != hub.StopDisconnected {
+		sendMessage(client, "message_interrupted", interruptedReply{
+			MessageId: reply.MessageId,
+			Content:   reply.Content,
+			Reason:    string(reason),
+			CreatedAt: time.Now().Format(time.RFC3339),
+		})
+		// the reply that superseded this one keeps the typing indicator
+		if reason != hub.StopSuperseded {
+			sendMessage(client, "typing_end", nil)
+		}
+	}
+
+	if allowed {
+		client.Hub.SaveMessage(client, reply)
+	}
+}
+
+// recordUsage books an LLM response against the client's company and conversation
+func recordUsage(client *hub.Client, used llm.Usage) {
+	metrics.LLMStreamSeconds.WithLabelValues(used.Model).Observe(used.Latency.Seconds())
+	if used.TimeToFirstToken > 0 {
+		metrics.LLMTimeToFirstToken.WithLabelValues(used.Model).Observe(used.TimeToFirstToken.Seconds())
+	}
+
+	if used.Estimated {
+		client.Logger().Info("AI usage estimated for a reply that ended early", logging.KeyEvent, "message",
+			"input_tokens", used.InputTokens, "output_tokens", used.OutputTokens)
+	}
+
+	if services.Usage == nil {
+		return
+	}
+	services.Usage.Record(usage.Record{
+		CompanyID:      client.Conversation.CompanyId,
+		ConversationID: client.Conversation.Id,
+		Model:          used.Model,
+		InputTokens:    used.InputTokens,
+		OutputTokens:   used.OutputTokens,
+		Latency:        used.Latency,
+	})
+}
+
+// handleBudgetHandoff moves a customer to a human once the company has
+// exhausted its AI budget. A customer already waiting for or talking to a
+// human is left where they are.
+func handleBudgetHandoff(client *hub.Client) {
+	if client.Status() != hub.StatusAI {
+		return
+	}
+	client.Logger().Warn("AI budget exhausted, handing conversation to a human", logging.KeyEvent, "message")
+
+	sendMessage(client, "connection_event", models.MsgInOut{
+		SenderType: "system",
+		SenderId:   "system",
+		ReceiverId: client.Customer.Id,
+		Content:    "connecting you to a human agent",
+	})
+	handleChatTransferToUser(client, client.Conversation)
 }
@@ -1,22 +1,33 @@
 package handler
 
 import (
+	"butter-socket/internal/authz"
 	"butter-socket/internal/hub"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
 	"butter-socket/models"
 	"bytes"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 // WsUserHandler handles WebSocket connections for EMPLOYEES
 func WsUserHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if h.Draining() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	logger := slog.Default().With(logging.KeyEvent, "connect", "remote_addr", r.RemoteAddr)
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Upgrade error:", err)
+		logger.Warn("upgrade error", "error", err)
 		return
 	}
 
@@ -33,12 +44,13 @@ func WsUserHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 	// Get token
 	userToken := r.URL.Query().Get("token")
 	if userToken == "" {
-		log.Println("Missing token parameter")
+		logger.Warn("missing token parameter")
+		metrics.AuthFailures.WithLabelValues("user", "missing_token").Inc()
 		closeConn(websocket.ClosePolicyViolation, "missing token")
 		return
 	}
 
-	log.Printf("Employee connection attempt with token: %s...", userToken[:min(10, len(userToken))])
+	logger.Debug("employee connection attempt", "token_prefix", userToken[:min(10, len(userToken))])
 
 	// request to auth service
 	req, err := http.NewRequest(
@@ -47,7 +59,8 @@ func WsUserHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 		bytes.NewBuffer([]byte(`{}`)),
 	)
 	if err != nil {
-		log.Println("Request creation failed:", err)
+		logger.Error("auth request creation failed", "error", err)
+		metrics.AuthFailures.WithLabelValues("user", "internal_error").Inc()
 		closeConn(websocket.CloseInternalServerErr, "internal error")
 		return
 	}
@@ -61,57 +74,60 @@ func WsUserHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Auth API error:", err)
+		logger.Error("auth API error", "error", err)
+		metrics.AuthFailures.WithLabelValues("user", "auth_unavailable").Inc()
 		closeConn(websocket.CloseTryAgainLater, "auth service unavailable")
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Auth failed with status: %d", resp.StatusCode)
+		logger.Warn("auth failed", "status", resp.StatusCode)
+		metrics.AuthFailures.WithLabelValues("user", "unauthorized").Inc()
 		closeConn(websocket.ClosePolicyViolation, "unauthorized")
 		return
 	}
 
 	var result models.EssentialResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Println("Decode error:", err)
+		logger.Error("auth response decode error", "error", err)
+		metrics.AuthFailures.WithLabelValues("user", "invalid_auth_response").Inc()
 		closeConn(websocket.CloseInternalServerErr, "invalid auth response")
 		return
 	}
 
 	// Validate response User
 	if result.User.UserID == "" {
-		log.Println("No user ID in response")
+		logger.Warn("no user ID in auth response")
+		metrics.AuthFailures.WithLabelValues("user", "missing_user_id").Inc()
 		closeConn(websocket.ClosePolicyViolation, "invalid user User")
 		return
 	}
 
 	if len(result.User.Departments) == 0 {
-		log.Println("No departments found for user")
+		logger.Warn("no departments found for user", logging.KeyUser, result.User.UserID, logging.KeyCompany, result.User.CompanyID)
+		metrics.AuthFailures.WithLabelValues("user", "no_departments").Inc()
 		closeConn(websocket.ClosePolicyViolation, "no departments assigned")
 		return
 	}
 
-	log.Printf("Employee authenticated: %s, Company: %s, Departments: %d",
-		result.User.UserID, result.User.CompanyID, len(result.User.Departments))
-
-	// Log departments
+	departmentIDs := make([]string, 0, len(result.User.Departments))
 	for _, dept := range result.User.Departments {
-		log.Printf("   - Department: %s (ID: %s)", dept.DepartmentName, dept.DepartmentID)
+		departmentIDs = append(departmentIDs, dept.DepartmentID)
 	}
 
 	// Create WebSocket client for employee
 	wsClient := &hub.Client{
-		Type:         "user",
-		Hub:          h,
-		Conn:         conn,
-		Send:         make(chan []byte, 256),
-		User:         &result.User,
-		SosFlag:      true,
-		FlagRevealed: true,
+		ID:   uuid.New().String(),
+		Type: "user",
+		Hub:  h,
+		Conn: conn,
+		Send: hub.NewSendQueue(sendQueueSize, services.AgentSendPolicy),
+		User: &result.User,
 	}
 
+	wsClient.Logger().Info("employee authenticated", logging.KeyEvent, "connect", "departments", departmentIDs, "role", authz.Role(&result.User))
+
 	// Register the employee
 	h.RegisterClient(wsClient)
 
@@ -119,8 +135,8 @@ func WsUserHandler(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 	sendWelcomeMessage(wsClient)
 
 	// Start goroutines for reading and writing
-	go writePump(wsClient)
-	go readPump(wsClient)
+	h.Go(func() { writePump(wsClient) })
+	h.Go(func() { readPump(wsClient) })
 }
 
 func min(a, b int) int {
@@ -0,0 +1,375 @@
+package hub
+
+import (
+	"butter-socket/internal/bus"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"butter-socket/models"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Broadcast audiences
+const (
+	AudienceAll       = "all"       // -> customers and agents
+	AudienceCustomers = "customers" // -> customers only
+	AudienceAgents    = "agents"    // -> agents only
+)
+
+// Recipient delivery states
+const (
+	RecipientDelivered = "delivered" // -> queued on the first try
+	RecipientPending   = "pending"   // -> queue full, still retrying
+	RecipientDelayed   = "delayed"   // -> queued after waiting on a slow consumer
+	RecipientMissed    = "missed"    // -> queue stayed full for slowConsumerWait
+	RecipientGone      = "gone"      // -> left before the frame could be queued
+)
+
+const (
+	// slowConsumerWait is how long a full queue gets to drain before the
+	// recipient misses the broadcast. The connection itself stays up.
+	slowConsumerWait = 10 * time.Second
+
+	// slowConsumerRetry is the pause between delivery attempts to full queues
+	slowConsumerRetry = 100 * time.Millisecond
+
+	// broadcastHistory bounds the reports kept for the admin API
+	broadcastHistory = 200
+)
+
+// ErrInvalidScope is returned for a broadcast without a company or with an unknown audience
+var ErrInvalidScope = errors.New("invalid broadcast scope")
+
+// Scope selects the recipients of a broadcast inside one company. Empty
+// fields don't narrow the selection.
+type Scope struct {
+	CompanyID    string `json:"company_id"`
+	DepartmentID string `json:"department_id,omitempty"` // -> agents in it, customers routed to it
+	Segment      string `json:"segment,omitempty"`       // -> customers of this segment; agents are never filtered by it
+	Audience     string `json:"audience,omitempty"`      // -> all (default), customers or agents
+}
+
+// Validate checks the scope names a company and a known audience
+func (s Scope) Validate() error {
+	if s.CompanyID == "" {
+		return fmt.Errorf("%w: missing company_id", ErrInvalidScope)
+	}
+	switch s.Audience {
+	case "", AudienceAll, AudienceCustomers, AudienceAgents:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown audience %q", ErrInvalidScope, s.Audience)
+}
+
+// matches reports whether a client of the scope's company is a recipient
+func (s Scope) matches(c *Client) bool {
+	if c.Type == "user" {
+		if s.Audience == AudienceCustomers {
+			return false
+		}
+		if s.DepartmentID == "" {
+			return true
+		}
+		return slices.ContainsFunc(c.User.Departments, func(d models.Department) bool {
+			return d.DepartmentID == s.DepartmentID
+		})
+	}
+
+	if s.Audience == AudienceAgents {
+		return false
+	}
+	if s.Segment != "" && c.Customer.Segment != s.Segment {
+		return false
+	}
+	if s.DepartmentID != "" && (c.Conversation == nil || c.Snapshot().DepartmentId != s.DepartmentID) {
+		return false
+	}
+	return true
+}
+
+// Recipient is the delivery outcome of a broadcast for one connection
+type Recipient struct {
+	ConnID      string     `json:"conn_id"`
+	Type        string     `json:"type"`
+	ID          string     `json:"id"` // -> customer or user ID
+	Node        string     `json:"node,omitempty"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// BroadcastReport accounts for every recipient of a broadcast. Recipients on
+// other nodes appear once their node has finished delivering.
+type BroadcastReport struct {
+	ID         string         `json:"id"`
+	Scope      Scope          `json:"scope"`
+	Source     string         `json:"source,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Counts     map[string]int `json:"counts"`
+	Recipients []Recipient    `json:"recipients,omitempty"`
+}
+
+// broadcastRecord collects recipient outcomes while a broadcast is delivered
+type broadcastRecord struct {
+	mu         sync.Mutex
+	report     BroadcastReport
+	recipients map[string]*Recipient // -> by connection ID
+}
+
+func newBroadcastRecord(id string, scope Scope, source string) *broadcastRecord {
+	return &broadcastRecord{
+		report:     BroadcastReport{ID: id, Scope: scope, Source: source, CreatedAt: time.Now()},
+		recipients: make(map[string]*Recipient),
+	}
+}
+
+func (r *broadcastRecord) set(rcpt Recipient) {
+	r.mu.Lock()
+	r.recipients[rcpt.ConnID] = &rcpt
+	r.mu.Unlock()
+}
+
+// snapshot copies the report, with recipients when withRecipients is set
+func (r *broadcastRecord) snapshot(withRecipients bool) BroadcastReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := r.report
+	out.Counts = make(map[string]int)
+	for _, rcpt := range r.recipients {
+		out.Counts[rcpt.State]++
+		if withRecipients {
+			out.Recipients = append(out.Recipients, *rcpt)
+		}
+	}
+	slices.SortFunc(out.Recipients, func(a, b Recipient) int {
+		return cmp.Compare(a.ConnID, b.ConnID)
+	})
+	return out
+}
+
+// broadcastLog keeps the latest broadcasts started on this node
+type broadcastLog struct {
+	mu      sync.Mutex
+	records map[string]*broadcastRecord
+	order   []string // -> oldest first
+}
+
+func newBroadcastLog() *broadcastLog {
+	return &broadcastLog{records: make(map[string]*broadcastRecord)}
+}
+
+func (l *broadcastLog) add(r *broadcastRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[r.report.ID] = r
+	l.order = append(l.order, r.report.ID)
+	if len(l.order) > broadcastHistory {
+		delete(l.records, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+func (l *broadcastLog) get(id string) *broadcastRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.records[id]
+}
+
+// broadcastEnvelope carries a broadcast to the other nodes
+type broadcastEnvelope struct {
+	ID    string          `json:"id"`
+	Scope Scope           `json:"scope"`
+	Frame json.RawMessage `json:"frame"`
+}
+
+// broadcastReceipt reports a node's recipients back to the node that started the broadcast
+type broadcastReceipt struct {
+	ID         string      `json:"id"`
+	Recipients []Recipient `json:"recipients"`
+}
+
+// Broadcast sends a WS frame to every client in scope, on every node, and
+// returns the ID of its delivery report. The frame only takes free room in
+// a client's queue, whatever its send policy; clients with a full queue are
+// retried for slowConsumerWait and reported delayed or missed, never
+// disconnected or made to lose other frames.
+func (h *Hub) Broadcast(scope Scope, frame []byte, source string) (string, error) {
+	if err := scope.Validate(); err != nil {
+		return "", err
+	}
+	if scope.Audience == "" {
+		scope.Audience = AudienceAll
+	}
+
+	id := uuid.New().String()
+	record := newBroadcastRecord(id, scope, source)
+	h.broadcasts.add(record)
+
+	slog.Info("broadcast started",
+		logging.KeyEvent, "broadcast",
+		logging.KeyCompany, scope.CompanyID,
+		"broadcast_id", id,
+		"department_id", scope.DepartmentID,
+		"segment", scope.Segment,
+		"audience", scope.Audience,
+		"source", source)
+
+	payload, _ := json.Marshal(broadcastEnvelope{ID: id, Scope: scope, Frame: frame})
+	h.publish(bus.Envelope{Kind: kindBroadcast, CompanyID: scope.CompanyID, Payload: payload})
+	h.broadcastLocal(record, scope, frame, nil)
+	return id, nil
+}
+
+// BroadcastReport returns the delivery report of a broadcast started on this node
+func (h *Hub) BroadcastReport(id string) (BroadcastReport, bool) {
+	record := h.broadcasts.get(id)
+	if record == nil {
+		return BroadcastReport{}, false
+	}
+	return record.snapshot(true), true
+}
+
+// Broadcasts lists recent broadcasts started on this node, newest first,
+// without their recipients. An empty companyID lists every company.
+func (h *Hub) Broadcasts(companyID string) []BroadcastReport {
+	h.broadcasts.mu.Lock()
+	records := make([]*broadcastRecord, 0, len(h.broadcasts.order))
+	for i := len(h.broadcasts.order) - 1; i >= 0; i-- {
+		records = append(records, h.broadcasts.records[h.broadcasts.order[i]])
+	}
+	h.broadcasts.mu.Unlock()
+
+	out := []BroadcastReport{}
+	for _, r := range records {
+		if companyID == "" || r.report.Scope.CompanyID == companyID {
+			out = append(out, r.snapshot(false))
+		}
+	}
+	return out
+}
+
+// broadcastLocal queues the frame for local clients in scope, then keeps
+// retrying full queues in the background. done, if set, runs with the final
+// recipients once every one of them is settled.
+func (h *Hub) broadcastLocal(record *broadcastRecord, scope Scope, frame []byte, done func([]Recipient)) {
+	var slow []*Client
+	var settled []Recipient
+	for _, client := range h.companyClients(scope.CompanyID) {
+		if !scope.matches(client) {
+			continue
+		}
+		rcpt := Recipient{ConnID: client.ID, Type: client.Type, ID: client.remoteKey(), Node: h.nodeID, Attempts: 1}
+		if client.Send.offer(frame) {
+			now := time.Now()
+			rcpt.State = RecipientDelivered
+			rcpt.DeliveredAt = &now
+			metrics.BroadcastRecipients.WithLabelValues(rcpt.State).Inc()
+			settled = append(settled, rcpt)
+		} else {
+			rcpt.State = RecipientPending
+			slow = append(slow, client)
+		}
+		record.set(rcpt)
+	}
+
+	if len(slow) == 0 {
+		if done != nil {
+			done(settled)
+		}
+		return
+	}
+	go h.retrySlow(record, frame, slow, settled, done)
+}
+
+// retrySlow keeps offering the frame to clients whose queue was full until
+// they take it, leave, or slowConsumerWait runs out
+func (h *Hub) retrySlow(record *broadcastRecord, frame []byte, slow []*Client, settled []Recipient, done func([]Recipient)) {
+	ticker := time.NewTicker(slowConsumerRetry)
+	defer ticker.Stop()
+	deadline := time.Now().Add(slowConsumerWait)
+	attempts := make(map[string]int, len(slow))
+
+	settle := func(client *Client, state string) {
+		rcpt := Recipient{
+			ConnID:   client.ID,
+			Type:     client.Type,
+			ID:       client.remoteKey(),
+			Node:     h.nodeID,
+			State:    state,
+			Attempts: attempts[client.ID] + 1,
+		}
+		if state == RecipientDelayed {
+			now := time.Now()
+			rcpt.DeliveredAt = &now
+		}
+		record.set(rcpt)
+		settled = append(settled, rcpt)
+		metrics.BroadcastRecipients.WithLabelValues(state).Inc()
+		if state == RecipientMissed {
+			client.Logger().Warn("slow consumer missed a broadcast", logging.KeyEvent, "broadcast", "broadcast_id", record.report.ID)
+		}
+	}
+
+	for len(slow) > 0 {
+		<-ticker.C
+		expired := time.Now().After(deadline)
+		remaining := slow[:0]
+		for _, client := range slow {
+			attempts[client.ID]++
+			switch {
+			case client.Send.offer(frame):
+				settle(client, RecipientDelayed)
+			case client.isClosed():
+				settle(client, RecipientGone)
+			case expired:
+				settle(client, RecipientMissed)
+			default:
+				remaining = append(remaining, client)
+			}
+		}
+		slow = remaining
+	}
+
+	if done != nil {
+		done(settled)
+	}
+}
+
+// handleBroadcast delivers a broadcast started on another node and reports
+// the recipients back to it
+func (h *Hub) handleBroadcast(env bus.Envelope) {
+	var b broadcastEnvelope
+	if err := json.Unmarshal(env.Payload, &b); err != nil {
+		slog.Warn("bad broadcast envelope", "origin", env.Origin, "error", err)
+		return
+	}
+	record := newBroadcastRecord(b.ID, b.Scope, env.Origin)
+	h.broadcastLocal(record, b.Scope, b.Frame, func(recipients []Recipient) {
+		payload, _ := json.Marshal(broadcastReceipt{ID: b.ID, Recipients: recipients})
+		h.publish(bus.Envelope{Kind: kindBroadcastReceipt, Target: env.Origin, CompanyID: b.Scope.CompanyID, Payload: payload})
+	})
+}
+
+// handleBroadcastReceipt files another node's recipients in a local broadcast's report
+func (h *Hub) handleBroadcastReceipt(env bus.Envelope) {
+	var receipt broadcastReceipt
+	if err := json.Unmarshal(env.Payload, &receipt); err != nil {
+		slog.Warn("bad broadcast receipt", "origin", env.Origin, "error", err)
+		return
+	}
+	record := h.broadcasts.get(receipt.ID)
+	if record == nil {
+		return
+	}
+	for _, rcpt := range receipt.Recipients {
+		record.set(rcpt)
+	}
+}
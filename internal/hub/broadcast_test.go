@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBroadcastSparesSlowConsumers(t *testing.T) {
+	h := NewHub()
+	fast := testCustomer(h, "fast", "acme")
+	slow := testCustomer(h, "slow", "acme")
+	slow.Send = NewSendQueue(1, SendPolicy{Mode: PolicyDisconnect})
+	h.RegisterClient(fast)
+	h.RegisterClient(slow)
+	fast.Send.Take()
+	slow.Send.Take()
+	slow.Send.push([]byte(`{"type":"message"}`))
+
+	id, err := h.Broadcast(Scope{CompanyID: "acme"}, []byte(`{"type":"broadcast"}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ := h.BroadcastReport(id)
+	if report.Counts[RecipientDelivered] != 1 || report.Counts[RecipientPending] != 1 {
+		t.Fatalf("counts = %v, want one delivered and one pending", report.Counts)
+	}
+	if slow.Send.overflowed || slow.isClosed() {
+		t.Fatal("broadcast tripped the slow client's disconnect policy")
+	}
+
+	// the slow client catches up and gets the broadcast late
+	if frames, _ := slow.Send.Take(); len(frames) != 1 || string(frames[0]) != `{"type":"message"}` {
+		t.Fatalf("slow client queue held %q, want only its message", frames)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if report, _ = h.BroadcastReport(id); report.Counts[RecipientDelayed] == 1 {
+			break
+		}
+		time.Sleep(slowConsumerRetry / 2)
+	}
+	for _, rcpt := range report.Recipients {
+		want := RecipientDelivered
+		if rcpt.ConnID == slow.ID {
+			want = RecipientDelayed
+		}
+		if rcpt.State != want || rcpt.DeliveredAt == nil {
+			t.Errorf("%s: state %s, delivered at %v, want %s", rcpt.ConnID, rcpt.State, rcpt.DeliveredAt, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/logging"
+	"butter-socket/models"
+	"context"
+	"slices"
+	"strings"
+)
+
+// classificationTags prefix the tags a classification owns
+var classificationTags = []string{"intent:", "topic:", "lang:", "sentiment:", "urgency:"}
+
+// Classifier reads a conversation's intent, topic, language, sentiment and urgency
+type Classifier interface {
+	Classify(ctx context.Context, conv models.Conversation) (*models.Classification, error)
+}
+
+// UseClassifier has conversations classified by c when they are handed to a
+// human and again when they close. Call before clients register.
+func (h *Hub) UseClassifier(c Classifier) {
+	h.classifier = c
+}
+
+// classificationData is the payload of conversation.classified
+type classificationData struct {
+	models.Classification
+	Stage string `json:"stage"`
+}
+
+// Classify classifies a customer's conversation, keeping the result and its
+// tags on the conversation and saving it with conversation.classified. A
+// conversation not yet with a human is routed to the department the
+// company's taxonomy names. It returns nil when classification is off or the
+// customer hasn't written yet.
+func (h *Hub) Classify(ctx context.Context, customer *Client, stage string) (*models.Classification, error) {
+	if h.classifier == nil || customer.Conversation == nil {
+		return nil, nil
+	}
+	conv, err := h.withMessages(ctx, customer.Snapshot())
+	if err != nil {
+		return nil, err
+	}
+	result, err := h.classifier.Classify(ctx, conv)
+	if err != nil || result == nil {
+		return nil, err
+	}
+
+	saved := customer.UpdateConversation(func(conv *models.Conversation) {
+		conv.Classification = result
+		conv.Tags = classifiedTags(conv.Tags, result)
+		if result.DepartmentID != "" && conv.AssignedTo == "" {
+			conv.DepartmentId = result.DepartmentID
+		}
+	})
+	customer.Logger().Info("conversation classified",
+		logging.KeyEvent, "classify",
+		"stage", stage,
+		"intent", result.Intent,
+		"topic", result.Topic,
+		"urgency", result.Urgency,
+		"department_id", result.DepartmentID)
+	h.save(customer, saved, events.ConversationClassified, classificationData{Classification: *result, Stage: stage})
+	return result, nil
+}
+
+// classifiedTags replaces the tags of an earlier classification, keeping any others
+func classifiedTags(tags []string, c *models.Classification) []string {
+	out := slices.DeleteFunc(slices.Clone(tags), func(tag string) bool {
+		return slices.ContainsFunc(classificationTags, func(prefix string) bool {
+			return strings.HasPrefix(tag, prefix)
+		})
+	})
+	return append(out,
+		"intent:"+c.Intent,
+		"topic:"+c.Topic,
+		"lang:"+c.Language,
+		"sentiment:"+c.Sentiment,
+		"urgency:"+c.Urgency,
+	)
+}
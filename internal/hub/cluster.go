@@ -0,0 +1,318 @@
+package hub
+
+import (
+	"butter-socket/internal/bus"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"butter-socket/models"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// Envelope kinds exchanged between hubs
+const (
+	kindPresence         = "presence"          // -> a client connected or left
+	kindPresenceSync     = "presence_sync"     // -> a node asks the others to announce their clients
+	kindDeliver          = "deliver"           // -> a WS frame for a client on the target node
+	kindAssign           = "assign"            // -> a human took over a customer's conversation
+	kindBroadcast        = "broadcast"         // -> a WS frame for the clients in a scope
+	kindBroadcastReceipt = "broadcast_receipt" // -> recipients of a broadcast, for the node that started it
+	kindDisconnect       = "disconnect"        // -> close a connection by its ID
+	kindClose            = "close"             // -> end a customer's conversation
+	kindWatch            = "watch"             // -> a supervisor started or stopped watching a conversation
+)
+
+// publishTimeout bounds a single bus publish so a stuck broker can't wedge the hub
+const publishTimeout = 5 * time.Second
+
+// announcement tells the other nodes about a local client
+type announcement struct {
+	ConnID         string           `json:"conn_id"`
+	Type           string           `json:"type"`
+	Online         bool             `json:"online"`
+	Customer       *models.Customer `json:"customer,omitempty"`
+	User           *models.User     `json:"user,omitempty"`
+	ConversationID string           `json:"conversation_id,omitempty"`
+	AssignedTo     string           `json:"assigned_to,omitempty"` // -> routing, so other nodes can authorize their agents
+	DepartmentID   string           `json:"department_id,omitempty"`
+}
+
+// UseBus connects the hub to other instances. Must be called before clients register.
+func (h *Hub) UseBus(b bus.Bus, nodeID string) error {
+	h.bus = b
+	h.nodeID = nodeID
+	if err := b.Subscribe(nodeID, h.handleEnvelope); err != nil {
+		return err
+	}
+
+	go h.publishPump()
+
+	// ask everyone already running who is connected where
+	h.publish(bus.Envelope{Kind: kindPresenceSync})
+	return nil
+}
+
+// NodeID identifies this instance on the bus
+func (h *Hub) NodeID() string {
+	return h.nodeID
+}
+
+// publish queues env for the bus. The hub never waits on the broker: with
+// the queue full, e.g. while the broker is down, the envelope is dropped.
+func (h *Hub) publish(env bus.Envelope) {
+	if h.bus == nil {
+		return
+	}
+	env.Origin = h.nodeID
+	select {
+	case h.outbound <- env:
+	default:
+		metrics.BusDropped.WithLabelValues(env.Kind).Inc()
+		slog.Warn("bus queue full, dropping envelope", "kind", env.Kind, "target", env.Target, "queued", len(h.outbound))
+	}
+}
+
+func (h *Hub) publishPump() {
+	for env := range h.outbound {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		if err := h.bus.Publish(ctx, env); err != nil {
+			slog.Error("bus publish failed", "kind", env.Kind, "target", env.Target, "error", err)
+		}
+		cancel()
+	}
+}
+
+// announce tells other nodes a local client came or went
+func (h *Hub) announce(client *Client, online bool, target string) {
+	if h.bus == nil || client.Remote {
+		return
+	}
+	p := announcement{
+		ConnID: client.ID,
+		Type:   client.Type,
+		Online: online,
+	}
+	if client.Type == "user" {
+		p.User = client.User
+	} else {
+		p.Customer = client.Customer
+	}
+	if client.Conversation != nil {
+		conv := client.Snapshot()
+		p.ConversationID = conv.Id
+		p.AssignedTo = conv.AssignedTo
+		p.DepartmentID = conv.DepartmentId
+	}
+	payload, _ := json.Marshal(p)
+	h.publish(bus.Envelope{Kind: kindPresence, Target: target, ClientType: client.Type, Payload: payload})
+}
+
+// forward ships frames queued on a remote client's Send queue to its node
+func (h *Hub) forward(proxy *Client) {
+	for range proxy.Send.Ready() {
+		frames, ok := proxy.Send.Take()
+		if !ok {
+			return
+		}
+		for _, msg := range frames {
+			h.publish(bus.Envelope{
+				Kind:       kindDeliver,
+				Target:     proxy.Node,
+				ClientType: proxy.Type,
+				ClientID:   proxy.remoteKey(),
+				Payload:    msg,
+			})
+		}
+	}
+}
+
+// remoteKey is the ID the owning node files the client under
+func (c *Client) remoteKey() string {
+	if c.Type == "user" {
+		return c.User.UserID
+	}
+	return c.Customer.Id
+}
+
+func (h *Hub) handleEnvelope(env bus.Envelope) {
+	switch env.Kind {
+	case kindPresence:
+		var p announcement
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			slog.Warn("bad presence envelope", "origin", env.Origin, "error", err)
+			return
+		}
+		if p.Online {
+			h.addRemote(env.Origin, p)
+		} else {
+			h.removeRemote(p)
+		}
+
+	case kindPresenceSync:
+		for _, c := range h.localClients(nil) {
+			h.announce(c, true, env.Origin)
+		}
+
+	case kindDeliver:
+		if client := h.localClient(env.ClientType, env.ClientID); client != nil {
+			if !client.Deliver(env.Payload) {
+				client.Logger().Warn("client send channel is full, dropping remote message", logging.KeyEvent, kindDeliver)
+			}
+		}
+
+	case kindAssign:
+		var user models.User
+		if err := json.Unmarshal(env.Payload, &user); err != nil {
+			slog.Warn("bad assign envelope", "origin", env.Origin, "error", err)
+			return
+		}
+		if customer := h.localClient("customer", env.ClientID); customer != nil {
+			h.AssignAgent(customer, &user)
+		}
+
+	case kindBroadcast:
+		h.handleBroadcast(env)
+
+	case kindBroadcastReceipt:
+		h.handleBroadcastReceipt(env)
+
+	case kindClose:
+		if customer := h.localClient("customer", env.ClientID); customer != nil {
+			h.CloseConversation(customer, string(env.Payload))
+		}
+
+	case kindWatch:
+		h.handleWatch(env)
+
+	case kindDisconnect:
+		if client := h.GetClientByConnId(env.ClientID); client != nil && !client.Remote {
+			h.Disconnect(client, string(env.Payload))
+		}
+	}
+}
+
+// addRemote files a proxy for a client on another node and returns it
+func (h *Hub) addRemote(node string, p announcement) *Client {
+	proxy := &Client{
+		ID:     p.ConnID,
+		Type:   p.Type,
+		Hub:    h,
+		Send:   NewSendQueue(256, SendPolicy{Mode: PolicyDropNonCritical}),
+		Remote: true,
+		Node:   node,
+	}
+	switch {
+	case p.User != nil:
+		proxy.Type = "user"
+		proxy.User = p.User
+	case p.Customer != nil:
+		proxy.Type = "customer"
+		proxy.Customer = p.Customer
+		proxy.Conversation = &models.Conversation{
+			Id:           p.ConversationID,
+			CompanyId:    p.Customer.CompanyId,
+			Customer:     p.Customer,
+			AssignedTo:   p.AssignedTo,
+			DepartmentId: p.DepartmentID,
+		}
+	default:
+		return nil
+	}
+
+	companyID := proxy.CompanyID()
+	s := h.shardFor(companyID)
+	s.mu.Lock()
+	c := s.companyLocked(companyID, true)
+	proxies := c.proxies(proxy.Type)
+	id := proxy.remoteKey()
+	old := proxies[id]
+	if old != nil && old.ID == p.ConnID {
+		s.mu.Unlock()
+		// announced again because its conversation was routed elsewhere
+		if old.Conversation != nil {
+			old.UpdateConversation(func(conv *models.Conversation) {
+				conv.AssignedTo = p.AssignedTo
+				conv.DepartmentId = p.DepartmentID
+			})
+		}
+		return old
+	}
+	proxies[id] = proxy
+	if old != nil {
+		h.forgetRemoteLocked(c, old)
+	}
+	if c.local(proxy) == nil {
+		for _, key := range proxy.directoryKeys() {
+			h.dir.set(key, companyID)
+		}
+	} else {
+		// a local connection of the same client keeps its other entries
+		h.dir.set(dirConn+proxy.ID, companyID)
+	}
+	s.mu.Unlock()
+
+	if old != nil {
+		old.closeSend()
+	}
+	go h.forward(proxy)
+	return proxy
+}
+
+func (h *Hub) removeRemote(p announcement) {
+	var companyID, id string
+	switch {
+	case p.User != nil:
+		companyID, id = p.User.CompanyID, p.User.UserID
+	case p.Customer != nil:
+		companyID, id = p.Customer.CompanyId, p.Customer.Id
+	default:
+		return
+	}
+
+	s := h.shardFor(companyID)
+	s.mu.Lock()
+	c := s.companyLocked(companyID, false)
+	var proxy *Client
+	if c != nil {
+		proxies := c.proxies(p.Type)
+		if current, ok := proxies[id]; ok && current.ID == p.ConnID {
+			proxy = current
+			delete(proxies, id)
+			h.forgetRemoteLocked(c, proxy)
+			s.pruneLocked(companyID)
+		}
+	}
+	s.mu.Unlock()
+
+	if proxy != nil {
+		proxy.closeSend()
+		// the customer's own node tells the watchers the chat is over
+		if proxy.Type == "user" {
+			h.watchers.forgetWatcher(proxy)
+		} else {
+			h.watchers.end(p.ConversationID)
+		}
+	}
+}
+
+// forgetRemoteLocked drops a removed proxy's directory entries, keeping those a
+// local connection of the same client still owns; callers hold the shard lock
+func (h *Hub) forgetRemoteLocked(c *company, proxy *Client) {
+	h.dir.delete(dirConn + proxy.ID)
+	if c.local(proxy) != nil {
+		return
+	}
+	for _, key := range proxy.directoryKeys() {
+		h.dir.delete(key)
+	}
+}
+
+// localClient finds a client connected to this node
+func (h *Hub) localClient(clientType, id string) *Client {
+	if clientType == "user" {
+		return h.find(dirUser+id, func(c *company) *Client { return c.users[id] })
+	}
+	return h.find(dirCustomer+id, func(c *company) *Client { return c.customers[id] })
+}
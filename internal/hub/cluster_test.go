@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"butter-socket/internal/authz"
+	"butter-socket/internal/bus"
+	"butter-socket/models"
+	"context"
+	"testing"
+	"time"
+)
+
+// stuckBus is a broker that never answers
+type stuckBus struct {
+	release chan struct{}
+}
+
+func (b *stuckBus) Publish(ctx context.Context, env bus.Envelope) error {
+	<-b.release
+	return nil
+}
+
+func (b *stuckBus) Subscribe(nodeID string, handle func(bus.Envelope)) error { return nil }
+func (b *stuckBus) Close() error                                             { return nil }
+
+func TestPublishNeverBlocks(t *testing.T) {
+	b := &stuckBus{release: make(chan struct{})}
+	defer close(b.release)
+	h := NewHub()
+	if err := h.UseBus(b, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*cap(h.outbound); i++ {
+			h.publish(bus.Envelope{Kind: kindPresence})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on a stuck broker")
+	}
+}
+
+// eventually polls cond until it holds or a second has passed
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestProxyRouting routes a customer of node A and checks node B's proxy of
+// them follows, so B can authorize its own agents
+func TestProxyRouting(t *testing.T) {
+	b := bus.NewLocal()
+	defer b.Close()
+	nodeA, nodeB := NewHub(), NewHub()
+	for _, n := range []struct {
+		h  *Hub
+		id string
+	}{{nodeA, "node-a"}, {nodeB, "node-b"}} {
+		if err := n.h.UseBus(b, n.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	customer := testCustomer(nodeA, "cust-1", "acme")
+	customer.Conversation.DepartmentId = "support"
+	nodeA.RegisterClient(customer)
+	var proxy *Client
+	eventually(t, "node B to see the customer", func() bool {
+		proxy = nodeB.GetCustomerConn("cust-1")
+		return proxy != nil
+	})
+	if conv := proxy.Snapshot(); !proxy.Remote || conv.DepartmentId != "support" || conv.AssignedTo != "" {
+		t.Fatalf("proxy conversation %+v, want it in support and unassigned", conv)
+	}
+
+	colleague := &models.User{UserID: "agent-2", CompanyID: "acme", Departments: []models.Department{{DepartmentID: "billing"}}}
+	customer.UpdateConversation(func(conv *models.Conversation) { conv.DepartmentId = "billing" })
+	eventually(t, "the department to reach node B", func() bool { return proxy.Snapshot().DepartmentId == "billing" })
+	nodeA.AssignAgent(customer, &models.User{UserID: "agent-1", CompanyID: "acme"})
+	eventually(t, "the assignment to reach node B", func() bool { return proxy.Snapshot().AssignedTo == "agent-1" })
+
+	tests := []struct {
+		action  string
+		allowed bool
+	}{
+		{authz.Note, true},     // -> a colleague of the department
+		{authz.Message, false}, // -> someone else's chat
+		{authz.Accept, false},
+	}
+	conv := proxy.Snapshot()
+	for _, tt := range tests {
+		if err := authz.Check(colleague, tt.action, &conv); (err == nil) != tt.allowed {
+			t.Errorf("%s by agent-2 on node B: %v, want allowed %v", tt.action, err, tt.allowed)
+		}
+	}
+
+	// a node joining later hears the routing with the customer
+	nodeC := NewHub()
+	if err := nodeC.UseBus(b, "node-c"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "node C to see the routed customer", func() bool {
+		late := nodeC.GetCustomerConn("cust-1")
+		return late != nil && late.Snapshot().AssignedTo == "agent-1" && late.Snapshot().DepartmentId == "billing"
+	})
+}
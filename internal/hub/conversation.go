@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"butter-socket/internal/bus"
+	"butter-socket/internal/logging"
+	"butter-socket/models"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// closeGrace lets the write pump flush a goodbye before the socket closes
+const closeGrace = time.Second
+
+// CloseConversation marks a customer's conversation closed and ends its
+// connection with a normal close once queued messages are written
+func (h *Hub) CloseConversation(customer *Client, reason string) {
+	if customer.Remote {
+		h.publish(bus.Envelope{
+			Kind:       kindClose,
+			Target:     customer.Node,
+			ClientType: "customer",
+			ClientID:   customer.Customer.Id,
+			Payload:    []byte(reason),
+		})
+		return
+	}
+
+	customer.CancelAI(StopClosed)
+	customer.UpdateConversation(func(conv *models.Conversation) { conv.Status = "closed" })
+	customer.Logger().Info("conversation closed", logging.KeyEvent, "close_conversation", "reason", reason)
+
+	time.AfterFunc(closeGrace, func() {
+		_ = customer.Conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+			time.Now().Add(time.Second),
+		)
+		customer.Conn.Close()
+	})
+}
+
+// AddNote keeps an agent's internal note on the customer's conversation: with
+// its messages, marked internal, and on the conversation itself so transfer
+// offers carry it. It returns the note as kept.
+func (h *Hub) AddNote(customer *Client, note models.MsgInOut) models.MsgInOut {
+	now := time.Now().Format(time.RFC3339)
+	note.Internal = true
+	note.ReceiverId = ""
+	if note.MessageId == "" {
+		note.MessageId = uuid.New().String()
+	}
+	if note.CreatedAt == "" {
+		note.CreatedAt = now
+	}
+	customer.UpdateConversation(func(conv *models.Conversation) {
+		conv.Notes = append(conv.Notes, storedMessage(conv.Id, note, now))
+	})
+	h.SaveMessage(customer, note)
+	return note
+}
@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"butter-socket/models"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Go runs a connection pump in its own goroutine and tracks it for Wait. A
+// panicking pump is logged instead of taking the server down with it.
+func (h *Hub) Go(pump func()) {
+	h.pumps.Add(1)
+	go func() {
+		defer h.pumps.Done()
+		defer func() {
+			if p := recover(); p != nil {
+				slog.Error("background task panicked", "panic", p, "stack", string(debug.Stack()))
+			}
+		}()
+		pump()
+	}()
+}
+
+// Draining reports whether the hub has stopped accepting new connections
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// Drain stops new connections, tells every connected client to reconnect
+// elsewhere with a server_draining event and cancels AI replies in flight
+func (h *Hub) Drain() {
+	if !h.draining.CompareAndSwap(false, true) {
+		return
+	}
+
+	msg, _ := json.Marshal(models.WSMessage{
+		Type: "server_draining",
+		Payload: models.MsgInOut{
+			SenderId:    "system",
+			SenderType:  "system",
+			Content:     "server is restarting, please reconnect",
+			ContentType: "text",
+			CreatedAt:   time.Now().Format(time.RFC3339),
+		},
+	})
+
+	for _, client := range h.localClients(nil) {
+		client.CancelAI(StopDraining)
+		client.Deliver(msg)
+	}
+}
+
+// CloseAll closes every connection with a service restart close frame.
+// The read pumps then unregister their clients as usual.
+func (h *Hub) CloseAll() {
+	for _, client := range h.localClients(nil) {
+		_ = client.Conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server draining"),
+			time.Now().Add(time.Second),
+		)
+		client.Conn.Close()
+	}
+}
+
+// Wait blocks until every pump started with Go has exited or ctx is done
+func (h *Hub) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
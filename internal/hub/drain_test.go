@@ -0,0 +1,21 @@
+package hub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGoRecoversPanics(t *testing.T) {
+	h := NewHub()
+	h.Go(func() { panic("boom") })
+	ran := make(chan struct{})
+	h.Go(func() { close(ran) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Wait(ctx); err != nil {
+		t.Fatalf("Wait = %v, want the panicked task counted as done", err)
+	}
+	<-ran
+}
@@ -0,0 +1,140 @@
+package hub
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/store"
+	"butter-socket/models"
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// storeTimeout bounds a single conversation store write
+const storeTimeout = 5 * time.Second
+
+// UseStore persists conversations and messages in s, together with the
+// domain events they raise. Call before clients register.
+func (h *Hub) UseStore(s store.Store) {
+	h.store = s
+}
+
+// Emit saves the client's conversation together with a domain event about it
+func (h *Hub) Emit(client *Client, eventType string, data any) {
+	if h.store == nil || client == nil || client.Conversation == nil {
+		return
+	}
+	h.save(client, client.Snapshot(), eventType, data)
+}
+
+// save stores conv, a snapshot of the client's conversation, together with a
+// domain event about it
+func (h *Hub) save(client *Client, conv models.Conversation, eventType string, data any) {
+	if h.store == nil {
+		return
+	}
+	ev := events.New(eventType, conv.CompanyId, conv.Id, data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.store.SaveConversation(ctx, conv, ev); err != nil {
+		client.Logger().Error("conversation save failed", "event_type", eventType, "error", err)
+	}
+}
+
+// SaveMessage appends msg to the client's conversation, copies it to the
+// supervisors watching and raises message.created, or note.created for an
+// internal note so consumers relaying messages to customers can't pick it up
+func (h *Hub) SaveMessage(client *Client, msg models.MsgInOut) {
+	if client == nil || client.Conversation == nil {
+		return
+	}
+	conv := client.Conversation
+	now := time.Now().Format(time.RFC3339)
+	if msg.CreatedAt == "" {
+		msg.CreatedAt = now
+	}
+	if msg.MessageId == "" {
+		msg.MessageId = uuid.New().String()
+	}
+	h.mirror(conv.Id, msg)
+	if h.store == nil {
+		return
+	}
+	saved := storedMessage(conv.Id, msg, now)
+	eventType := events.MessageCreated
+	if msg.Internal {
+		eventType = events.NoteCreated
+	}
+	ev := events.New(eventType, conv.CompanyId, conv.Id, saved)
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	err := h.store.AppendMessage(ctx, saved, ev)
+	if err == store.ErrNotFound {
+		// conversations of remote customers were started on their own node
+		err = h.store.SaveConversation(ctx, client.Snapshot())
+		if err == nil {
+			err = h.store.AppendMessage(ctx, saved, ev)
+		}
+	}
+	if err != nil {
+		client.Logger().Error("message save failed", "error", err)
+	}
+}
+
+// storedMessage is how a message is kept with its conversation
+func storedMessage(conversationID string, msg models.MsgInOut, now string) models.Message {
+	return models.Message{
+		MetaData:       models.MetaData{CreatedAt: msg.CreatedAt, LastUpdated: now},
+		Id:             msg.MessageId,
+		ConversationId: conversationID,
+		SenderId:       msg.SenderId,
+		SenderType:     msg.SenderType,
+		Content:        msg.Content,
+		ContentType:    msg.ContentType,
+		Internal:       msg.Internal,
+	}
+}
+
+// conversationData is the payload of conversation.started and conversation.closed
+type conversationData struct {
+	CustomerID string `json:"customer_id"`
+	Source     string `json:"source,omitempty"`
+	AssignedTo string `json:"assigned_to,omitempty"`
+	Node       string `json:"node,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func (h *Hub) emitConversation(client *Client, eventType, reason string) {
+	if client.Remote || client.Customer == nil {
+		return
+	}
+	data := conversationData{
+		CustomerID: client.Customer.Id,
+		Source:     client.Customer.Source,
+		Node:       h.nodeID,
+		Reason:     reason,
+	}
+	if client.Conversation != nil {
+		conv := client.UpdateConversation(func(conv *models.Conversation) {
+			if eventType == events.ConversationClosed {
+				conv.Status = "closed"
+			}
+		})
+		data.AssignedTo = conv.AssignedTo
+	}
+	h.Emit(client, eventType, data)
+	if eventType == events.ConversationClosed {
+		h.endWatch(client, reason)
+		h.reviewClosed(client, reason)
+	}
+}
+
+// closeReason tells a conversation ended on purpose from a dropped connection
+func closeReason(client *Client) string {
+	if client.Conversation != nil && client.Snapshot().Status == "closed" {
+		return "closed"
+	}
+	return "disconnected"
+}
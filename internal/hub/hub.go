@@ -1,218 +1,509 @@
 package hub
 
 import (
+	"butter-socket/internal/bus"
+	"butter-socket/internal/events"
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"butter-socket/internal/presence"
+	"butter-socket/internal/store"
 	"butter-socket/models"
 	"context"
-	"fmt"
+	"encoding/json"
+	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // Client represents a connected customer
 type Client struct {
+	ID           string // -> unique per connection
 	Type         string
 	Hub          *Hub
 	Conn         *websocket.Conn
-	Send         chan []byte
+	Send         *SendQueue
 	Customer     *models.Customer
-	User         *models.User
-	Conversation *models.Conversation
-	CancelAI     context.CancelFunc
-	SosFlag      bool // -> true when customer talking to human or need to talk to human
-	FlagRevealed bool // -> when a human accepts connection
+	User         *models.User         // -> the connected user; nil for customers
+	Conversation *models.Conversation // -> Id and CompanyId are fixed, the rest goes through Snapshot and UpdateConversation
+	Remote       bool                 // -> connected to another node, Send is forwarded over the bus
+	Node         string               // -> node holding a remote connection
+
+	// Handoff state of a customer, and its conversation
+	mu                  sync.Mutex
+	agent               *models.User // -> human in charge of the conversation
+	sosFlag             bool         // -> true when customer talking to human or need to talk to human
+	flagRevealed        bool         // -> when a human accepts connection
+	transferRequestedAt time.Time    // -> when the customer asked for a human
+
+	aiMu     sync.Mutex
+	cancelAI context.CancelCauseFunc
 }
 
-// Hub maintains active clients and broadcasts messages
-type Hub struct {
-	// Registered clients
-	clients  map[string]*Client
-	allUsers map[string]*Client
+// Deliver queues a frame for the client under its send policy. It reports
+// false when the frame was lost to a full queue or the client has already
+// left. A client whose disconnect policy trips is closed so it can reconnect.
+func (c *Client) Deliver(msg []byte) bool {
+	switch c.Send.push(msg) {
+	case pushQueued:
+		return true
+	case pushOverflow:
+		c.Logger().Warn("client send queue is full, disconnecting", logging.KeyEvent, "send_overflow", "queued", c.Send.Len())
+		if !c.Remote {
+			go c.Hub.Disconnect(c, "send queue full")
+		}
+	}
+	return false
+}
 
-	//registered companies to departments to users
-	users map[string]map[string][]models.User
+// isClosed reports whether the client has left and no longer takes frames
+func (c *Client) isClosed() bool {
+	return c.Send.Closed()
+}
 
-	// Inbound messages from clients
-	broadcast chan []byte
+// closeSend closes the send queue, ending the write pump once it is drained
+func (c *Client) closeSend() {
+	c.Send.close()
+}
 
-	// Register requests from clients
-	register chan *Client
+// Logger returns a logger carrying the client's connection, company and conversation IDs
+func (c *Client) Logger() *slog.Logger {
+	attrs := []any{
+		logging.KeyConnID, c.ID,
+		logging.KeyClientType, c.Type,
+		logging.KeyCompany, c.CompanyID(),
+	}
+	if c.Customer != nil {
+		attrs = append(attrs, logging.KeyCustomer, c.Customer.Id)
+	}
+	if c.User != nil {
+		attrs = append(attrs, logging.KeyUser, c.User.UserID)
+	} else if agent := c.Agent(); agent != nil {
+		attrs = append(attrs, logging.KeyUser, agent.UserID)
+	}
+	if c.Conversation != nil {
+		attrs = append(attrs, logging.KeyConversation, c.Conversation.Id)
+	}
+	return slog.Default().With(attrs...)
+}
 
-	// Unregister requests from clients
-	unregister chan *Client
+// StopReason says why an AI reply was cut short. It is the cancel cause of
+// the reply's context.
+type StopReason string
 
-	// Mutex for thread-safe operations
-	mu sync.RWMutex
+func (r StopReason) Error() string {
+	return "AI reply stopped: " + string(r)
 }
 
-// NewHub creates a new Hub instanceinstance
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[string]*Client),
-		allUsers:   make(map[string]*Client),
-		users:      make(map[string]map[string][]models.User),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-	}
-}
-
-// Run starts the hub's main loop
-func (h *Hub) Run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			if client.User != nil || client.Type == "user" {
-				h.allUsers[client.User.UserID] = client
-				h.addUser(client.User)
-				fmt.Printf("user client registered. Total clients: %d\n", len(h.allUsers))
-			} else {
-				h.clients[client.Customer.Id] = client
-				fmt.Printf("customer client registered. Total clients: %d\n", len(h.clients))
-			}
-			h.mu.Unlock()
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if client.User != nil || client.Type == "user" {
-				if _, ok := h.allUsers[client.User.UserID]; ok {
-					delete(h.clients, client.User.UserID)
-					h.removeUser(client.User)
-					close(client.Send)
-					fmt.Printf("customer client unregistered. Total clients: %d\n", len(h.clients))
-				}
-			} else {
-				if _, ok := h.clients[client.Customer.Id]; ok {
-					delete(h.clients, client.Customer.Id)
-					close(client.Send)
-					fmt.Printf("customer client unregistered. Total clients: %d\n", len(h.clients))
-				}
-			}
-			h.mu.Unlock()
-
-		case message := <-h.broadcast:
-			h.mu.RLock()
-			for client := range h.clients {
-				select {
-				case h.clients[client].Send <- message:
-				default:
-					close(h.clients[client].Send)
-					delete(h.clients, client)
-				}
-			}
-			h.mu.RUnlock()
-		}
+// Reasons an AI reply stops early
+const (
+	StopSuperseded   StopReason = "superseded"          // -> the customer sent another message
+	StopRequested    StopReason = "stopped"             // -> the customer sent stop_generation
+	StopTakeover     StopReason = "human_takeover"      // -> an agent accepted the chat
+	StopDisconnected StopReason = "disconnected"        // -> the connection went away
+	StopDraining     StopReason = "server_draining"     // -> the server is shutting down
+	StopClosed       StopReason = "conversation_closed" // -> the conversation was closed
+)
+
+// SetCancelAI stores the cancel func of the AI reply in flight, superseding any previous one
+func (c *Client) SetCancelAI(cancel context.CancelCauseFunc) {
+	c.aiMu.Lock()
+	defer c.aiMu.Unlock()
+	if c.cancelAI != nil {
+		c.cancelAI(StopSuperseded)
 	}
+	c.cancelAI = cancel
 }
 
-// RegisterClient adds a client to the hub
-func (h *Hub) RegisterClient(client *Client) {
-	h.register <- client
+// CancelAI stops the AI reply in flight, if any
+func (c *Client) CancelAI(reason StopReason) {
+	c.aiMu.Lock()
+	defer c.aiMu.Unlock()
+	if c.cancelAI != nil {
+		c.cancelAI(reason)
+		c.cancelAI = nil
+	}
 }
 
-// UnregisterClient removes a client from the hub
-func (h *Hub) UnregisterClient(client *Client) {
-	h.unregister <- client
+// CompanyID returns the company the client belongs to
+func (c *Client) CompanyID() string {
+	if c.User != nil {
+		return c.User.CompanyID
+	}
+	if c.Customer != nil {
+		return c.Customer.CompanyId
+	}
+	return ""
 }
 
-// BroadcastMessage sends a message to all connected clients
-func (h *Hub) BroadcastMessage(message []byte) {
-	h.broadcast <- message
+// Agent returns the human in charge of a customer's conversation, if any
+func (c *Client) Agent() *models.User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.agent
 }
 
-// GetClientCount returns the number of connected clients
-func (h *Hub) GetClientCount() int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return len(h.clients)
+// RequestHuman marks a customer as waiting for a human. It reports false
+// when the customer already asked for or is with one.
+func (c *Client) RequestHuman() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sosFlag {
+		return false
+	}
+	c.sosFlag = true
+	c.transferRequestedAt = time.Now()
+	return true
 }
 
-func (h *Hub) GetAllUserCount() int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return len(h.allUsers)
+// Snapshot returns a copy of the customer's conversation that is safe to
+// read, send and store while the conversation carries on
+func (c *Client) Snapshot() models.Conversation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snapshotLocked()
 }
 
-func (h *Hub) GetAllClients() map[string]*Client {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.clients
+// UpdateConversation changes the customer's conversation under its lock and
+// returns a copy of the result. Other nodes hear when it is routed elsewhere.
+func (c *Client) UpdateConversation(update func(conv *models.Conversation)) models.Conversation {
+	c.mu.Lock()
+	assignedTo, departmentID := c.Conversation.AssignedTo, c.Conversation.DepartmentId
+	update(c.Conversation)
+	conv := c.snapshotLocked()
+	c.mu.Unlock()
+
+	if c.Hub != nil && (conv.AssignedTo != assignedTo || conv.DepartmentId != departmentID) {
+		c.Hub.announce(c, true, "")
+	}
+	return conv
 }
 
-func (h *Hub) GetAllUsers() map[string]*Client {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	return h.allUsers
+func (c *Client) snapshotLocked() models.Conversation {
+	conv := *c.Conversation
+	conv.Tags = slices.Clone(conv.Tags)
+	conv.Notes = slices.Clone(conv.Notes)
+	conv.Messages = slices.Clone(conv.Messages)
+	return conv
 }
 
-func (h *Hub) addUser(user *models.User) {
-	companyID := user.CompanyID
+// Hub tracks the clients of every company. Companies are spread over shards
+// with their own locks; a directory answers lookups by ID.
+type Hub struct {
+	shards [shardCount]shard
+	dir    *directory
 
-	// ensure company map exists
-	if h.users[companyID] == nil {
-		h.users[companyID] = make(map[string][]models.User)
-	}
+	// Set once shutdown starts; no new connections are accepted
+	draining atomic.Bool
 
-	// add user to each department
-	for _, d := range user.Departments {
-		deptID := d.DepartmentID
-		h.users[companyID][deptID] =
-			append(h.users[companyID][deptID], *user)
-	}
+	// Running read/write pumps, waited on during shutdown
+	pumps sync.WaitGroup
+
+	// Cross-node routing; nil bus means a single instance
+	bus      bus.Bus
+	nodeID   string
+	outbound chan bus.Envelope
+
+	// Shared record of who is connected where; nil keeps presence to the bus
+	registry    presence.Registry
+	registryOps chan func(context.Context)
+	deadNodes   map[string]bool // -> nodes whose clients were dropped, heartbeat only
+
+	// Conversation persistence and event outbox; nil records nothing
+	store store.Store
+
+	// Summarize and classify conversations on handoff and close; nil skips either
+	summarizer Summarizer
+	classifier Classifier
+
+	// Delivery reports of broadcasts started on this node
+	broadcasts *broadcastLog
+
+	// Supervisors watching conversations
+	watchers *watchList
 }
 
-func (h *Hub) removeUser(user *models.User) {
+// NewHub creates a new Hub instance
+func NewHub() *Hub {
+	h := &Hub{
+		dir:        newDirectory(),
+		outbound:   make(chan bus.Envelope, 1024),
+		broadcasts: newBroadcastLog(),
+		watchers:   newWatchList(),
+	}
+	for i := range h.shards {
+		h.shards[i].companies = make(map[string]*company)
+	}
+	return h
+}
 
-	companyID := user.CompanyID
+func (h *Hub) shardFor(companyID string) *shard {
+	return &h.shards[shardIndex(companyID)]
+}
 
-	depts, ok := h.users[companyID]
-	if !ok {
-		return
+// RegisterClient adds a local client to the hub, replacing an older
+// connection of the same customer or user
+func (h *Hub) RegisterClient(client *Client) {
+	companyID := client.CompanyID()
+	s := h.shardFor(companyID)
+
+	s.mu.Lock()
+	c := s.companyLocked(companyID, true)
+	var old *Client
+	if client.Type == "user" {
+		old = c.users[client.User.UserID]
+		c.users[client.User.UserID] = client
+	} else {
+		old = c.customers[client.Customer.Id]
+		c.customers[client.Customer.Id] = client
 	}
+	if old != nil {
+		for _, key := range old.directoryKeys() {
+			h.dir.delete(key)
+		}
+	}
+	for _, key := range client.directoryKeys() {
+		h.dir.set(key, companyID)
+	}
+	s.mu.Unlock()
 
-	for _, d := range user.Departments {
-		deptID := d.DepartmentID
-		usersInDept := depts[deptID]
+	if old == nil {
+		metrics.ConnectedClients.WithLabelValues(client.Type).Inc()
+	}
+	client.Logger().Info(client.Type+" client registered", logging.KeyEvent, "register", "replaced", old != nil)
+	h.announce(client, true, "")
+	h.recordPresence(client, true)
+	if client.Type != "user" {
+		if old != nil {
+			h.emitConversation(old, events.ConversationClosed, "replaced")
+		}
+		h.emitConversation(client, events.ConversationStarted, "")
+	}
+}
 
-		// remove user from slice
-		for i, u := range usersInDept {
-			if u.UserID == user.UserID {
-				depts[deptID] = append(
-					usersInDept[:i],
-					usersInDept[i+1:]...,
-				)
-				break
+// UnregisterClient removes a local client, unless a newer connection of the
+// same customer or user has replaced it
+func (h *Hub) UnregisterClient(client *Client) {
+	companyID := client.CompanyID()
+	s := h.shardFor(companyID)
+
+	s.mu.Lock()
+	c := s.companyLocked(companyID, false)
+	current := false
+	if c != nil {
+		if client.Type == "user" {
+			current = c.users[client.User.UserID] == client
+			if current {
+				delete(c.users, client.User.UserID)
+			}
+		} else {
+			current = c.customers[client.Customer.Id] == client
+			if current {
+				delete(c.customers, client.Customer.Id)
+			}
+		}
+	}
+	if current {
+		for _, key := range client.directoryKeys() {
+			h.dir.delete(key)
+		}
+		// still reachable through another node
+		if proxy := c.remote(client); proxy != nil {
+			for _, key := range proxy.directoryKeys() {
+				h.dir.set(key, companyID)
 			}
 		}
+		s.pruneLocked(companyID)
+	}
+	s.mu.Unlock()
 
-		// cleanup empty department
-		if len(depts[deptID]) == 0 {
-			delete(depts, deptID)
+	client.CancelAI(StopDisconnected)
+	client.closeSend()
+	if !current {
+		return
+	}
+	metrics.ConnectedClients.WithLabelValues(client.Type).Dec()
+	client.Logger().Info(client.Type+" client unregistered", logging.KeyEvent, "unregister")
+	h.announce(client, false, "")
+	h.recordPresence(client, false)
+	if client.Type == "user" {
+		h.watchers.forgetWatcher(client)
+	} else {
+		h.emitConversation(client, events.ConversationClosed, closeReason(client))
+	}
+}
+
+// GetClientCount returns the number of local customers
+func (h *Hub) GetClientCount() int {
+	return len(h.GetAllClients())
+}
+
+// GetAllUserCount returns the number of local users
+func (h *Hub) GetAllUserCount() int {
+	return len(h.GetAllUsers())
+}
+
+// GetAllClients returns a snapshot of local customers by customer ID
+func (h *Hub) GetAllClients() map[string]*Client {
+	out := make(map[string]*Client)
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for _, c := range s.companies {
+			for id, cl := range c.customers {
+				out[id] = cl
+			}
 		}
+		s.mu.RUnlock()
 	}
+	return out
+}
 
-	// cleanup empty company
-	if len(depts) == 0 {
-		delete(h.users, companyID)
+// GetAllUsers returns a snapshot of local users by user ID
+func (h *Hub) GetAllUsers() map[string]*Client {
+	out := make(map[string]*Client)
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for _, c := range s.companies {
+			for id, cl := range c.users {
+				out[id] = cl
+			}
+		}
+		s.mu.RUnlock()
 	}
+	return out
 }
 
+// GetAllUserConnByCompanyId lists the users of a company who belong to at
+// least one department, on this and other nodes
 func (h *Hub) GetAllUserConnByCompanyId(companyId string) []*Client {
-	departments := h.users[companyId]
-	var userIdList []string
-	for _, department := range departments {
-		for _, user := range department {
-			userIdList = append(userIdList, user.UserID)
-		}
+	h.remoteUsersOf(companyId)
+
+	s := h.shardFor(companyId)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := s.companyLocked(companyId, false)
+	if c == nil {
+		return nil
 	}
 	var connList []*Client
-	for _, u := range userIdList {
-		connList = append(connList, h.allUsers[u])
+	for _, conn := range c.users {
+		if len(conn.User.Departments) > 0 {
+			connList = append(connList, conn)
+		}
+	}
+	for id, conn := range c.remoteUsers {
+		// a user connected here too is reached through the local connection
+		if c.users[id] == nil && len(conn.User.Departments) > 0 {
+			connList = append(connList, conn)
+		}
 	}
 	return connList
 }
 
+// GetUserConnByUserId finds a user connected to this or another node
 func (h *Hub) GetUserConnByUserId(userId string) *Client {
-	return h.allUsers[userId]
+	if conn := h.find(dirUser+userId, func(c *company) *Client { return c.user(userId) }); conn != nil {
+		return conn
+	}
+	return h.lookupRemote("user", userId)
+}
+
+// GetCustomerConn finds a customer connected to this or another node
+func (h *Hub) GetCustomerConn(customerId string) *Client {
+	if conn := h.find(dirCustomer+customerId, func(c *company) *Client { return c.customer(customerId) }); conn != nil {
+		return conn
+	}
+	return h.lookupRemote("customer", customerId)
+}
+
+// find resolves a directory key to its company and picks a client there
+func (h *Hub) find(key string, pick func(*company) *Client) *Client {
+	companyID, ok := h.dir.get(key)
+	if !ok {
+		return nil
+	}
+	s := h.shardFor(companyID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c := s.companyLocked(companyID, false); c != nil {
+		return pick(c)
+	}
+	return nil
+}
+
+// localClients snapshots local clients matching keep; nil keeps all
+func (h *Hub) localClients(keep func(*Client) bool) []*Client {
+	var out []*Client
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for _, c := range s.companies {
+			for _, m := range []map[string]*Client{c.customers, c.users} {
+				for _, cl := range m {
+					if keep == nil || keep(cl) {
+						out = append(out, cl)
+					}
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return out
+}
+
+// companyClients snapshots the local clients of one company
+func (h *Hub) companyClients(companyID string) []*Client {
+	s := h.shardFor(companyID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := s.companyLocked(companyID, false)
+	if c == nil {
+		return nil
+	}
+	out := make([]*Client, 0, len(c.customers)+len(c.users))
+	for _, m := range []map[string]*Client{c.customers, c.users} {
+		for _, cl := range m {
+			out = append(out, cl)
+		}
+	}
+	return out
+}
+
+// AssignAgent puts a human in charge of a customer's conversation, on
+// whichever node the customer is connected. It returns the agent who had the
+// conversation before, if any.
+func (h *Hub) AssignAgent(customer *Client, user *models.User) *models.User {
+	customer.mu.Lock()
+	previous := customer.agent
+	customer.agent = user
+	customer.Conversation.AssignedTo = user.UserID
+	if customer.Remote {
+		// the proxy remembers it too, so this node can authorize the agent
+		customer.mu.Unlock()
+		payload, _ := json.Marshal(user)
+		h.publish(bus.Envelope{
+			Kind:       kindAssign,
+			Target:     customer.Node,
+			ClientType: "customer",
+			ClientID:   customer.Customer.Id,
+			Payload:    payload,
+		})
+		return previous
+	}
+	customer.sosFlag = true
+	customer.flagRevealed = true
+	if !customer.transferRequestedAt.IsZero() {
+		metrics.TransferWaitSeconds.Observe(time.Since(customer.transferRequestedAt).Seconds())
+		customer.transferRequestedAt = time.Time{}
+	}
+	customer.mu.Unlock()
+
+	customer.CancelAI(StopTakeover)
+	h.announce(customer, true, "")
+	return previous
 }
@@ -0,0 +1,325 @@
+package hub
+
+import (
+	"butter-socket/internal/metrics"
+	"butter-socket/internal/store"
+	"butter-socket/models"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var (
+	benchConns     = flag.Int("hub.conns", 50000, "connections the hub benchmarks hold open")
+	benchCompanies = flag.Int("hub.companies", 500, "companies the benchmark connections are spread over")
+	benchAgents    = flag.Float64("hub.agents", 0.1, "fraction of benchmark connections that are agents")
+	benchPolicy    = flag.String("hub.policy", PolicyDropNonCritical, "send policy of every benchmark client, e.g. drop_oldest or block:1s")
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// the hub logs every register; keep test output readable
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+func testCustomer(h *Hub, id, companyID string) *Client {
+	customer := &models.Customer{Id: id, CompanyId: companyID}
+	return &Client{
+		ID:           "conn-" + id,
+		Type:         "customer",
+		Hub:          h,
+		Send:         NewSendQueue(256, SendPolicy{Mode: PolicyDropNonCritical}),
+		Customer:     customer,
+		Conversation: &models.Conversation{Id: "conversation-" + id, CompanyId: companyID, Customer: customer},
+	}
+}
+
+func testAgent(h *Hub, id, companyID string) *Client {
+	return &Client{
+		ID:   "conn-" + id,
+		Type: "user",
+		Hub:  h,
+		Send: NewSendQueue(256, SendPolicy{Mode: PolicyDropNonCritical}),
+		User: &models.User{
+			UserID:      id,
+			CompanyID:   companyID,
+			Departments: []models.Department{{DepartmentID: "support"}},
+		},
+	}
+}
+
+type fixedClassifier struct{}
+
+func (fixedClassifier) Classify(ctx context.Context, conv models.Conversation) (*models.Classification, error) {
+	return &models.Classification{Intent: "refund", Topic: "billing", DepartmentID: "billing"}, nil
+}
+
+type fixedSummarizer struct{}
+
+func (fixedSummarizer) Summarize(ctx context.Context, conv models.Conversation) (string, error) {
+	return "wants a refund", nil
+}
+
+// TestHandoffRace runs a transfer, agents accepting, classification,
+// summaries and notes on one conversation at once. Run with -race.
+func TestHandoffRace(t *testing.T) {
+	h := NewHub()
+	h.UseStore(store.NewMemory())
+	h.UseClassifier(fixedClassifier{})
+	h.UseSummaries(fixedSummarizer{})
+	customer := testCustomer(h, "cust-1", "acme")
+	h.RegisterClient(customer)
+	agents := []*Client{testAgent(h, "agent-1", "acme"), testAgent(h, "agent-2", "acme")}
+	for _, a := range agents {
+		h.RegisterClient(a)
+	}
+
+	ctx := context.Background()
+	ops := []func(){
+		func() { customer.RequestHuman() },
+		func() {
+			offer := customer.Snapshot()
+			if offer.DepartmentId != "" {
+				customer.UpdateConversation(func(conv *models.Conversation) { conv.DepartmentId = "" })
+			}
+		},
+		func() { h.AssignAgent(customer, agents[0].User) },
+		func() { h.AssignAgent(customer, agents[1].User) },
+		func() { h.Classify(ctx, customer, StageHandoff) },
+		func() { h.Summarize(ctx, customer, StageHandoff) },
+		func() { h.AddNote(customer, models.MsgInOut{SenderId: "agent-1", Content: "called back"}) },
+		func() { h.Sessions("acme", "") },
+		func() { customer.Logger() },
+	}
+	var wg sync.WaitGroup
+	for _, op := range ops {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				op()
+			}()
+		}
+	}
+	wg.Wait()
+
+	conv := customer.Snapshot()
+	if customer.Status() != StatusWithAgent || conv.AssignedTo != customer.Agent().UserID {
+		t.Errorf("status %s, assigned to %q, agent %+v", customer.Status(), conv.AssignedTo, customer.Agent())
+	}
+	if conv.Summary == "" || conv.Classification == nil || len(conv.Notes) != 20 {
+		t.Errorf("conversation lost updates: summary %q, classification %v, %d notes", conv.Summary, conv.Classification, len(conv.Notes))
+	}
+}
+
+// benchHub holds *benchConns registered clients whose Send queues are drained
+// the way a write pump would
+type benchHub struct {
+	hub    *Hub
+	policy SendPolicy
+
+	customerIDs     []string
+	userIDs         []string
+	conversationIDs []string
+}
+
+var (
+	benchOnce  sync.Once
+	benchState *benchHub
+)
+
+// sharedBench builds the benchmark hub once for every lookup benchmark
+func sharedBench(b *testing.B) *benchHub {
+	benchOnce.Do(func() {
+		policy, err := ParseSendPolicy(*benchPolicy)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bh := &benchHub{hub: NewHub(), policy: policy}
+		fanOut(bh.clients(*benchConns, policy), func(c *Client) {
+			bh.hub.RegisterClient(c)
+			go drain(c)
+		})
+		benchState = bh
+	})
+	if benchState == nil {
+		b.Fatal("benchmark hub failed to build")
+	}
+	return benchState
+}
+
+func (bh *benchHub) clients(n int, policy SendPolicy) []*Client {
+	out := make([]*Client, 0, n)
+	for i := 0; i < n; i++ {
+		companyID := benchCompany(i % *benchCompanies)
+		id := strconv.Itoa(i)
+		var c *Client
+		if float64(i%100) < *benchAgents*100 {
+			c = testAgent(bh.hub, "user-"+id, companyID)
+			bh.userIDs = append(bh.userIDs, c.User.UserID)
+		} else {
+			c = testCustomer(bh.hub, "customer-"+id, companyID)
+			bh.customerIDs = append(bh.customerIDs, c.Customer.Id)
+			bh.conversationIDs = append(bh.conversationIDs, c.Conversation.Id)
+		}
+		c.Send = NewSendQueue(256, policy)
+		out = append(out, c)
+	}
+	return out
+}
+
+func benchCompany(i int) string {
+	return "company-" + strconv.Itoa(i)
+}
+
+func drain(c *Client) {
+	for range c.Send.Ready() {
+		if _, ok := c.Send.Take(); !ok {
+			return
+		}
+	}
+}
+
+// fanOut calls fn for every client from GOMAXPROCS goroutines
+func fanOut(clients []*Client, fn func(*Client)) {
+	workers := runtime.GOMAXPROCS(0)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(clients); i += workers {
+				fn(clients[i])
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// parallel runs op from every P, each with its own random source
+func parallel(b *testing.B, op func(r *rand.Rand)) {
+	var seed atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewPCG(seed.Add(1), 0))
+		for pb.Next() {
+			op(r)
+		}
+	})
+}
+
+func BenchmarkRegister(b *testing.B) {
+	policy, err := ParseSendPolicy(*benchPolicy)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bh := &benchHub{hub: NewHub()}
+	clients := bh.clients(b.N, policy)
+	b.ResetTimer()
+	fanOut(clients, bh.hub.RegisterClient)
+	b.StopTimer()
+	fanOut(clients, bh.hub.UnregisterClient)
+	if n := bh.hub.GetClientCount() + bh.hub.GetAllUserCount(); n != 0 {
+		b.Errorf("%d clients left registered", n)
+	}
+}
+
+func BenchmarkGetCustomerConn(b *testing.B) {
+	bh := sharedBench(b)
+	parallel(b, func(r *rand.Rand) {
+		bh.hub.GetCustomerConn(bh.customerIDs[r.IntN(len(bh.customerIDs))])
+	})
+}
+
+func BenchmarkGetUserConnByUserId(b *testing.B) {
+	bh := sharedBench(b)
+	parallel(b, func(r *rand.Rand) {
+		bh.hub.GetUserConnByUserId(bh.userIDs[r.IntN(len(bh.userIDs))])
+	})
+}
+
+func BenchmarkGetAllUserConnByCompanyId(b *testing.B) {
+	bh := sharedBench(b)
+	parallel(b, func(r *rand.Rand) {
+		bh.hub.GetAllUserConnByCompanyId(benchCompany(r.IntN(*benchCompanies)))
+	})
+}
+
+func BenchmarkGetClientByConversationId(b *testing.B) {
+	bh := sharedBench(b)
+	parallel(b, func(r *rand.Rand) {
+		bh.hub.GetClientByConversationId(bh.conversationIDs[r.IntN(len(bh.conversationIDs))])
+	})
+}
+
+// BenchmarkLookupDuringChurn measures customer lookups while other goroutines
+// keep connecting and disconnecting customers, as happens during a busy hour
+func BenchmarkLookupDuringChurn(b *testing.B) {
+	bh := sharedBench(b)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, runtime.GOMAXPROCS(0)/4); w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c := testCustomer(bh.hub, fmt.Sprintf("churn-%d-%d", w, i), benchCompany(i%*benchCompanies))
+				c.Send = NewSendQueue(1, bh.policy)
+				bh.hub.RegisterClient(c)
+				bh.hub.UnregisterClient(c)
+			}
+		}(w)
+	}
+
+	parallel(b, func(r *rand.Rand) {
+		bh.hub.GetCustomerConn(bh.customerIDs[r.IntN(len(bh.customerIDs))])
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkBroadcastCompany(b *testing.B) {
+	bh := sharedBench(b)
+	parallel(b, func(r *rand.Rand) {
+		bh.hub.Broadcast(Scope{CompanyID: benchCompany(r.IntN(*benchCompanies))}, []byte(`{"type":"broadcast"}`), "bench")
+	})
+}
+
+func TestCompanyConnections(t *testing.T) {
+	h := NewHub()
+	for _, c := range []*Client{
+		testAgent(h, "agent-1", "acme"),
+		testCustomer(h, "cust-1", "acme"),
+		testCustomer(h, "cust-2", "acme"),
+		testCustomer(h, "cust-3", "made-up"),
+		testCustomer(h, "cust-4", "also-made-up"),
+	} {
+		h.RegisterClient(c)
+	}
+
+	got := h.CompanyConnections()
+	want := []metrics.CompanyConnections{
+		{CompanyID: "acme", Customers: 2, Users: 1},
+		{CompanyID: otherCompanies, Customers: 2},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("CompanyConnections = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package hub
+
+import (
+	"butter-socket/internal/metrics"
+	"butter-socket/internal/presence"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// registryTimeout bounds a single presence registry call
+const registryTimeout = 5 * time.Second
+
+// UsePresence records local connections in r and heartbeats this node every
+// interval. Remote clients of nodes that stop heartbeating are dropped.
+// Call after UseBus and before clients register.
+func (h *Hub) UsePresence(r presence.Registry, interval time.Duration) {
+	h.registry = r
+	h.registryOps = make(chan func(context.Context), 1024)
+
+	// registry writes run in order on their own goroutine, off the hub loop
+	go func() {
+		for op := range h.registryOps {
+			ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+			op(ctx)
+			cancel()
+		}
+	}()
+
+	h.heartbeat()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.heartbeat()
+		}
+	}()
+}
+
+// heartbeat keeps this node alive, expires dead nodes and forgets their clients
+func (h *Hub) heartbeat() {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+
+	if err := h.registry.Heartbeat(ctx, h.nodeID); err != nil {
+		slog.Error("presence heartbeat failed", "node", h.nodeID, "error", err)
+		return
+	}
+	if removed, err := h.registry.Expire(ctx); err != nil {
+		slog.Error("presence expiry failed", "error", err)
+	} else if removed > 0 {
+		slog.Warn("expired connections of dead nodes", "removed", removed)
+	}
+
+	nodes, err := h.registry.Nodes(ctx)
+	if err != nil {
+		slog.Error("presence node listing failed", "error", err)
+		return
+	}
+	// each dead node is dropped once; the registry forgets it in time
+	dead := make(map[string]bool)
+	for _, n := range nodes {
+		if n.Alive || n.ID == h.nodeID {
+			continue
+		}
+		dead[n.ID] = true
+		if !h.deadNodes[n.ID] {
+			h.dropNode(n.ID)
+		}
+	}
+	h.deadNodes = dead
+}
+
+// recordPresence writes a local connection change to the registry
+func (h *Hub) recordPresence(client *Client, online bool) {
+	if h.registry == nil || client.Remote {
+		return
+	}
+	entry := presence.Entry{
+		ConnID:     client.ID,
+		Node:       h.nodeID,
+		ClientType: client.Type,
+		ClientID:   client.remoteKey(),
+		CompanyID:  client.CompanyID(),
+	}
+	if client.Type == "user" {
+		entry.User = client.User
+	} else {
+		entry.Customer = client.Customer
+	}
+	if client.Conversation != nil {
+		entry.ConversationID = client.Conversation.Id
+	}
+
+	op := func(ctx context.Context) {
+		var err error
+		if online {
+			err = h.registry.Register(ctx, entry)
+		} else {
+			err = h.registry.Unregister(ctx, entry)
+		}
+		if err != nil {
+			client.Logger().Error("presence update failed", "online", online, "error", err)
+		}
+	}
+	// a registry that falls behind loses updates rather than stalling connections
+	select {
+	case h.registryOps <- op:
+	default:
+		metrics.PresenceDropped.Inc()
+		client.Logger().Warn("presence queue full, dropping update", "online", online, "queued", len(h.registryOps))
+	}
+}
+
+// lookupRemote asks the registry for a client this node has not heard of
+// over the bus and files a proxy for it
+func (h *Hub) lookupRemote(clientType, clientID string) *Client {
+	if h.registry == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+
+	entry, ok, err := h.registry.Lookup(ctx, clientType, clientID)
+	if err != nil {
+		slog.Error("presence lookup failed", "client_type", clientType, "client_id", clientID, "error", err)
+		return nil
+	}
+	if !ok || entry.Node == h.nodeID {
+		return nil
+	}
+	return h.addRemote(entry.Node, entryAnnouncement(entry))
+}
+
+// remoteUsersOf files proxies for every user of a company connected elsewhere
+func (h *Hub) remoteUsersOf(companyID string) {
+	if h.registry == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+
+	entries, err := h.registry.List(ctx, companyID, "user")
+	if err != nil {
+		slog.Error("presence listing failed", "company_id", companyID, "error", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.Node != h.nodeID {
+			h.addRemote(entry.Node, entryAnnouncement(entry))
+		}
+	}
+}
+
+// dropNode forgets every remote client held by a dead node
+func (h *Hub) dropNode(node string) {
+	var dropped []*Client
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.Lock()
+		for companyID, c := range s.companies {
+			for _, proxies := range []map[string]*Client{c.remoteUsers, c.remoteCustomers} {
+				for id, proxy := range proxies {
+					if proxy.Node == node {
+						delete(proxies, id)
+						h.forgetRemoteLocked(c, proxy)
+						dropped = append(dropped, proxy)
+					}
+				}
+			}
+			s.pruneLocked(companyID)
+		}
+		s.mu.Unlock()
+	}
+
+	for _, proxy := range dropped {
+		proxy.closeSend()
+	}
+	if len(dropped) > 0 {
+		slog.Warn("dropped clients of dead node", "node", node, "dropped", len(dropped))
+	}
+}
+
+func entryAnnouncement(e presence.Entry) announcement {
+	return announcement{
+		ConnID:         e.ConnID,
+		Type:           e.ClientType,
+		Online:         true,
+		Customer:       e.Customer,
+		User:           e.User,
+		ConversationID: e.ConversationID,
+	}
+}
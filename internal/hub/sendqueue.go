@@ -0,0 +1,337 @@
+package hub
+
+import (
+	"butter-socket/internal/metrics"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Send policies, applied when a client's queue has no room for a frame
+const (
+	PolicyBlock           = "block"             // -> wait up to Timeout for room, then drop the frame
+	PolicyDropOldest      = "drop_oldest"       // -> evict the oldest frame of the lane
+	PolicyDropNonCritical = "drop_non_critical" // -> evict non-critical frames first, critical ones last
+	PolicyDisconnect      = "disconnect"        // -> close the connection; the client reconnects and resyncs
+)
+
+// defaultBlockTimeout is how long the block policy waits when no timeout is given
+const defaultBlockTimeout = time.Second
+
+// nonCritical frame types may be lost without the conversation going wrong;
+// a later frame of the same type supersedes them
+var nonCritical = map[string]bool{
+	"message_chunk": true,
+	"typing":        true,
+	"typing_start":  true,
+	"typing_end":    true,
+	"pong":          true,
+}
+
+// Lanes split a queue so floods of non-critical frames can't crowd out the rest
+const (
+	laneCritical = iota
+	laneBulk
+)
+
+// SendPolicy decides what happens to a frame when a client's queue is full
+type SendPolicy struct {
+	Mode    string        // -> one of the Policy constants; empty means drop_non_critical
+	Timeout time.Duration // -> block only
+}
+
+// ParseSendPolicy reads a policy such as "drop_oldest" or "block:2s"
+func ParseSendPolicy(s string) (SendPolicy, error) {
+	mode, timeout, hasTimeout := strings.Cut(s, ":")
+	p := SendPolicy{Mode: mode}
+	switch mode {
+	case "":
+		p.Mode = PolicyDropNonCritical
+	case PolicyBlock, PolicyDropOldest, PolicyDropNonCritical, PolicyDisconnect:
+	default:
+		return SendPolicy{}, fmt.Errorf("unknown send policy %q", mode)
+	}
+	if hasTimeout {
+		if mode != PolicyBlock {
+			return SendPolicy{}, fmt.Errorf("send policy %q takes no timeout", mode)
+		}
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return SendPolicy{}, fmt.Errorf("bad block timeout %q", timeout)
+		}
+		p.Timeout = d
+	}
+	return p, nil
+}
+
+// push outcomes
+const (
+	pushQueued   = iota
+	pushDropped  // -> the frame was lost
+	pushOverflow // -> the disconnect policy tripped
+)
+
+type frame struct {
+	seq  uint64
+	kind string
+	data []byte
+}
+
+// SendQueue holds a client's outbound frames until its write pump takes them.
+// Critical frames may fill the whole queue; non-critical ones only three
+// quarters of it, so a chunk flood always leaves room for a message.
+type SendQueue struct {
+	mu         sync.Mutex
+	policy     SendPolicy
+	size       int // -> frames across both lanes
+	bulkLimit  int // -> non-critical frames
+	lanes      [2][]frame
+	seq        uint64
+	ready      chan struct{} // -> signalled when frames are queued, closed with the queue
+	space      chan struct{} // -> closed and replaced whenever Take frees room
+	closed     bool
+	overflowed bool // -> the disconnect policy has tripped once
+}
+
+// NewSendQueue creates a queue for size frames
+func NewSendQueue(size int, policy SendPolicy) *SendQueue {
+	if policy.Mode == "" {
+		policy.Mode = PolicyDropNonCritical
+	}
+	if policy.Mode == PolicyBlock && policy.Timeout <= 0 {
+		policy.Timeout = defaultBlockTimeout
+	}
+	return &SendQueue{
+		policy:    policy,
+		size:      size,
+		bulkLimit: max(1, size-size/4),
+		ready:     make(chan struct{}, 1),
+		space:     make(chan struct{}),
+	}
+}
+
+// Policy returns the queue's send policy
+func (q *SendQueue) Policy() SendPolicy {
+	return q.policy
+}
+
+// Ready is signalled when frames are waiting and closed once the queue closes
+func (q *SendQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Take removes every queued frame, in the order they were pushed. It reports
+// false once the queue is closed and empty.
+func (q *SendQueue) Take() ([][]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	critical, bulk := q.lanes[laneCritical], q.lanes[laneBulk]
+	if len(critical)+len(bulk) == 0 {
+		return nil, !q.closed
+	}
+
+	out := make([][]byte, 0, len(critical)+len(bulk))
+	for len(critical) > 0 || len(bulk) > 0 {
+		if len(bulk) == 0 || (len(critical) > 0 && critical[0].seq < bulk[0].seq) {
+			out = append(out, critical[0].data)
+			critical = critical[1:]
+		} else {
+			out = append(out, bulk[0].data)
+			bulk = bulk[1:]
+		}
+	}
+	q.lanes[laneCritical] = q.lanes[laneCritical][:0]
+	q.lanes[laneBulk] = q.lanes[laneBulk][:0]
+
+	if !q.closed {
+		close(q.space)
+		q.space = make(chan struct{})
+	}
+	return out, true
+}
+
+// Len returns the number of queued frames
+func (q *SendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.lanes[laneCritical]) + len(q.lanes[laneBulk])
+}
+
+// Closed reports whether the queue no longer takes frames
+func (q *SendQueue) Closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// close stops the queue; frames already queued can still be taken
+func (q *SendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.ready)
+	close(q.space)
+}
+
+// push queues a frame, applying the policy when there is no room
+func (q *SendQueue) push(data []byte) int {
+	f := frame{kind: frameType(data), data: data}
+	lane := laneOf(f.kind)
+
+	var deadline *time.Timer
+	defer func() {
+		if deadline != nil {
+			deadline.Stop()
+		}
+	}()
+
+	q.mu.Lock()
+	for {
+		if q.closed {
+			q.mu.Unlock()
+			return pushDropped
+		}
+		if q.fits(lane) {
+			q.appendLocked(lane, f)
+			q.mu.Unlock()
+			return pushQueued
+		}
+
+		switch q.policy.Mode {
+		case PolicyBlock:
+			if deadline == nil {
+				deadline = time.NewTimer(q.policy.Timeout)
+				q.record("blocked", "")
+			}
+			space := q.space
+			q.mu.Unlock()
+			select {
+			case <-space:
+				q.mu.Lock()
+				continue
+			case <-deadline.C:
+				q.record("timed_out", f.kind)
+				return pushDropped
+			}
+
+		case PolicyDropOldest, PolicyDropNonCritical:
+			action := "evicted_oldest"
+			if q.policy.Mode == PolicyDropNonCritical {
+				action = "evicted_non_critical"
+			}
+			switch {
+			case lane == laneBulk && len(q.lanes[laneBulk]) == 0:
+				// never evict a critical frame to make room for a non-critical one
+				q.mu.Unlock()
+				q.record("rejected", f.kind)
+				return pushDropped
+			case lane == laneBulk:
+				q.evictLocked(laneBulk, action)
+			case q.policy.Mode == PolicyDropNonCritical && len(q.lanes[laneBulk]) > 0:
+				q.evictLocked(laneBulk, action)
+			case q.oldestIs(laneBulk):
+				q.evictLocked(laneBulk, action)
+			default:
+				q.evictLocked(laneCritical, "evicted_oldest")
+			}
+
+		case PolicyDisconnect:
+			// losing a typing indicator is never worth a reconnect
+			if lane == laneBulk {
+				q.mu.Unlock()
+				q.record("rejected", f.kind)
+				return pushDropped
+			}
+			first := !q.overflowed
+			q.overflowed = true
+			q.mu.Unlock()
+			if !first {
+				q.record("rejected", f.kind)
+				return pushDropped
+			}
+			q.record("disconnected", f.kind)
+			return pushOverflow
+		}
+	}
+}
+
+// offer queues a frame only when it fits. Whatever the policy it never
+// waits, evicts or trips a disconnect, so callers that retry on their own,
+// such as broadcasts, cost the client nothing else.
+func (q *SendQueue) offer(data []byte) bool {
+	f := frame{kind: frameType(data), data: data}
+	lane := laneOf(f.kind)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || !q.fits(lane) {
+		return false
+	}
+	q.appendLocked(lane, f)
+	return true
+}
+
+func laneOf(kind string) int {
+	if nonCritical[kind] {
+		return laneBulk
+	}
+	return laneCritical
+}
+
+// fits reports whether a frame of the lane has room; callers hold mu
+func (q *SendQueue) fits(lane int) bool {
+	total := len(q.lanes[laneCritical]) + len(q.lanes[laneBulk])
+	if lane == laneBulk {
+		return total < q.size && len(q.lanes[laneBulk]) < q.bulkLimit
+	}
+	return total < q.size
+}
+
+// oldestIs reports whether the oldest queued frame sits in lane; callers hold mu
+func (q *SendQueue) oldestIs(lane int) bool {
+	other := q.lanes[1-lane]
+	return len(q.lanes[lane]) > 0 && (len(other) == 0 || q.lanes[lane][0].seq < other[0].seq)
+}
+
+// appendLocked queues a frame and wakes the write pump; callers hold mu
+func (q *SendQueue) appendLocked(lane int, f frame) {
+	q.seq++
+	f.seq = q.seq
+	q.lanes[lane] = append(q.lanes[lane], f)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// evictLocked drops the oldest frame of a lane; callers hold mu
+func (q *SendQueue) evictLocked(lane int, action string) {
+	victim := q.lanes[lane][0]
+	q.lanes[lane] = q.lanes[lane][1:]
+	q.record(action, victim.kind)
+}
+
+// record counts a policy action and the frame it cost, if any
+func (q *SendQueue) record(action, lostType string) {
+	metrics.SendQueueActions.WithLabelValues(q.policy.Mode, action).Inc()
+	if lostType != "" {
+		metrics.DroppedMessages.WithLabelValues(lostType).Inc()
+	}
+}
+
+// frameType reads the type of a WSMessage frame without decoding it; every
+// frame the server sends starts with its type
+func frameType(data []byte) string {
+	rest, ok := bytes.CutPrefix(data, []byte(`{"type":"`))
+	if !ok {
+		return ""
+	}
+	if i := bytes.IndexByte(rest, '"'); i >= 0 {
+		return string(rest[:i])
+	}
+	return ""
+}
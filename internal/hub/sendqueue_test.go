@@ -0,0 +1,163 @@
+package hub
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func wsFrame(kind, id string) []byte {
+	return []byte(`{"type":"` + kind + `","payload":"` + id + `"}`)
+}
+
+// taken lists the payload IDs of the queued frames, in order
+func taken(q *SendQueue) string {
+	frames, _ := q.Take()
+	ids := make([]string, 0, len(frames))
+	for _, f := range frames {
+		var msg struct{ Payload string }
+		json.Unmarshal(f, &msg)
+		ids = append(ids, msg.Payload)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SendPolicy
+		pushes [][]byte
+		last   int // -> outcome of the last push
+		want   string
+	}{
+		{
+			name:   "fits",
+			policy: SendPolicy{Mode: PolicyDropOldest},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message_chunk", "c1")},
+			last:   pushQueued,
+			want:   "m1 c1",
+		},
+		{
+			name:   "drop oldest evicts the oldest frame",
+			policy: SendPolicy{Mode: PolicyDropOldest},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message", "m2"), wsFrame("message", "m3"), wsFrame("message", "m4"), wsFrame("message", "m5")},
+			last:   pushQueued,
+			want:   "m2 m3 m4 m5",
+		},
+		{
+			name:   "drop non-critical evicts chunks before messages",
+			policy: SendPolicy{Mode: PolicyDropNonCritical},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message_chunk", "c1"), wsFrame("message", "m2"), wsFrame("message", "m3"), wsFrame("message", "m4")},
+			last:   pushQueued,
+			want:   "m1 m2 m3 m4",
+		},
+		{
+			name:   "chunks never evict messages",
+			policy: SendPolicy{Mode: PolicyDropNonCritical},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message", "m2"), wsFrame("message", "m3"), wsFrame("message", "m4"), wsFrame("message_chunk", "c1")},
+			last:   pushDropped,
+			want:   "m1 m2 m3 m4",
+		},
+		{
+			name:   "chunks only fill three quarters",
+			policy: SendPolicy{Mode: PolicyDropOldest},
+			pushes: [][]byte{wsFrame("typing", "t1"), wsFrame("typing", "t2"), wsFrame("typing", "t3"), wsFrame("typing", "t4")},
+			last:   pushQueued,
+			want:   "t2 t3 t4",
+		},
+		{
+			name:   "block times out and drops",
+			policy: SendPolicy{Mode: PolicyBlock, Timeout: 10 * time.Millisecond},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message", "m2"), wsFrame("message", "m3"), wsFrame("message", "m4"), wsFrame("message", "m5")},
+			last:   pushDropped,
+			want:   "m1 m2 m3 m4",
+		},
+		{
+			name:   "disconnect trips on a full queue",
+			policy: SendPolicy{Mode: PolicyDisconnect},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message", "m2"), wsFrame("message", "m3"), wsFrame("message", "m4"), wsFrame("message", "m5")},
+			last:   pushOverflow,
+			want:   "m1 m2 m3 m4",
+		},
+		{
+			name:   "disconnect trips once",
+			policy: SendPolicy{Mode: PolicyDisconnect},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message", "m2"), wsFrame("message", "m3"), wsFrame("message", "m4"), wsFrame("message", "m5"), wsFrame("message", "m6")},
+			last:   pushDropped,
+			want:   "m1 m2 m3 m4",
+		},
+		{
+			name:   "disconnect ignores lost chunks",
+			policy: SendPolicy{Mode: PolicyDisconnect},
+			pushes: [][]byte{wsFrame("message", "m1"), wsFrame("message", "m2"), wsFrame("message", "m3"), wsFrame("message", "m4"), wsFrame("message_chunk", "c1")},
+			last:   pushDropped,
+			want:   "m1 m2 m3 m4",
+		},
+	}
+	for _, tt := range tests {
+		q := NewSendQueue(4, tt.policy)
+		var last int
+		for _, f := range tt.pushes {
+			last = q.push(f)
+		}
+		if last != tt.last {
+			t.Errorf("%s: last push = %d, want %d", tt.name, last, tt.last)
+		}
+		if got := taken(q); got != tt.want {
+			t.Errorf("%s: queue = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendQueueBlockWaitsForRoom(t *testing.T) {
+	q := NewSendQueue(1, SendPolicy{Mode: PolicyBlock, Timeout: time.Second})
+	q.push(wsFrame("message", "m1"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Take()
+	}()
+	if got := q.push(wsFrame("message", "m2")); got != pushQueued {
+		t.Fatalf("push = %d, want it queued once room frees", got)
+	}
+	if got := taken(q); got != "m2" {
+		t.Errorf("queue = %q, want m2", got)
+	}
+}
+
+func TestSendQueueClosed(t *testing.T) {
+	q := NewSendQueue(4, SendPolicy{})
+	q.push(wsFrame("message", "m1"))
+	q.close()
+	if got := q.push(wsFrame("message", "m2")); got != pushDropped {
+		t.Errorf("push after close = %d, want dropped", got)
+	}
+	if got := taken(q); got != "m1" {
+		t.Errorf("queue = %q, want m1 still taken after close", got)
+	}
+	if _, ok := q.Take(); ok {
+		t.Error("Take reported more frames from a closed, empty queue")
+	}
+}
+
+func TestParseSendPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SendPolicy
+		wantErr bool
+	}{
+		{"", SendPolicy{Mode: PolicyDropNonCritical}, false},
+		{"drop_oldest", SendPolicy{Mode: PolicyDropOldest}, false},
+		{"block:2s", SendPolicy{Mode: PolicyBlock, Timeout: 2 * time.Second}, false},
+		{"block", SendPolicy{Mode: PolicyBlock}, false},
+		{"block:0s", SendPolicy{}, true},
+		{"disconnect:1s", SendPolicy{}, true},
+		{"shout", SendPolicy{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSendPolicy(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSendPolicy(%q) = %+v, %v", tt.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// shardCount spreads companies over independently locked shards, so traffic
+// of one company never waits on another's lock
+const shardCount = 64
+
+// company holds the connections of one company
+type company struct {
+	customers       map[string]*Client // -> local, by customer ID
+	users           map[string]*Client // -> local, by user ID
+	remoteCustomers map[string]*Client // -> proxies for other nodes, by customer ID
+	remoteUsers     map[string]*Client // -> proxies for other nodes, by user ID
+}
+
+func newCompany() *company {
+	return &company{
+		customers:       make(map[string]*Client),
+		users:           make(map[string]*Client),
+		remoteCustomers: make(map[string]*Client),
+		remoteUsers:     make(map[string]*Client),
+	}
+}
+
+func (c *company) empty() bool {
+	return len(c.customers)+len(c.users)+len(c.remoteCustomers)+len(c.remoteUsers) == 0
+}
+
+// customer finds a customer, local first
+func (c *company) customer(id string) *Client {
+	if cl, ok := c.customers[id]; ok {
+		return cl
+	}
+	return c.remoteCustomers[id]
+}
+
+// user finds a user, local first
+func (c *company) user(id string) *Client {
+	if cl, ok := c.users[id]; ok {
+		return cl
+	}
+	return c.remoteUsers[id]
+}
+
+// proxies returns the remote map for a client type
+func (c *company) proxies(clientType string) map[string]*Client {
+	if clientType == "user" {
+		return c.remoteUsers
+	}
+	return c.remoteCustomers
+}
+
+// local finds the local connection of the client behind a proxy, if any
+func (c *company) local(proxy *Client) *Client {
+	if proxy.Type == "user" {
+		return c.users[proxy.User.UserID]
+	}
+	return c.customers[proxy.Customer.Id]
+}
+
+// remote finds the proxy of a local client connected elsewhere too, if any
+func (c *company) remote(client *Client) *Client {
+	if client.Type == "user" {
+		return c.remoteUsers[client.User.UserID]
+	}
+	return c.remoteCustomers[client.Customer.Id]
+}
+
+// each calls fn for every client, local and remote, until fn returns false
+func (c *company) each(fn func(*Client) bool) {
+	for _, m := range []map[string]*Client{c.customers, c.users, c.remoteCustomers, c.remoteUsers} {
+		for _, cl := range m {
+			if !fn(cl) {
+				return
+			}
+		}
+	}
+}
+
+// shard is a group of companies behind one lock
+type shard struct {
+	mu        sync.RWMutex
+	companies map[string]*company
+}
+
+// companyLocked returns a company, creating it when create is set; callers hold mu
+func (s *shard) companyLocked(id string, create bool) *company {
+	c, ok := s.companies[id]
+	if !ok && create {
+		c = newCompany()
+		s.companies[id] = c
+	}
+	return c
+}
+
+// pruneLocked forgets a company once its last client is gone; callers hold mu
+func (s *shard) pruneLocked(id string) {
+	if c, ok := s.companies[id]; ok && c.empty() {
+		delete(s.companies, id)
+	}
+}
+
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % shardCount)
+}
+
+// directory maps customer, user, connection and conversation IDs to the
+// company holding them, for lookups that don't know the company. It is
+// striped like the shards and only written while the company's shard is locked.
+type directory struct {
+	stripes [shardCount]struct {
+		mu sync.RWMutex
+		m  map[string]string
+	}
+}
+
+func newDirectory() *directory {
+	d := &directory{}
+	for i := range d.stripes {
+		d.stripes[i].m = make(map[string]string)
+	}
+	return d
+}
+
+// Directory key kinds
+const (
+	dirCustomer     = "customer/"
+	dirUser         = "user/"
+	dirConn         = "conn/"
+	dirConversation = "conversation/"
+)
+
+func (d *directory) get(key string) (string, bool) {
+	st := &d.stripes[shardIndex(key)]
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	companyID, ok := st.m[key]
+	return companyID, ok
+}
+
+func (d *directory) set(key, companyID string) {
+	st := &d.stripes[shardIndex(key)]
+	st.mu.Lock()
+	st.m[key] = companyID
+	st.mu.Unlock()
+}
+
+func (d *directory) delete(key string) {
+	st := &d.stripes[shardIndex(key)]
+	st.mu.Lock()
+	delete(st.m, key)
+	st.mu.Unlock()
+}
+
+// directoryKeys lists the directory entries of a client
+func (c *Client) directoryKeys() []string {
+	if c.Type == "user" {
+		return []string{dirUser + c.User.UserID, dirConn + c.ID}
+	}
+	keys := []string{dirCustomer + c.Customer.Id, dirConn + c.ID}
+	if c.Conversation != nil {
+		keys = append(keys, dirConversation+c.Conversation.Id)
+	}
+	return keys
+}
@@ -0,0 +1,224 @@
+package hub
+
+import (
+	"butter-socket/internal/bus"
+	"butter-socket/internal/metrics"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Session statuses reported for customer connections
+const (
+	StatusAI              = "ai"               // -> the AI is answering
+	StatusPendingTransfer = "pending_transfer" // -> waiting for a human to accept
+	StatusWithAgent       = "with_agent"       // -> a human is chatting
+)
+
+// AgentInfo describes an online user connection
+type AgentInfo struct {
+	ConnID      string   `json:"conn_id"`
+	UserID      string   `json:"user_id"`
+	CompanyID   string   `json:"company_id"`
+	Departments []string `json:"departments"`
+	Node        string   `json:"node,omitempty"`
+}
+
+// SessionInfo describes an active customer connection
+type SessionInfo struct {
+	ConnID         string     `json:"conn_id"`
+	CustomerID     string     `json:"customer_id"`
+	CompanyID      string     `json:"company_id"`
+	ConversationID string     `json:"conversation_id"`
+	DepartmentID   string     `json:"department_id,omitempty"`
+	Status         string     `json:"status"`
+	AssignedTo     string     `json:"assigned_to,omitempty"`
+	WaitingSince   *time.Time `json:"waiting_since,omitempty"`
+}
+
+// Status reports where a customer's conversation currently stands
+func (c *Client) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.statusLocked()
+}
+
+func (c *Client) statusLocked() string {
+	switch {
+	case c.flagRevealed:
+		return StatusWithAgent
+	case c.sosFlag:
+		return StatusPendingTransfer
+	}
+	return StatusAI
+}
+
+// OnlineAgents lists connected users of a company, optionally narrowed to a
+// department. An empty companyID lists every company.
+func (h *Hub) OnlineAgents(companyID, departmentID string) []AgentInfo {
+	agents := []AgentInfo{}
+	h.scan(companyID, func(c *company) {
+		for _, cl := range c.users {
+			if info, ok := agentInfo(cl, departmentID); ok {
+				agents = append(agents, info)
+			}
+		}
+		for id, cl := range c.remoteUsers {
+			if c.users[id] != nil {
+				continue
+			}
+			if info, ok := agentInfo(cl, departmentID); ok {
+				agents = append(agents, info)
+			}
+		}
+	})
+	sort.Slice(agents, func(i, j int) bool { return agents[i].UserID < agents[j].UserID })
+	return agents
+}
+
+func agentInfo(c *Client, departmentID string) (AgentInfo, bool) {
+	info := AgentInfo{ConnID: c.ID, UserID: c.User.UserID, CompanyID: c.User.CompanyID, Node: c.Node}
+	inDepartment := departmentID == ""
+	for _, d := range c.User.Departments {
+		info.Departments = append(info.Departments, d.DepartmentID)
+		if d.DepartmentID == departmentID {
+			inDepartment = true
+		}
+	}
+	return info, inDepartment
+}
+
+// Sessions lists connected customers of a company. An empty companyID lists
+// every company, an empty status every status.
+func (h *Hub) Sessions(companyID, status string) []SessionInfo {
+	sessions := []SessionInfo{}
+	h.scan(companyID, func(c *company) {
+		for _, cl := range c.customers {
+			if info, ok := sessionInfo(cl, status); ok {
+				sessions = append(sessions, info)
+			}
+		}
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CustomerID < sessions[j].CustomerID })
+	return sessions
+}
+
+func sessionInfo(c *Client, status string) (SessionInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := SessionInfo{
+		ConnID:     c.ID,
+		CustomerID: c.Customer.Id,
+		CompanyID:  c.CompanyID(),
+		Status:     c.statusLocked(),
+	}
+	if status != "" && info.Status != status {
+		return SessionInfo{}, false
+	}
+	if c.Conversation != nil {
+		info.ConversationID = c.Conversation.Id
+		info.DepartmentID = c.Conversation.DepartmentId
+		info.AssignedTo = c.Conversation.AssignedTo
+	}
+	if !c.transferRequestedAt.IsZero() {
+		since := c.transferRequestedAt
+		info.WaitingSince = &since
+	}
+	return info, true
+}
+
+// otherCompanies sums the connections of companies without an agent online
+const otherCompanies = "other"
+
+// CompanyConnections counts this node's connections per company, for
+// metrics. Only companies with an agent online anywhere are named: their IDs
+// came from the auth service, while any customer can make one up.
+func (h *Hub) CompanyConnections() []metrics.CompanyConnections {
+	other := metrics.CompanyConnections{CompanyID: otherCompanies}
+	var out []metrics.CompanyConnections
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for companyID, c := range s.companies {
+			cc := metrics.CompanyConnections{CompanyID: companyID, Customers: len(c.customers), Users: len(c.users)}
+			switch {
+			case cc.Customers+cc.Users == 0:
+			case len(c.users)+len(c.remoteUsers) > 0:
+				out = append(out, cc)
+			default:
+				other.Customers += cc.Customers
+			}
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CompanyID < out[j].CompanyID })
+	return append(out, other)
+}
+
+// scan calls fn with one company, or with every company for an empty
+// companyID, under its shard's read lock
+func (h *Hub) scan(companyID string, fn func(*company)) {
+	if companyID != "" {
+		s := h.shardFor(companyID)
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if c := s.companyLocked(companyID, false); c != nil {
+			fn(c)
+		}
+		return
+	}
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.RLock()
+		for _, c := range s.companies {
+			fn(c)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// GetClientByConnId finds a customer or user connection by its connection ID
+func (h *Hub) GetClientByConnId(connID string) *Client {
+	return h.find(dirConn+connID, func(c *company) *Client {
+		var found *Client
+		c.each(func(cl *Client) bool {
+			if cl.ID == connID {
+				found = cl
+			}
+			return found == nil
+		})
+		return found
+	})
+}
+
+// GetClientByConversationId finds the customer connection owning a conversation,
+// on this or another node
+func (h *Hub) GetClientByConversationId(conversationID string) *Client {
+	return h.find(dirConversation+conversationID, func(c *company) *Client {
+		var found *Client
+		c.each(func(cl *Client) bool {
+			if cl.Type != "user" && cl.Conversation != nil && cl.Conversation.Id == conversationID {
+				found = cl
+			}
+			return found == nil
+		})
+		return found
+	})
+}
+
+// Disconnect closes a connection with the given close reason. The read pump
+// unregisters the client as it would for any other disconnect.
+func (h *Hub) Disconnect(client *Client, reason string) {
+	if client.Remote {
+		h.publish(bus.Envelope{Kind: kindDisconnect, Target: client.Node, ClientID: client.ID, Payload: []byte(reason)})
+		return
+	}
+	client.CancelAI(StopDisconnected)
+	_ = client.Conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+		time.Now().Add(time.Second),
+	)
+	client.Conn.Close()
+}
@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/logging"
+	"butter-socket/models"
+	"context"
+	"time"
+)
+
+// summaryTimeout bounds classifying and summarizing a closed conversation
+const summaryTimeout = 20 * time.Second
+
+// Stages at which a conversation is classified and summarized
+const (
+	StageHandoff = "handoff" // -> for the agents offered the chat
+	StageFinal   = "final"   // -> after the conversation closed
+)
+
+// Summarizer writes a short summary of a conversation and its messages
+type Summarizer interface {
+	Summarize(ctx context.Context, conv models.Conversation) (string, error)
+}
+
+// UseSummaries has conversations summarized by s when they are handed to a
+// human and again when they close. Call before clients register.
+func (h *Hub) UseSummaries(s Summarizer) {
+	h.summarizer = s
+}
+
+// summaryData is the payload of conversation.summarized
+type summaryData struct {
+	Summary string `json:"summary"`
+	Stage   string `json:"stage"`
+}
+
+// Summarize writes a fresh summary of a customer's conversation into
+// Conversation.Summary and saves it with conversation.summarized. It returns
+// "" when summaries are off or there is nothing to summarize yet.
+func (h *Hub) Summarize(ctx context.Context, customer *Client, stage string) (string, error) {
+	if h.summarizer == nil || customer.Conversation == nil {
+		return "", nil
+	}
+	conv, err := h.withMessages(ctx, customer.Snapshot())
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	summary, err := h.summarizer.Summarize(ctx, conv)
+	if err != nil || summary == "" {
+		return "", err
+	}
+	saved := customer.UpdateConversation(func(conv *models.Conversation) { conv.Summary = summary })
+	customer.Logger().Info("conversation summarized",
+		logging.KeyEvent, "summary",
+		"stage", stage,
+		"messages", len(conv.Messages),
+		"duration_ms", time.Since(start).Milliseconds())
+	h.save(customer, saved, events.ConversationSummarized, summaryData{Summary: summary, Stage: stage})
+	return summary, nil
+}
+
+// withMessages fills in a conversation's messages from the store
+func (h *Hub) withMessages(ctx context.Context, conv models.Conversation) (models.Conversation, error) {
+	if h.store == nil {
+		return conv, nil
+	}
+	stored, ok, err := h.store.Conversation(ctx, conv.Id)
+	if err != nil {
+		return conv, err
+	}
+	if ok {
+		conv.Messages = stored.Messages
+	}
+	return conv, nil
+}
+
+// reviewClosed classifies and summarizes a closed conversation in the
+// background. Chats replaced by a reconnect or cut by a drain carry on
+// elsewhere and are left alone.
+func (h *Hub) reviewClosed(customer *Client, reason string) {
+	if (h.summarizer == nil && h.classifier == nil) || reason == "replaced" || h.Draining() {
+		return
+	}
+	h.Go(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+		defer cancel()
+		if _, err := h.Classify(ctx, customer, StageFinal); err != nil {
+			customer.Logger().Warn("final classification failed", logging.KeyEvent, "classify", "error", err)
+		}
+		if _, err := h.Summarize(ctx, customer, StageFinal); err != nil {
+			customer.Logger().Warn("final summary failed", logging.KeyEvent, "summary", "error", err)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/store"
+	"butter-socket/models"
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReviewIsSaved(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	h := NewHub()
+	h.UseStore(s)
+	h.UseClassifier(fixedClassifier{})
+	h.UseSummaries(fixedSummarizer{})
+	customer := testCustomer(h, "cust-1", "acme")
+	h.RegisterClient(customer)
+	h.SaveMessage(customer, models.MsgInOut{SenderType: "customer", Content: "I want my money back"})
+
+	if _, err := h.Classify(ctx, customer, StageHandoff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Summarize(ctx, customer, StageHandoff); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, ok, _ := s.Conversation(ctx, customer.Conversation.Id)
+	if !ok {
+		t.Fatal("conversation not saved")
+	}
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"summary", saved.Summary == "wants a refund"},
+		{"classification", saved.Classification != nil && saved.Classification.Intent == "refund"},
+		{"tags", slices.Contains(saved.Tags, "intent:refund")},
+		{"department", saved.DepartmentId == "billing"},
+		{"messages kept", len(saved.Messages) == 1},
+	}
+	for _, tt := range tests {
+		if !tt.ok {
+			t.Errorf("saved conversation lost its %s: %+v", tt.name, saved)
+		}
+	}
+
+	pending, _ := s.Pending(ctx, time.Now(), 100)
+	var types []string
+	for _, e := range pending {
+		types = append(types, e.Event.Type)
+	}
+	for _, want := range []string{events.ConversationClassified, events.ConversationSummarized} {
+		if !slices.Contains(types, want) {
+			t.Errorf("outbox %v lacks %s", types, want)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package hub
+
+import (
+	"butter-socket/internal/bus"
+	"butter-socket/internal/events"
+	"butter-socket/internal/logging"
+	"butter-socket/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// supervisionHistory bounds the supervisor actions listed by the admin API
+const supervisionHistory = 1000
+
+// Supervisor actions, each raised as the domain event of the same name
+const (
+	SuperviseMonitor   = events.ChatMonitored
+	SuperviseUnmonitor = events.ChatUnmonitored
+	SuperviseWhisper   = events.ChatWhispered
+	SuperviseBargeIn   = events.ChatBargedIn
+)
+
+// SupervisorAction is the audit record of one thing a supervisor did to a chat
+type SupervisorAction struct {
+	ID             string    `json:"id"`
+	Action         string    `json:"action"`
+	CompanyID      string    `json:"company_id"`
+	ConversationID string    `json:"conversation_id"`
+	UserID         string    `json:"user_id"`
+	Role           string    `json:"role"`
+	AgentID        string    `json:"agent_id,omitempty"` // -> who had the chat at the time
+	Content        string    `json:"content,omitempty"`  // -> what was whispered
+	At             time.Time `json:"at"`
+}
+
+// Audit records a supervisor action on the customer's conversation: it is
+// logged, and kept in the store for the admin API of every node, raised as
+// a domain event in the same write
+func (h *Hub) Audit(customer *Client, a SupervisorAction) {
+	a.ID = uuid.New().String()
+	a.CompanyID = customer.CompanyID()
+	a.ConversationID = customer.Conversation.Id
+	a.At = time.Now().UTC()
+
+	customer.Logger().Info("supervisor action",
+		logging.KeyEvent, a.Action,
+		logging.KeyUser, a.UserID,
+		"role", a.Role,
+		"agent_id", a.AgentID)
+	if h.store == nil {
+		return
+	}
+	ev := events.New(a.Action, a.CompanyID, a.ConversationID, a)
+	ev.OccurredAt = a.At
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.store.AppendAudit(ctx, ev); err != nil {
+		customer.Logger().Error("supervisor action not recorded", logging.KeyEvent, a.Action, "error", err)
+	}
+}
+
+// Supervision lists the supervisor actions recorded for a company, newest
+// first. An empty companyID lists every company.
+func (h *Hub) Supervision(ctx context.Context, companyID string) ([]SupervisorAction, error) {
+	out := []SupervisorAction{}
+	if h.store == nil {
+		return out, nil
+	}
+	evs, err := h.store.Audit(ctx, companyID, supervisionHistory)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range evs {
+		var a SupervisorAction
+		if err := json.Unmarshal(ev.Data, &a); err != nil {
+			return nil, fmt.Errorf("audit record %s: %w", ev.ID, err)
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// MonitoredMessage is a message of a conversation a supervisor is watching
+type MonitoredMessage struct {
+	ConversationID string          `json:"conversation_id"`
+	Message        models.MsgInOut `json:"message"`
+}
+
+// MonitorEnded tells a supervisor they no longer watch a conversation
+type MonitorEnded struct {
+	ConversationID string `json:"conversation_id"`
+	Reason         string `json:"reason"`
+}
+
+// watchEnvelope tells the other nodes a supervisor started or stopped
+// watching a conversation, so messages saved there reach them too
+type watchEnvelope struct {
+	ConversationID string `json:"conversation_id"`
+	UserID         string `json:"user_id"`
+	Watch          bool   `json:"watch"`
+}
+
+// watchList is who watches which conversation, by conversation and user ID.
+// Every node keeps its own, so whichever node saves a message can mirror it.
+type watchList struct {
+	mu       sync.Mutex
+	watchers map[string]map[string]*Client
+}
+
+func newWatchList() *watchList {
+	return &watchList{watchers: make(map[string]map[string]*Client)}
+}
+
+func (l *watchList) add(conversationID string, watcher *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.watchers[conversationID] == nil {
+		l.watchers[conversationID] = make(map[string]*Client)
+	}
+	l.watchers[conversationID][watcher.User.UserID] = watcher
+}
+
+func (l *watchList) remove(conversationID, userID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.watchers[conversationID][userID]; !ok {
+		return false
+	}
+	delete(l.watchers[conversationID], userID)
+	if len(l.watchers[conversationID]) == 0 {
+		delete(l.watchers, conversationID)
+	}
+	return true
+}
+
+// of returns the watchers of a conversation
+func (l *watchList) of(conversationID string) []*Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []*Client
+	for _, w := range l.watchers[conversationID] {
+		out = append(out, w)
+	}
+	return out
+}
+
+// forgetWatcher stops a connection that went away from watching anything
+func (l *watchList) forgetWatcher(watcher *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for conversationID, ws := range l.watchers {
+		if ws[watcher.User.UserID] == watcher {
+			delete(ws, watcher.User.UserID)
+			if len(ws) == 0 {
+				delete(l.watchers, conversationID)
+			}
+		}
+	}
+}
+
+// end drops a conversation and returns who was watching it
+func (l *watchList) end(conversationID string) []*Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []*Client
+	for _, w := range l.watchers[conversationID] {
+		out = append(out, w)
+	}
+	delete(l.watchers, conversationID)
+	return out
+}
+
+// Watch subscribes a user connection to a conversation, read-only: every
+// message saved to it from now on is copied to them as monitor_message
+func (h *Hub) Watch(conversationID string, watcher *Client) {
+	h.watchers.add(conversationID, watcher)
+	h.publishWatch(conversationID, watcher, true)
+}
+
+// Unwatch ends a subscription made with Watch, reporting whether there was one
+func (h *Hub) Unwatch(conversationID string, watcher *Client) bool {
+	if !h.watchers.remove(conversationID, watcher.User.UserID) {
+		return false
+	}
+	h.publishWatch(conversationID, watcher, false)
+	return true
+}
+
+func (h *Hub) publishWatch(conversationID string, watcher *Client, watch bool) {
+	if watcher.Remote {
+		return
+	}
+	payload, _ := json.Marshal(watchEnvelope{ConversationID: conversationID, UserID: watcher.User.UserID, Watch: watch})
+	h.publish(bus.Envelope{Kind: kindWatch, ClientType: "user", Payload: payload})
+}
+
+// handleWatch files a supervisor of another node as a watcher here
+func (h *Hub) handleWatch(env bus.Envelope) {
+	var w watchEnvelope
+	if err := json.Unmarshal(env.Payload, &w); err != nil {
+		slog.Warn("bad watch envelope", "origin", env.Origin, "error", err)
+		return
+	}
+	if !w.Watch {
+		h.watchers.remove(w.ConversationID, w.UserID)
+		return
+	}
+	// the supervisor's own node already has them
+	if watcher := h.GetUserConnByUserId(w.UserID); watcher != nil && watcher.Remote {
+		h.watchers.add(w.ConversationID, watcher)
+	}
+}
+
+// mirror copies a message saved to a conversation to its watchers
+func (h *Hub) mirror(conversationID string, msg models.MsgInOut) {
+	watchers := h.watchers.of(conversationID)
+	if len(watchers) == 0 {
+		return
+	}
+	frame, _ := json.Marshal(models.WSMessage{
+		Type:    "monitor_message",
+		Payload: MonitoredMessage{ConversationID: conversationID, Message: msg},
+	})
+	for _, w := range watchers {
+		w.Deliver(frame)
+	}
+}
+
+// endWatch tells the watchers of a local customer's conversation it is over
+func (h *Hub) endWatch(customer *Client, reason string) {
+	watchers := h.watchers.end(customer.Conversation.Id)
+	if len(watchers) == 0 {
+		return
+	}
+	frame, _ := json.Marshal(models.WSMessage{
+		Type:    "monitor_ended",
+		Payload: MonitorEnded{ConversationID: customer.Conversation.Id, Reason: reason},
+	})
+	for _, w := range watchers {
+		w.Deliver(frame)
+	}
+}
+
+// Transcript returns a copy of the customer's conversation with its stored messages
+func (h *Hub) Transcript(ctx context.Context, customer *Client) (models.Conversation, error) {
+	return h.withMessages(ctx, customer.Snapshot())
+}
@@ -0,0 +1,55 @@
+package hub
+
+import (
+	"butter-socket/internal/store"
+	"context"
+	"testing"
+	"time"
+)
+
+// TestSupervisionIsShared audits actions on two nodes sharing a store; each
+// node's admin API lists both
+func TestSupervisionIsShared(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	nodes := []*Hub{NewHub(), NewHub()}
+	for i, h := range nodes {
+		h.UseStore(s)
+		customer := testCustomer(h, []string{"cust-1", "cust-2"}[i], []string{"acme", "globex"}[i])
+		h.RegisterClient(customer)
+		h.Audit(customer, SupervisorAction{Action: SuperviseBargeIn, UserID: "super-1", Role: "supervisor"})
+	}
+	nodes[0].Audit(nodes[0].GetCustomerConn("cust-1"), SupervisorAction{Action: SuperviseWhisper, UserID: "super-1", Content: "offer the refund"})
+
+	tests := []struct {
+		companyID string
+		want      []string
+	}{
+		{"acme", []string{SuperviseWhisper, SuperviseBargeIn}},
+		{"globex", []string{SuperviseBargeIn}},
+		{"", []string{SuperviseWhisper, SuperviseBargeIn, SuperviseBargeIn}},
+	}
+	for _, h := range nodes {
+		for _, tt := range tests {
+			actions, err := h.Supervision(ctx, tt.companyID)
+			if err != nil || len(actions) != len(tt.want) {
+				t.Fatalf("Supervision(%q) = %+v, %v, want %v", tt.companyID, actions, err, tt.want)
+			}
+			for i, a := range actions {
+				if a.Action != tt.want[i] || a.ID == "" || a.ConversationID == "" {
+					t.Errorf("Supervision(%q)[%d] = %+v, want %s", tt.companyID, i, a, tt.want[i])
+				}
+			}
+		}
+	}
+	pending, _ := s.Pending(ctx, time.Now(), 100)
+	raised := 0
+	for _, e := range pending {
+		if e.Event.Type == SuperviseBargeIn || e.Event.Type == SuperviseWhisper {
+			raised++
+		}
+	}
+	if raised != 3 {
+		t.Errorf("%d supervisor events raised, want one per action", raised)
+	}
+}
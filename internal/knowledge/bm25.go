@@ -0,0 +1,166 @@
+package knowledge
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters, the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// stopwords carry no meaning for retrieval
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "can": true, "do": true, "does": true, "for": true, "from": true,
+	"has": true, "have": true, "how": true, "i": true, "if": true, "in": true, "is": true,
+	"it": true, "its": true, "me": true, "my": true, "of": true, "on": true, "or": true,
+	"our": true, "so": true, "that": true, "the": true, "their": true, "there": true,
+	"this": true, "to": true, "was": true, "we": true, "what": true, "when": true,
+	"where": true, "which": true, "will": true, "with": true, "you": true, "your": true,
+}
+
+// terms splits text into lower-case index terms without stopwords. Plural
+// "s" is dropped so "refunds" finds "refund".
+func terms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	out := words[:0]
+	for _, w := range words {
+		if len(w) < 2 || stopwords[w] {
+			continue
+		}
+		if len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") {
+			w = w[:len(w)-1]
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+// BM25 is an in-memory lexical index over the chunks of one company
+type BM25 struct {
+	mu         sync.RWMutex
+	lengths    map[string]int            // -> terms per chunk ID
+	postings   map[string]map[string]int // -> term, chunk ID, term frequency
+	byDocument map[string][]string       // -> document ID, chunk IDs
+	totalLen   int
+}
+
+// NewBM25 creates an empty lexical index
+func NewBM25() *BM25 {
+	return &BM25{
+		lengths:    make(map[string]int),
+		postings:   make(map[string]map[string]int),
+		byDocument: make(map[string][]string),
+	}
+}
+
+// Prepare splits chunks into terms; apply indexes them
+func (x *BM25) Prepare(_ context.Context, chunks []Chunk) (func(), error) {
+	chunkTerms := make([][]string, len(chunks))
+	for i, c := range chunks {
+		chunkTerms[i] = terms(c.Heading + " " + c.Title + " " + c.Text)
+	}
+	return func() {
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		for i, c := range chunks {
+			ts := chunkTerms[i]
+			x.lengths[c.ID] = len(ts)
+			x.totalLen += len(ts)
+			x.byDocument[c.DocumentID] = append(x.byDocument[c.DocumentID], c.ID)
+			for _, t := range ts {
+				p := x.postings[t]
+				if p == nil {
+					p = make(map[string]int)
+					x.postings[t] = p
+				}
+				p[c.ID]++
+			}
+		}
+	}, nil
+}
+
+// Remove drops every chunk of a document
+func (x *BM25) Remove(documentID string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ids := x.byDocument[documentID]
+	if len(ids) == 0 {
+		return
+	}
+	gone := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		gone[id] = true
+		x.totalLen -= x.lengths[id]
+		delete(x.lengths, id)
+	}
+	delete(x.byDocument, documentID)
+	for t, p := range x.postings {
+		for id := range p {
+			if gone[id] {
+				delete(p, id)
+			}
+		}
+		if len(p) == 0 {
+			delete(x.postings, t)
+		}
+	}
+}
+
+// Search scores chunks against the query with Okapi BM25 and returns the best k
+func (x *BM25) Search(_ context.Context, query string, k int) ([]Hit, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	n := len(x.lengths)
+	if n == 0 {
+		return nil, nil
+	}
+	avgLen := float64(x.totalLen) / float64(n)
+
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, t := range terms(query) {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		p := x.postings[t]
+		if len(p) == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(n)-float64(len(p))+0.5)/(float64(len(p))+0.5))
+		for id, tf := range p {
+			norm := bm25K1 * (1 - bm25B + bm25B*float64(x.lengths[id])/avgLen)
+			scores[id] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+		}
+	}
+	return topHits(scores, k), nil
+}
+
+// topHits orders scores best first and keeps k of them
+func topHits(scores map[string]float64, k int) []Hit {
+	hits := make([]Hit, 0, len(scores))
+	for id, s := range scores {
+		hits = append(hits, Hit{ChunkID: id, Score: s})
+	}
+	slices.SortFunc(hits, func(a, b Hit) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ChunkID, b.ChunkID)
+	})
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
@@ -0,0 +1,120 @@
+package knowledge
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// embedBatch bounds the texts sent to the embedder in one call
+const embedBatch = 64
+
+// Embedder turns texts into vectors, one per text, e.g. an embeddings API
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Vectors is an in-memory embedding index over the chunks of one company,
+// ranked by cosine similarity
+type Vectors struct {
+	embedder Embedder
+
+	mu         sync.RWMutex
+	vectors    map[string][]float32 // -> by chunk ID, normalised
+	byDocument map[string][]string
+}
+
+// NewVectors creates an empty embedding index backed by e
+func NewVectors(e Embedder) *Vectors {
+	return &Vectors{
+		embedder:   e,
+		vectors:    make(map[string][]float32),
+		byDocument: make(map[string][]string),
+	}
+}
+
+// Prepare embeds chunks; apply indexes them. It fails if any batch does.
+func (v *Vectors) Prepare(ctx context.Context, chunks []Chunk) (func(), error) {
+	vecs := make([][]float32, 0, len(chunks))
+	for start := 0; start < len(chunks); start += embedBatch {
+		batch := chunks[start:min(start+embedBatch, len(chunks))]
+		texts := make([]string, len(batch))
+		for i, c := range batch {
+			texts[i] = c.passageText()
+		}
+		out, err := v.embedder.Embed(ctx, texts)
+		if err != nil {
+			return nil, fmt.Errorf("embed chunks: %w", err)
+		}
+		if len(out) != len(batch) {
+			return nil, fmt.Errorf("embed chunks: got %d vectors for %d texts", len(out), len(batch))
+		}
+		vecs = append(vecs, out...)
+	}
+
+	for i := range vecs {
+		vecs[i] = normalize(vecs[i])
+	}
+	return func() {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		for i, c := range chunks {
+			v.vectors[c.ID] = vecs[i]
+			v.byDocument[c.DocumentID] = append(v.byDocument[c.DocumentID], c.ID)
+		}
+	}, nil
+}
+
+// Remove drops every chunk of a document
+func (v *Vectors) Remove(documentID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, id := range v.byDocument[documentID] {
+		delete(v.vectors, id)
+	}
+	delete(v.byDocument, documentID)
+}
+
+// Search embeds the query and returns the k most similar chunks
+func (v *Vectors) Search(ctx context.Context, query string, k int) ([]Hit, error) {
+	out, err := v.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("embed query: %w", err)
+	}
+	if len(out) != 1 {
+		return nil, fmt.Errorf("embed query: got %d vectors", len(out))
+	}
+	q := normalize(out[0])
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	scores := make(map[string]float64, len(v.vectors))
+	for id, vec := range v.vectors {
+		if len(vec) != len(q) {
+			continue
+		}
+		var dot float64
+		for i := range vec {
+			dot += float64(vec[i]) * float64(q[i])
+		}
+		scores[id] = dot
+	}
+	return topHits(scores, k), nil
+}
+
+func normalize(vec []float32) []float32 {
+	var sum float64
+	for _, x := range vec {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return vec
+	}
+	norm := float32(math.Sqrt(sum))
+	out := make([]float32, len(vec))
+	for i, x := range vec {
+		out[i] = x / norm
+	}
+	return out
+}
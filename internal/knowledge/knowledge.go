@@ -0,0 +1,363 @@
+// Package knowledge holds each company's docs, FAQs and policies and finds
+// the passages that answer a customer's question.
+package knowledge
+
+import (
+	"butter-socket/internal/logging"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxDocument bounds the size of one ingested document
+const MaxDocument = 2 << 20
+
+// rrfK damps reciprocal rank fusion so one index can't dominate the other
+const rrfK = 60
+
+var (
+	// ErrInvalid marks a document that can't be ingested
+	ErrInvalid = errors.New("invalid document")
+
+	// ErrNotFound is returned for unknown documents
+	ErrNotFound = errors.New("document not found")
+)
+
+// Document is one source of company knowledge, e.g. a returns policy page
+type Document struct {
+	ID        string `json:"id,omitempty"` // -> set to replace an earlier version
+	CompanyID string `json:"company_id"`
+	Title     string `json:"title,omitempty"`
+	Source    string `json:"source,omitempty"` // -> URL or file the text came from
+	Format    string `json:"format,omitempty"` // -> markdown, html or text
+	Content   string `json:"content"`
+}
+
+// DocumentInfo describes an ingested document
+type DocumentInfo struct {
+	ID         string    `json:"id"`
+	CompanyID  string    `json:"company_id"`
+	Title      string    `json:"title"`
+	Source     string    `json:"source,omitempty"`
+	Format     string    `json:"format"`
+	Chunks     int       `json:"chunks"`
+	IngestedAt time.Time `json:"ingested_at"`
+}
+
+// Chunk is a passage of a document, the unit that is indexed and retrieved
+type Chunk struct {
+	ID         string `json:"id"`
+	DocumentID string `json:"document_id"`
+	Title      string `json:"title"`
+	Heading    string `json:"heading,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Text       string `json:"text"`
+}
+
+// passageText is what gets embedded: the text with its title and heading
+func (c Chunk) passageText() string {
+	text := c.Text
+	if c.Heading != "" {
+		text = c.Heading + "\n" + text
+	}
+	if c.Title != "" {
+		text = c.Title + "\n" + text
+	}
+	return text
+}
+
+// Hit is a chunk an index found for a query
+type Hit struct {
+	ChunkID string
+	Score   float64
+}
+
+// Passage is a retrieved chunk with its fused relevance score
+type Passage struct {
+	Chunk
+	Score float64 `json:"score"`
+}
+
+// Index finds the chunks of one company most relevant to a query
+type Index interface {
+	// Prepare does the slow part of indexing chunks, such as embedding them,
+	// and returns apply, which adds them to the index quickly. A document's
+	// earlier chunks should be removed before apply runs.
+	Prepare(ctx context.Context, chunks []Chunk) (apply func(), err error)
+	Remove(documentID string)
+	Search(ctx context.Context, query string, k int) ([]Hit, error)
+}
+
+// library is the knowledge of one company
+type library struct {
+	mu      sync.RWMutex
+	docs    map[string]DocumentInfo
+	chunks  map[string]Chunk
+	indexes []Index // -> BM25 first, then embeddings if enabled; fixed, each locks itself
+}
+
+// Base holds the knowledge of every company
+type Base struct {
+	embedder Embedder
+
+	mu        sync.RWMutex
+	libraries map[string]*library // -> by company ID
+	owners    map[string]string   // -> document ID, company ID
+}
+
+// NewBase creates an empty knowledge base with lexical search only
+func NewBase() *Base {
+	return &Base{
+		libraries: make(map[string]*library),
+		owners:    make(map[string]string),
+	}
+}
+
+// UseEmbeddings adds an embedding index next to BM25 for every company.
+// Call before ingesting documents.
+func (b *Base) UseEmbeddings(e Embedder) {
+	b.embedder = e
+}
+
+func (b *Base) library(companyID string, create bool) *library {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lib := b.libraries[companyID]
+	if lib == nil && create {
+		lib = &library{
+			docs:    make(map[string]DocumentInfo),
+			chunks:  make(map[string]Chunk),
+			indexes: []Index{NewBM25()},
+		}
+		if b.embedder != nil {
+			lib.indexes = append(lib.indexes, NewVectors(b.embedder))
+		}
+		b.libraries[companyID] = lib
+	}
+	return lib
+}
+
+// Ingest chunks and indexes a document, replacing an earlier version with the same ID
+func (b *Base) Ingest(ctx context.Context, doc Document) (DocumentInfo, error) {
+	if doc.CompanyID == "" {
+		return DocumentInfo{}, fmt.Errorf("%w: missing company_id", ErrInvalid)
+	}
+	if len(doc.Content) > MaxDocument {
+		return DocumentInfo{}, fmt.Errorf("%w: longer than %d bytes", ErrInvalid, MaxDocument)
+	}
+	format, err := ParseFormat(doc.Format)
+	if err != nil {
+		return DocumentInfo{}, err
+	}
+	if doc.ID == "" {
+		doc.ID = uuid.New().String()
+	}
+
+	b.mu.RLock()
+	owner, known := b.owners[doc.ID]
+	b.mu.RUnlock()
+	if known && owner != doc.CompanyID {
+		return DocumentInfo{}, fmt.Errorf("%w: id belongs to another company", ErrInvalid)
+	}
+
+	text, title := toMarkdown(format, doc.Content)
+	if doc.Title != "" {
+		title = doc.Title
+	}
+	if title == "" {
+		title = doc.Source
+	}
+	chunks := split(text)
+	if len(chunks) == 0 {
+		return DocumentInfo{}, fmt.Errorf("%w: no text", ErrInvalid)
+	}
+	for i := range chunks {
+		chunks[i].ID = doc.ID + "#" + strconv.Itoa(i)
+		chunks[i].DocumentID = doc.ID
+		chunks[i].Title = title
+		chunks[i].Source = doc.Source
+	}
+
+	// embedding takes a network call; searches carry on until the swap
+	lib := b.library(doc.CompanyID, true)
+	applies := make([]func(), 0, len(lib.indexes))
+	for _, idx := range lib.indexes {
+		apply, err := idx.Prepare(ctx, chunks)
+		if err != nil {
+			return DocumentInfo{}, err
+		}
+		applies = append(applies, apply)
+	}
+
+	lib.mu.Lock()
+	lib.removeLocked(doc.ID)
+	for _, apply := range applies {
+		apply()
+	}
+	for _, c := range chunks {
+		lib.chunks[c.ID] = c
+	}
+	info := DocumentInfo{
+		ID:         doc.ID,
+		CompanyID:  doc.CompanyID,
+		Title:      title,
+		Source:     doc.Source,
+		Format:     format,
+		Chunks:     len(chunks),
+		IngestedAt: time.Now(),
+	}
+	lib.docs[doc.ID] = info
+	lib.mu.Unlock()
+
+	b.mu.Lock()
+	b.owners[doc.ID] = doc.CompanyID
+	b.mu.Unlock()
+	return info, nil
+}
+
+// removeLocked drops a document from the library; callers hold mu
+func (l *library) removeLocked(documentID string) {
+	info, ok := l.docs[documentID]
+	if !ok {
+		return
+	}
+	for _, idx := range l.indexes {
+		idx.Remove(documentID)
+	}
+	for i := 0; i < info.Chunks; i++ {
+		delete(l.chunks, documentID+"#"+strconv.Itoa(i))
+	}
+	delete(l.docs, documentID)
+}
+
+// Remove deletes a document and its chunks
+func (b *Base) Remove(documentID string) error {
+	b.mu.Lock()
+	companyID, ok := b.owners[documentID]
+	delete(b.owners, documentID)
+	b.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	lib := b.library(companyID, false)
+	if lib == nil {
+		return ErrNotFound
+	}
+	lib.mu.Lock()
+	lib.removeLocked(documentID)
+	lib.mu.Unlock()
+	return nil
+}
+
+// Documents lists a company's documents by title
+func (b *Base) Documents(companyID string) []DocumentInfo {
+	out := []DocumentInfo{}
+	lib := b.library(companyID, false)
+	if lib == nil {
+		return out
+	}
+	lib.mu.RLock()
+	for _, info := range lib.docs {
+		out = append(out, info)
+	}
+	lib.mu.RUnlock()
+	slices.SortFunc(out, func(a, b DocumentInfo) int {
+		return cmp.Or(cmp.Compare(a.Title, b.Title), cmp.Compare(a.ID, b.ID))
+	})
+	return out
+}
+
+// Search returns up to k passages of a company's knowledge for a query. With
+// embeddings enabled both rankings are merged by reciprocal rank fusion; an
+// embedding failure falls back to BM25 alone.
+func (b *Base) Search(ctx context.Context, companyID, query string, k int) ([]Passage, error) {
+	lib := b.library(companyID, false)
+	if lib == nil || k <= 0 {
+		return nil, nil
+	}
+
+	fused := make(map[string]float64)
+	var lastErr error
+	searched := 0
+	for _, idx := range lib.indexes {
+		hits, err := idx.Search(ctx, query, k*2)
+		if err != nil {
+			slog.Warn("knowledge index search failed", logging.KeyCompany, companyID, "error", err)
+			lastErr = err
+			continue
+		}
+		searched++
+		for rank, h := range hits {
+			fused[h.ChunkID] += 1 / float64(rrfK+rank+1)
+		}
+	}
+	if searched == 0 {
+		return nil, lastErr
+	}
+
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	out := make([]Passage, 0, k)
+	for _, h := range topHits(fused, k) {
+		if c, ok := lib.chunks[h.ChunkID]; ok {
+			out = append(out, Passage{Chunk: c, Score: h.Score})
+		}
+	}
+	return out, nil
+}
+
+// LoadDir ingests every .md, .html and .txt file under dir/<company ID>/,
+// using the file's path as its document ID so reloading replaces it
+func (b *Base) LoadDir(ctx context.Context, dir string) (int, error) {
+	companies, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	loaded := 0
+	for _, company := range companies {
+		if !company.IsDir() {
+			continue
+		}
+		root := filepath.Join(dir, company.Name())
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			format, err := FormatOf(path)
+			if err != nil || filepath.Ext(path) == "" {
+				return nil
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, path)
+			_, err = b.Ingest(ctx, Document{
+				ID:        filepath.ToSlash(rel),
+				CompanyID: company.Name(),
+				Source:    filepath.ToSlash(rel),
+				Format:    format,
+				Content:   string(content),
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			loaded++
+			return nil
+		})
+		if err != nil {
+			return loaded, err
+		}
+	}
+	return loaded, nil
+}
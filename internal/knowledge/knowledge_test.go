@@ -0,0 +1,170 @@
+package knowledge
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func index(t *testing.T, idx Index, chunks ...Chunk) {
+	t.Helper()
+	apply, err := idx.Prepare(context.Background(), chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply()
+}
+
+func TestBM25(t *testing.T) {
+	x := NewBM25()
+	index(t, x,
+		Chunk{ID: "refunds#0", DocumentID: "refunds", Text: "Refunds are paid back to the original card within five days."},
+		Chunk{ID: "shipping#0", DocumentID: "shipping", Text: "Orders ship in two days. Shipping is free over fifty euros."},
+		Chunk{ID: "returns#0", DocumentID: "returns", Heading: "Returns", Text: "Return an item within thirty days for a refund."},
+	)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"refunds to my card", []string{"refunds#0", "returns#0"}},
+		{"is shipping free", []string{"shipping#0"}},
+		{"returns", []string{"returns#0"}},
+		{"the and of", nil},
+		{"warranty", nil},
+	}
+	for _, tt := range tests {
+		hits, _ := x.Search(context.Background(), tt.query, 5)
+		var got []string
+		for _, h := range hits {
+			got = append(got, h.ChunkID)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	x.Remove("refunds")
+	if hits, _ := x.Search(context.Background(), "original card", 5); len(hits) != 0 {
+		t.Errorf("removed document still found: %v", hits)
+	}
+}
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"How do I get my Refunds?", "get refund"},
+		{"Address and glass", "address glass"},
+		{"a b cd", "cd"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(terms(tt.in), " "); got != tt.want {
+			t.Errorf("terms(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// topicEmbedder places texts on one axis per topic word they mention. Texts
+// containing "slow" wait for release first.
+type topicEmbedder struct {
+	topics  []string
+	release chan struct{}
+}
+
+func (e topicEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	out := make([][]float32, len(texts))
+	for i, text := range texts {
+		text = strings.ToLower(text)
+		if strings.Contains(text, "slow") {
+			select {
+			case <-e.release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		vec := make([]float32, len(e.topics))
+		for j, topic := range e.topics {
+			if strings.Contains(text, topic) {
+				vec[j] = 1
+			}
+		}
+		out[i] = vec
+	}
+	return out, nil
+}
+
+func TestSearchFusesRankings(t *testing.T) {
+	ctx := context.Background()
+	b := NewBase()
+	b.UseEmbeddings(topicEmbedder{topics: []string{"money", "parcel"}})
+	docs := []Document{
+		{ID: "refunds", CompanyID: "acme", Content: "Refunds go back to your card. You get your money back in five days."},
+		{ID: "wallet", CompanyID: "acme", Content: "Money kept in your wallet can pay for later orders."},
+		{ID: "shipping", CompanyID: "acme", Content: "Every parcel ships in two days."},
+	}
+	for _, doc := range docs {
+		if _, err := b.Ingest(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// both rankings agree
+		{"refunds to my card and my money", "refunds#0"},
+		// only the embedding knows "parcel" from "delivery"
+		{"parcel delivery", "shipping#0"},
+	}
+	for _, tt := range tests {
+		passages, err := b.Search(ctx, "acme", tt.query, 2)
+		if err != nil || len(passages) == 0 || passages[0].ID != tt.want {
+			t.Errorf("Search(%q) = %+v, %v, want %s first", tt.query, passages, err, tt.want)
+		}
+	}
+	if passages, _ := b.Search(ctx, "other", "refunds", 2); len(passages) != 0 {
+		t.Errorf("another company's knowledge leaked: %+v", passages)
+	}
+}
+
+func TestIngestEmbedsOutsideTheLock(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	b := NewBase()
+	b.UseEmbeddings(topicEmbedder{topics: []string{"refund"}, release: release})
+	if _, err := b.Ingest(ctx, Document{ID: "refunds", CompanyID: "acme", Content: "Refunds take five days."}); err != nil {
+		t.Fatal(err)
+	}
+
+	ingested := make(chan error)
+	go func() {
+		_, err := b.Ingest(ctx, Document{ID: "refunds", CompanyID: "acme", Content: "Refunds are slow, they take ten days."})
+		ingested <- err
+	}()
+
+	searched := make(chan []Passage)
+	go func() {
+		passages, _ := b.Search(ctx, "acme", "refund", 1)
+		searched <- passages
+	}()
+	select {
+	case passages := <-searched:
+		if len(passages) != 1 || !strings.Contains(passages[0].Text, "five days") {
+			t.Errorf("search during ingest = %+v, want the old version", passages)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("search waited for an ingest to finish embedding")
+	}
+
+	close(release)
+	if err := <-ingested; err != nil {
+		t.Fatal(err)
+	}
+	if passages, _ := b.Search(ctx, "acme", "refund", 2); len(passages) != 1 || !strings.Contains(passages[0].Text, "ten days") {
+		t.Errorf("search after ingest = %+v, want only the new version", passages)
+	}
+}
@@ -0,0 +1,58 @@
+package knowledge
+
+import (
+	"butter-socket/models"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Instructions tells the model to answer from the retrieved passages and to
+// cite them as [n]. It returns "" when nothing was retrieved.
+func Instructions(passages []Passage) string {
+	if len(passages) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("You are a customer support assistant. Answer using the company knowledge below when it is relevant, ")
+	b.WriteString("and cite the passages you use with their number in square brackets, e.g. [1]. ")
+	b.WriteString("If the knowledge does not cover the question, say you are not sure instead of guessing.\n\n")
+	b.WriteString("Company knowledge:\n")
+	for i, p := range passages {
+		fmt.Fprintf(&b, "\n[%d] %s", i+1, p.Title)
+		if p.Heading != "" && p.Heading != p.Title {
+			b.WriteString(" - " + p.Heading)
+		}
+		b.WriteString("\n" + p.Text + "\n")
+	}
+	return b.String()
+}
+
+var citationMarker = regexp.MustCompile(`\[(\d+)\]`)
+
+// Cite lists the passages a reply refers to with [n] markers, or every
+// passage when the reply has no markers
+func Cite(passages []Passage, reply string) []models.Citation {
+	used := make(map[int]bool)
+	for _, m := range citationMarker.FindAllStringSubmatch(reply, -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil && n >= 1 && n <= len(passages) {
+			used[n] = true
+		}
+	}
+
+	var out []models.Citation
+	for i, p := range passages {
+		if len(used) > 0 && !used[i+1] {
+			continue
+		}
+		out = append(out, models.Citation{
+			Index:      i + 1,
+			DocumentID: p.DocumentID,
+			Title:      p.Title,
+			Heading:    p.Heading,
+			Source:     p.Source,
+		})
+	}
+	return out
+}
@@ -0,0 +1,293 @@
+package knowledge
+
+import (
+	"fmt"
+	"html"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Document formats
+const (
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+	FormatText     = "text"
+)
+
+// Chunk sizes, in bytes of text
+const (
+	maxChunk = 1200 // -> passages are cut before they grow past this
+	minChunk = 200  // -> shorter sections are merged with the next one
+)
+
+// ParseFormat normalises a format name such as "md", "htm" or "txt"
+func ParseFormat(format string) (string, error) {
+	switch strings.ToLower(strings.TrimPrefix(format, ".")) {
+	case "md", "markdown":
+		return FormatMarkdown, nil
+	case "html", "htm":
+		return FormatHTML, nil
+	case "txt", "text", "":
+		return FormatText, nil
+	}
+	return "", fmt.Errorf("%w: unsupported format %q", ErrInvalid, format)
+}
+
+// FormatOf guesses a document's format from its file name
+func FormatOf(name string) (string, error) {
+	return ParseFormat(filepath.Ext(name))
+}
+
+// toMarkdown turns a document into lightly marked up text: headings stay as
+// "#" lines, everything else becomes plain paragraphs
+func toMarkdown(format, content string) (text, title string) {
+	switch format {
+	case FormatHTML:
+		return htmlToMarkdown(content)
+	case FormatMarkdown:
+		return stripMarkdown(content), firstHeading(content)
+	}
+	return content, ""
+}
+
+var (
+	mdImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink     = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	mdEmphasis = regexp.MustCompile("(\\*\\*|__|\\*|`)")
+	mdListItem = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+)
+
+// stripMarkdown drops inline markup but keeps headings, lists and code text
+func stripMarkdown(md string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(md, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "#") {
+			line = mdListItem.ReplaceAllString(line, "")
+			line = strings.TrimPrefix(strings.TrimSpace(line), ">")
+		}
+		line = mdImage.ReplaceAllString(line, "$1")
+		line = mdLink.ReplaceAllString(line, "$1")
+		line = mdEmphasis.ReplaceAllString(line, "")
+		b.WriteString(strings.TrimSpace(line))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func firstHeading(md string) string {
+	for _, line := range strings.Split(md, "\n") {
+		if h, ok := heading(line); ok {
+			return h
+		}
+	}
+	return ""
+}
+
+// heading reports whether a line is a markdown heading and returns its text
+func heading(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "#") {
+		return "", false
+	}
+	text := strings.TrimSpace(strings.TrimLeft(trimmed, "#"))
+	return text, text != ""
+}
+
+// htmlBlocks end a paragraph when they open or close
+var htmlBlocks = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "ul": true, "ol": true,
+	"tr": true, "table": true, "section": true, "article": true, "main": true,
+	"header": true, "footer": true, "blockquote": true, "pre": true, "hr": true,
+	"dt": true, "dd": true,
+}
+
+// htmlSkipped elements never contain readable text
+var htmlSkipped = map[string]bool{"script": true, "style": true, "noscript": true, "template": true, "svg": true}
+
+// htmlToMarkdown extracts readable text from HTML, turning h1-h6 into
+// markdown headings and block elements into paragraph breaks
+func htmlToMarkdown(doc string) (text, title string) {
+	var b strings.Builder
+	skip := ""
+	inTitle := false
+	var titleText strings.Builder
+
+	for len(doc) > 0 {
+		lt := strings.IndexByte(doc, '<')
+		if lt < 0 {
+			lt = len(doc)
+		}
+		if skip == "" {
+			chunk := html.UnescapeString(doc[:lt])
+			if inTitle {
+				titleText.WriteString(chunk)
+			} else {
+				b.WriteString(chunk)
+			}
+		}
+		doc = doc[lt:]
+		if doc == "" {
+			break
+		}
+
+		if strings.HasPrefix(doc, "<!--") {
+			end := strings.Index(doc, "-->")
+			if end < 0 {
+				break
+			}
+			doc = doc[end+3:]
+			continue
+		}
+		gt := strings.IndexByte(doc, '>')
+		if gt < 0 {
+			break
+		}
+		tag := doc[1:gt]
+		doc = doc[gt+1:]
+
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimLeft(tag, "/"))
+		if i := strings.IndexAny(name, " \t\n/"); i >= 0 {
+			name = name[:i]
+		}
+
+		switch {
+		case skip != "":
+			if closing && name == skip {
+				skip = ""
+			}
+		case htmlSkipped[name] && !closing:
+			skip = name
+		case name == "title":
+			inTitle = !closing
+		case len(name) == 2 && name[0] == 'h' && name[1] >= '1' && name[1] <= '6':
+			if closing {
+				b.WriteString("\n\n")
+			} else {
+				b.WriteString("\n\n" + strings.Repeat("#", int(name[1]-'0')) + " ")
+			}
+		case htmlBlocks[name]:
+			b.WriteString("\n\n")
+		}
+	}
+
+	title = strings.Join(strings.Fields(titleText.String()), " ")
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	text = strings.Join(lines, "\n")
+	if title == "" {
+		title = firstHeading(text)
+	}
+	return text, title
+}
+
+// section is a run of paragraphs under one heading
+type section struct {
+	heading    string
+	paragraphs []string
+}
+
+// split cuts marked up text into passages of at most maxChunk bytes, each
+// remembering the heading it sits under
+func split(text string) []Chunk {
+	var sections []section
+	current := section{}
+	var para []string
+	endPara := func() {
+		if len(para) > 0 {
+			current.paragraphs = append(current.paragraphs, strings.Join(para, " "))
+			para = nil
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if h, ok := heading(line); ok {
+			endPara()
+			if len(current.paragraphs) > 0 {
+				sections = append(sections, current)
+			}
+			current = section{heading: h}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			endPara()
+			continue
+		}
+		para = append(para, strings.TrimSpace(line))
+	}
+	endPara()
+	if len(current.paragraphs) > 0 {
+		sections = append(sections, current)
+	}
+
+	var chunks []Chunk
+	var b strings.Builder
+	under := ""
+	emit := func() {
+		if t := strings.TrimSpace(b.String()); t != "" {
+			chunks = append(chunks, Chunk{Heading: under, Text: t})
+		}
+		b.Reset()
+	}
+	for _, s := range sections {
+		// small sections share a passage with the next one, which keeps its heading as text
+		if b.Len() >= minChunk {
+			emit()
+		}
+		if b.Len() == 0 {
+			under = s.heading
+		} else if s.heading != "" {
+			b.WriteString("\n\n" + s.heading)
+		}
+		for _, p := range s.paragraphs {
+			for _, piece := range cut(p, maxChunk) {
+				if b.Len() > 0 && b.Len()+len(piece)+2 > maxChunk {
+					emit()
+					under = s.heading
+				}
+				if b.Len() > 0 {
+					b.WriteString("\n\n")
+				}
+				b.WriteString(piece)
+			}
+		}
+	}
+	emit()
+	return chunks
+}
+
+// cut splits an over-long paragraph at sentence ends, or at spaces when a
+// sentence alone is too long
+func cut(p string, limit int) []string {
+	if len(p) <= limit {
+		return []string{p}
+	}
+	var out []string
+	for len(p) > limit {
+		at := strings.LastIndexAny(p[:limit], ".!?")
+		if at < limit/2 {
+			at = strings.LastIndexByte(p[:limit], ' ')
+		}
+		if at <= 0 {
+			at = limit
+			for at > 0 && !utf8.RuneStart(p[at]) {
+				at--
+			}
+		} else {
+			at++
+		}
+		out = append(out, strings.TrimSpace(p[:at]))
+		p = strings.TrimSpace(p[at:])
+	}
+	if p != "" {
+		out = append(out, p)
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package llm
+
+import (
+	"context"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/openai/openai-go/v3/responses"
+)
+
+// Complete generates a whole reply at once, for background jobs such as
+// summaries where nobody watches tokens arrive. Tools are not offered.
+func Complete(ctx context.Context, req Request) (string, Usage, error) {
+	client := openai.NewClient(
+		option.WithAPIKey(LLM_KEY),
+	)
+
+	model := req.Model
+	if model == "" {
+		model = DefaultModel
+	}
+	usage := Usage{Model: model}
+	start := time.Now()
+
+	params := responses.ResponseNewParams{
+		Model: model,
+		Input: responses.ResponseNewParamsInputUnion{
+			OfString: openai.String(req.Input),
+		},
+	}
+	if req.Instructions != "" {
+		params.Instructions = openai.String(req.Instructions)
+	}
+	resp, err := client.Responses.New(ctx, params)
+	usage.Latency = time.Since(start)
+	if err != nil {
+		return "", usage, err
+	}
+	usage.InputTokens = resp.Usage.InputTokens
+	usage.OutputTokens = resp.Usage.OutputTokens
+	return resp.OutputText(), usage, nil
+}
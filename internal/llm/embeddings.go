@@ -0,0 +1,52 @@
+package llm
+
+import (
+	"context"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+)
+
+// DefaultEmbeddingModel embeds knowledge base passages when no model is configured
+const DefaultEmbeddingModel = openai.EmbeddingModelTextEmbedding3Small
+
+// Embedder turns texts into vectors with the provider's embeddings API
+type Embedder struct {
+	client openai.Client
+	model  string
+}
+
+// NewEmbedder creates an embedder for model, or DefaultEmbeddingModel when empty
+func NewEmbedder(model string) *Embedder {
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+	return &Embedder{
+		client: openai.NewClient(option.WithAPIKey(LLM_KEY)),
+		model:  model,
+	}
+}
+
+// Embed returns one vector per text, in order
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	resp, err := e.client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+		Model: e.model,
+		Input: openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: texts},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]float32, len(texts))
+	for _, d := range resp.Data {
+		if int(d.Index) >= len(out) {
+			continue
+		}
+		vec := make([]float32, len(d.Embedding))
+		for i, x := range d.Embedding {
+			vec[i] = float32(x)
+		}
+		out[d.Index] = vec
+	}
+	return out, nil
+}
@@ -2,6 +2,7 @@ package llm
 
 import (
 	"context"
+	"log/slog"
 
 	"github.com/openai/openai-go/v3"
 	"github.com/openai/openai-go/v3/option"
@@ -25,6 +26,6 @@ func AskButterAI(query string) string {
 		panic(err)
 	}
 
-	println(resp.OutputText())
+	slog.Debug("AI answer", "model", openai.ChatModelGPT5_2, "length", len(resp.OutputText()))
 	return resp.OutputText()
 }
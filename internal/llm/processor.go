@@ -1,38 +1,407 @@
 package llm
 
 import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"unicode"
 )
 
-// ProcessMessage processes incoming messages by reversing them
-func ProcessMessage(content string) string {
-	// Reverse the message
-	reversed := reverseString(content)
-	return reversed
+// Kinds of content the processor looks for
+const (
+	KindProfanity = "profanity"
+	KindAbuse     = "abuse" // -> insults and threats aimed at someone
+	KindCard      = "card"
+	KindEmail     = "email"
+	KindPhone     = "phone"
+)
+
+// What a policy does with a kind of content
+const (
+	ActionAllow = "allow" // -> leave it alone
+	ActionFlag  = "flag"  // -> pass it on unchanged, but report it
+	ActionMask  = "mask"  // -> replace it before it is sent on or stored
+	ActionBlock = "block" // -> drop the whole message
+)
+
+// DefaultModeration flags bad language and masks personal data
+var DefaultModeration = map[string]string{
+	KindProfanity: ActionFlag,
+	KindAbuse:     ActionFlag,
+	KindCard:      ActionMask,
+	KindEmail:     ActionMask,
+	KindPhone:     ActionMask,
+}
+
+// ModerationPolicy is what a company does with each kind of content
+type ModerationPolicy struct {
+	Actions map[string]string `json:"actions,omitempty"` // -> kind, action; missing kinds use the default policy
+	Words   []string          `json:"words,omitempty"`   // -> extra words counted as profanity, on top of the default policy's
+}
+
+// ModerationConfig is the moderation file: a default policy and per company overrides
+type ModerationConfig struct {
+	Default   ModerationPolicy            `json:"default"`
+	Companies map[string]ModerationPolicy `json:"companies"`
+}
+
+// LoadModerationConfig reads a moderation file. An empty path yields DefaultModeration.
+func LoadModerationConfig(path string) (ModerationConfig, error) {
+	cfg := ModerationConfig{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("read moderation file: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parse moderation file: %w", err)
+		}
+	}
+
+	if err := cfg.Default.validate(); err != nil {
+		return cfg, fmt.Errorf("default moderation policy: %w", err)
+	}
+	for companyID, p := range cfg.Companies {
+		if err := p.validate(); err != nil {
+			return cfg, fmt.Errorf("moderation policy for company %s: %w", companyID, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (p ModerationPolicy) validate() error {
+	for kind, action := range p.Actions {
+		if _, ok := DefaultModeration[kind]; !ok {
+			return fmt.Errorf("unknown kind %q", kind)
+		}
+		switch action {
+		case ActionAllow, ActionFlag, ActionMask, ActionBlock:
+		default:
+			return fmt.Errorf("unknown action %q for %s", action, kind)
+		}
+	}
+	for i, w := range p.Words {
+		if strings.TrimSpace(w) == "" {
+			return fmt.Errorf("word %d is empty", i)
+		}
+	}
+	return nil
+}
+
+// Finding is one kind of content found in a message and what was done about it
+type Finding struct {
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+	Count  int    `json:"count"`
+}
+
+// Processed is a message after moderation
+type Processed struct {
+	Text     string    // -> what may be sent on and stored; empty when blocked
+	Blocked  bool      // -> the message must not go any further
+	Findings []Finding // -> every kind found that the policy doesn't allow
+}
+
+// Flagged reports whether anything was found that needs reporting
+func (p Processed) Flagged() bool {
+	return len(p.Findings) > 0
 }
 
-// reverseString reverses a string (supporting UTF-8)
-func reverseString(s string) string {
-	runes := []rune(s)
-	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-		runes[i], runes[j] = runes[j], runes[i]
+// Processor moderates messages on their way in and out: bad language and
+// personal data are detected and allowed, flagged, masked or blocked under
+// the sender's company policy
+type Processor struct {
+	cfg   ModerationConfig
+	words map[string]*regexp.Regexp // -> company ID, its extra words; "" for everyone's
+}
+
+// NewProcessor creates a processor for cfg
+func NewProcessor(cfg ModerationConfig) *Processor {
+	p := &Processor{cfg: cfg, words: make(map[string]*regexp.Regexp)}
+	p.words[""] = wordPattern(cfg.Default.Words)
+	for companyID, policy := range cfg.Companies {
+		if companyID != "" {
+			p.words[companyID] = wordPattern(policy.Words)
+		}
 	}
-	return string(runes)
+	return p
 }
 
-// Additional processing functions can be added here
+// span is a stretch of text one detector matched
+type span struct {
+	kind       string
+	start, end int
+}
+
+// Process moderates one message of a company
+func (p *Processor) Process(companyID, text string) Processed {
+	return p.apply(companyID, text, p.find(companyID, text))
+}
+
+// find runs every detector over text, strongest kind first
+func (p *Processor) find(companyID, text string) []span {
+	var spans []span
+	spans = append(spans, match(KindCard, cardNumber, text, luhn)...)
+	spans = append(spans, match(KindEmail, email, text, nil)...)
+	spans = append(spans, match(KindPhone, phone, text, phoneDigits)...)
+	spans = append(spans, match(KindAbuse, abuse, text, nil)...)
+	spans = append(spans, match(KindProfanity, profanity, text, nil)...)
+	for _, key := range []string{"", companyID} {
+		if extra := p.words[key]; extra != nil {
+			spans = append(spans, match(KindProfanity, extra, text, nil)...)
+		}
+	}
+	return nonOverlapping(spans)
+}
+
+// apply carries out the company's policy on the spans found in text
+func (p *Processor) apply(companyID, text string, spans []span) Processed {
+	out := Processed{Text: text}
+	counts := make(map[string]int)
+	var masked []span
+	for _, s := range spans {
+		action := p.action(companyID, s.kind)
+		if action == ActionAllow {
+			continue
+		}
+		counts[s.kind]++
+		switch action {
+		case ActionBlock:
+			out.Blocked = true
+		case ActionMask:
+			masked = append(masked, s)
+		}
+	}
+	for kind, n := range counts {
+		out.Findings = append(out.Findings, Finding{Kind: kind, Action: p.action(companyID, kind), Count: n})
+	}
+	slices.SortFunc(out.Findings, func(a, b Finding) int { return cmp.Compare(a.Kind, b.Kind) })
+
+	if out.Blocked {
+		out.Text = ""
+		return out
+	}
+	out.Text = mask(text, masked)
+	return out
+}
+
+// action is the company's action for a kind, falling back to the default policy
+func (p *Processor) action(companyID, kind string) string {
+	if a, ok := p.cfg.Companies[companyID].Actions[kind]; ok {
+		return a
+	}
+	if a, ok := p.cfg.Default.Actions[kind]; ok {
+		return a
+	}
+	return DefaultModeration[kind]
+}
 
-// ProcessMessageWithPrefix adds a prefix before reversing
-func ProcessMessageWithPrefix(content string, prefix string) string {
-	reversed := reverseString(content)
-	return prefix + ": " + reversed
+// rewrites reports whether the company's policy masks or blocks anything
+func (p *Processor) rewrites(companyID string) bool {
+	for kind := range DefaultModeration {
+		if a := p.action(companyID, kind); a == ActionMask || a == ActionBlock {
+			return true
+		}
+	}
+	return false
+}
+
+// streamHold is how much of a streamed message is held back until more
+// arrives. It covers the longest content that spans spaces, a 19 digit card
+// number with separators; words are never split, however long.
+const streamHold = 64
+
+// Stream moderates a message that arrives in pieces, such as a streamed AI
+// reply, so content split between pieces is still caught
+type Stream struct {
+	p         *Processor
+	companyID string
+	rewrites  bool
+	pending   string
+	blocked   bool
+}
+
+// Stream starts moderating a streamed message of a company
+func (p *Processor) Stream(companyID string) *Stream {
+	return &Stream{p: p, companyID: companyID, rewrites: p.rewrites(companyID)}
+}
+
+// Next adds text to the message and returns what of it may be sent on, masked.
+// The tail is held back unless final. Once the message is blocked Next
+// returns nothing more and reports true.
+func (s *Stream) Next(text string, final bool) (string, bool) {
+	if s.blocked {
+		return "", true
+	}
+	s.pending += text
+	if !s.rewrites {
+		out := s.pending
+		s.pending = ""
+		return out, false
+	}
+
+	spans := s.p.find(s.companyID, s.pending)
+	cut := len(s.pending)
+	if !final {
+		cut = strings.LastIndexFunc(s.pending[:max(0, cut-streamHold)], unicode.IsSpace) + 1
+		for _, sp := range spans {
+			if sp.start < cut && cut < sp.end {
+				cut = sp.start
+			}
+		}
+	}
+	var released []span
+	for _, sp := range spans {
+		if sp.end <= cut {
+			released = append(released, sp)
+		}
+	}
+
+	result := s.p.apply(s.companyID, s.pending[:cut], released)
+	s.pending = s.pending[cut:]
+	if result.Blocked {
+		s.blocked = true
+		s.pending = ""
+		return "", true
+	}
+	return result.Text, false
+}
+
+var (
+	// 13-19 digits, optionally grouped by spaces or dashes; confirmed with luhn
+	cardNumber = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	email      = regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)
+	// an optional + or (, then digits with the usual separators; confirmed with phoneDigits
+	phone = regexp.MustCompile(`[+(]?\b\d[\d ().-]{6,}\d\b`)
+
+	profanity = wordPattern([]string{
+		"fuck", "fucking", "fucked", "fucker", "motherfucker", "shit", "shitty", "bullshit",
+		"bitch", "bastard", "asshole", "dick", "dickhead", "cunt", "prick", "wanker",
+		"twat", "piss", "pissed", "crap", "damn", "goddamn", "slut", "whore",
+	})
+	abuse = regexp.MustCompile(`(?i)\b(?:(?:you|u)(?:'re| are| r)?\s+(?:an?\s+)?(?:idiot|moron|stupid|useless|retard(?:ed)?|pathetic|worthless|loser|incompetent)` +
+		`|(?:i(?:'ll| will| am going to|'m going to|'m gonna| gonna)\s+)?(?:kill|hurt)\s+(?:you|u)\b` +
+		`|kill\s+yourself|kys|go\s+die|shut\s+(?:the\s+\w+\s+)?up)\b`)
+)
+
+// wordPattern matches any of words as a whole word, case-insensitively;
+// blank words are skipped, as they would match everywhere
+func wordPattern(words []string) *regexp.Regexp {
+	var quoted []string
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(strings.ToLower(w)))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// match finds kind in text, keeping matches ok accepts when ok is set
+func match(kind string, re *regexp.Regexp, text string, ok func(string) bool) []span {
+	var out []span
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		if ok == nil || ok(text[loc[0]:loc[1]]) {
+			out = append(out, span{kind: kind, start: loc[0], end: loc[1]})
+		}
+	}
+	return out
+}
+
+// nonOverlapping keeps the earliest match where two overlap, so a card number
+// isn't also read as a phone number. Spans are listed strongest kind first.
+func nonOverlapping(spans []span) []span {
+	var out []span
+	for _, s := range spans {
+		if !slices.ContainsFunc(out, func(o span) bool { return s.start < o.end && o.start < s.end }) {
+			out = append(out, s)
+		}
+	}
+	slices.SortFunc(out, func(a, b span) int { return cmp.Compare(a.start, b.start) })
+	return out
+}
+
+// mask replaces personal data with a placeholder such as [email] and keeps
+// the first letter of bad words, e.g. "f***"
+func mask(text string, spans []span) string {
+	if len(spans) == 0 {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, s := range spans {
+		b.WriteString(text[last:s.start])
+		switch s.kind {
+		case KindProfanity, KindAbuse:
+			b.WriteString(stars(text[s.start:s.end]))
+		default:
+			b.WriteString("[" + s.kind + "]")
+		}
+		last = s.end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func stars(word string) string {
+	var b strings.Builder
+	for i, r := range []rune(word) {
+		if i == 0 || unicode.IsSpace(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('*')
+		}
+	}
+	return b.String()
+}
+
+// digits keeps only the digits of s
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// luhn tells card numbers from other long numbers such as order IDs
+func luhn(s string) bool {
+	d := digits(s)
+	if len(d) < 13 || len(d) > 19 {
+		return false
+	}
+	sum := 0
+	for i := len(d) - 1; i >= 0; i-- {
+		n := int(d[i] - '0')
+		if (len(d)-1-i)%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
 }
 
-// ProcessMessageWordReverse reverses word order instead of characters
-func ProcessMessageWordReverse(content string) string {
-	words := strings.Fields(content)
-	for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
-		words[i], words[j] = words[j], words[i]
+// phoneDigits accepts 10-15 digits, or 8 and up with a leading +. A bare run
+// of digits must look like a national number, 10 or 11 long, so order
+// numbers and dates are left alone.
+func phoneDigits(s string) bool {
+	d := digits(s)
+	n := len(d)
+	switch {
+	case strings.HasPrefix(s, "+"):
+		return n >= 8 && n <= 15
+	case d == s:
+		return n == 10 || n == 11
 	}
-	return strings.Join(words, " ")
+	return n >= 10 && n <= 15
 }
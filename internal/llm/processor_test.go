@@ -0,0 +1,170 @@
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"5500-0000-0000-0004", true},
+		{"4111111111111112", false},
+		{"411111111111", false},         // -> too short
+		{"41111111111111111111", false}, // -> too long
+	}
+	for _, tt := range tests {
+		if got := luhn(tt.s); got != tt.want {
+			t.Errorf("luhn(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestDetectors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string // -> the kinds found, in order
+	}{
+		{"card", "my card is 4111 1111 1111 1111 thanks", []string{KindCard}},
+		{"order number", "order 4111111111111112 is late", nil},
+		{"email", "write to jane.doe+shop@example.co.uk", []string{KindEmail}},
+		{"phone", "call me on +44 20 7946 0958", []string{KindPhone}},
+		{"national phone", "call 2025550143 tonight", []string{KindPhone}},
+		{"date", "it arrived on 2024-05-01", nil},
+		{"profanity", "this is SHIT", []string{KindProfanity}},
+		{"word inside a word", "scrapbook and Scunthorpe", nil},
+		{"abuse", "you are useless", []string{KindAbuse}},
+		{"threat", "I will kill you", []string{KindAbuse}},
+		{"card before phone", "4111 1111 1111 1111 or jo@example.com", []string{KindCard, KindEmail}},
+	}
+	p := NewProcessor(ModerationConfig{})
+	for _, tt := range tests {
+		var got []string
+		for _, s := range p.find("acme", tt.text) {
+			got = append(got, s.kind)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: found %v in %q, want %v", tt.name, got, tt.text, tt.want)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	p := NewProcessor(ModerationConfig{
+		Default: ModerationPolicy{Words: []string{"  Frak "}},
+		Companies: map[string]ModerationPolicy{
+			"strict": {Actions: map[string]string{KindProfanity: ActionBlock}, Words: []string{"gorram"}},
+			"lax":    {Actions: map[string]string{KindEmail: ActionAllow, KindProfanity: ActionMask}},
+		},
+	})
+	tests := []struct {
+		companyID string
+		text      string
+		want      string
+		blocked   bool
+		findings  int
+	}{
+		{"acme", "all good", "all good", false, 0},
+		{"acme", "mail jo@example.com", "mail [email]", false, 1},
+		{"acme", "card 4111-1111-1111-1111 and jo@example.com", "card [card] and [email]", false, 2},
+		{"acme", "well shit", "well shit", false, 1}, // -> flagged, not masked
+		{"lax", "mail jo@example.com", "mail jo@example.com", false, 0},
+		{"lax", "well shit", "well s***", false, 1},
+		{"lax", "frak this", "f*** this", false, 1}, // -> the default policy's extra words apply to everyone
+		{"strict", "gorram it", "", true, 1},
+		{"acme", "gorram it", "gorram it", false, 0}, // -> another company's words don't
+	}
+	for _, tt := range tests {
+		got := p.Process(tt.companyID, tt.text)
+		if got.Text != tt.want || got.Blocked != tt.blocked || len(got.Findings) != tt.findings {
+			t.Errorf("Process(%s, %q) = %+v, want %q, blocked %v, %d findings", tt.companyID, tt.text, got, tt.want, tt.blocked, tt.findings)
+		}
+	}
+}
+
+func TestWordPattern(t *testing.T) {
+	tests := []struct {
+		words []string
+		text  string
+		want  bool
+	}{
+		{[]string{"frak"}, "FRAK off", true},
+		{[]string{"frak"}, "frakking", false},
+		{[]string{"a.b"}, "axb", false}, // -> quoted, not a regexp
+		{[]string{"", "  ", "frak"}, "nothing here", false},
+	}
+	for _, tt := range tests {
+		re := wordPattern(tt.words)
+		if got := re != nil && re.MatchString(tt.text); got != tt.want {
+			t.Errorf("wordPattern(%q) matches %q = %v, want %v", tt.words, tt.text, got, tt.want)
+		}
+	}
+	if re := wordPattern([]string{"", " \t"}); re != nil {
+		t.Errorf("wordPattern of blank words = %v, want nil", re)
+	}
+}
+
+func TestLoadModerationConfig(t *testing.T) {
+	tests := []struct {
+		file    string
+		wantErr string
+	}{
+		{`{"default":{"actions":{"card":"block"},"words":["frak"]}}`, ""},
+		{`{"default":{"actions":{"cards":"block"}}}`, `unknown kind "cards"`},
+		{`{"companies":{"acme":{"actions":{"email":"hide"}}}}`, `unknown action "hide" for email`},
+		{`{"companies":{"acme":{"words":["frak"," "]}}}`, "moderation policy for company acme: word 1 is empty"},
+		{`{"default":{"words":[""]}}`, "default moderation policy: word 0 is empty"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "moderation.json")
+		if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadModerationConfig(path)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("LoadModerationConfig(%s) = %v, want %q", tt.file, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	p := NewProcessor(ModerationConfig{
+		Companies: map[string]ModerationPolicy{
+			"strict": {Actions: map[string]string{KindProfanity: ActionBlock}},
+			"open":   {Actions: map[string]string{KindCard: ActionFlag, KindEmail: ActionFlag, KindPhone: ActionFlag}},
+		},
+	})
+	filler := strings.Repeat("word ", 20)
+	tests := []struct {
+		name      string
+		companyID string
+		pieces    []string
+		want      string
+		blocked   bool
+	}{
+		{"card split between pieces", "acme", []string{filler + "card 4111 11", "11 1111 1111 is mine " + filler}, filler + "card [card] is mine " + filler, false},
+		{"email split between pieces", "acme", []string{"write to jo@exa", "mple.com " + filler}, "write to [email] " + filler, false},
+		{"word split between pieces", "strict", []string{filler + "well sh", "it " + filler}, strings.Repeat("word ", 8), true}, // -> only what preceded the held back tail
+		{"nothing to rewrite", "open", []string{"card 4111 11", "11 1111 1111"}, "card 4111 1111 1111 1111", false},
+	}
+	for _, tt := range tests {
+		s := p.Stream(tt.companyID)
+		var sent strings.Builder
+		var blocked bool
+		for i, piece := range tt.pieces {
+			out, b := s.Next(piece, i == len(tt.pieces)-1)
+			sent.WriteString(out)
+			blocked = b
+		}
+		if sent.String() != tt.want || blocked != tt.blocked {
+			t.Errorf("%s: sent %q, blocked %v, want %q, %v", tt.name, sent.String(), blocked, tt.want, tt.blocked)
+		}
+	}
+}
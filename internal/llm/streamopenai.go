@@ -2,41 +2,182 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/openai/openai-go/v3"
 	"github.com/openai/openai-go/v3/option"
 	"github.com/openai/openai-go/v3/responses"
 )
 
+// DefaultModel is used when a request does not name a model
+const DefaultModel = openai.ChatModelGPT5_2
+
+// charsPerToken is roughly how many characters make a token of English text,
+// for estimating what a response that never completed cost
+const charsPerToken = 4
+
+// maxToolRounds bounds how often one reply may go back to the model with
+// tool results; the last round must answer without tools
+const maxToolRounds = 4
+
+// Request describes a single generation against the provider
+type Request struct {
+	Model        string
+	Input        string
+	Instructions string   // -> system guidance, e.g. retrieved company knowledge
+	Tools        *Toolbox // -> company tools the model may call; nil for none
+}
+
+// Usage is what one LLM response cost us
+type Usage struct {
+	Model            string
+	InputTokens      int64
+	OutputTokens     int64
+	Latency          time.Duration
+	TimeToFirstToken time.Duration
+	ToolCalls        int
+	Estimated        bool // -> a response ended before the provider counted its tokens
+}
+
+// StreamButterAI streams a reply token by token. When the model calls tools
+// they are run here and their results sent back, so onToken only ever sees
+// the text of the answer; Usage covers every round.
 func StreamButterAI(
 	ctx context.Context,
-	query string,
+	req Request,
 	onToken func(token string),
-) error {
+) (Usage, error) {
 
 	client := openai.NewClient(
 		option.WithAPIKey(LLM_KEY),
 	)
 
-	stream := client.Responses.NewStreaming(ctx, responses.ResponseNewParams{
-		Model: openai.ChatModelGPT5_2,
+	model := req.Model
+	if model == "" {
+		model = DefaultModel
+	}
+
+	usage := Usage{Model: model}
+	start := time.Now()
+	done := func(err error) (Usage, error) {
+		usage.Latency = time.Since(start)
+		return usage, err
+	}
+
+	params := responses.ResponseNewParams{
+		Model: model,
 		Input: responses.ResponseNewParamsInputUnion{
-			OfString: openai.String(query),
+			OfString: openai.String(req.Input),
 		},
-	})
+	}
+	if req.Instructions != "" {
+		params.Instructions = openai.String(req.Instructions)
+	}
+	if req.Tools != nil {
+		params.Tools = req.Tools.params()
+	}
+
+	for round := 1; ; round++ {
+		if req.Tools != nil && round > maxToolRounds {
+			params.ToolChoice = responses.ResponseNewParamsToolChoiceUnion{
+				OfToolChoiceMode: openai.Opt(responses.ToolChoiceOptionsNone),
+			}
+		}
+		resp, err := streamRound(ctx, &client, params, &usage, start, onToken)
+		if err != nil {
+			return done(err)
+		}
+
+		var results responses.ResponseInputParam
+		for _, item := range resp.Output {
+			if item.Type != "function_call" || req.Tools == nil {
+				continue
+			}
+			call := item.AsFunctionCall()
+			usage.ToolCalls++
+			output := req.Tools.call(ctx, call.CallID, call.Name, call.Arguments)
+			results = append(results, responses.ResponseInputItemParamOfFunctionCallOutput(call.CallID, output))
+		}
+		if len(results) == 0 {
+			return done(nil)
+		}
+		if err := ctx.Err(); err != nil {
+			return done(err)
+		}
+
+		// continue the same response with what the tools returned
+		params.PreviousResponseID = openai.String(resp.ID)
+		params.Input = responses.ResponseNewParamsInputUnion{OfInputItemList: results}
+	}
+}
+
+// streamRound streams one model response, passing text deltas to onToken and
+// adding its tokens to usage. A response cut short by cancellation or an error
+// after it started is never counted by the provider, so its tokens are
+// estimated from the prompt and what was streamed before it stopped.
+func streamRound(
+	ctx context.Context,
+	client *openai.Client,
+	params responses.ResponseNewParams,
+	usage *Usage,
+	start time.Time,
+	onToken func(token string),
+) (responses.Response, error) {
+	stream := client.Responses.NewStreaming(ctx, params)
 	defer stream.Close()
 
+	var resp responses.Response
+	var streamed strings.Builder
+	started, counted := false, false
 	for stream.Next() {
 		event := stream.Current()
+		started = true
 
-		if event.Type == "response.output_text.delta" {
+		switch event.Type {
+		case "response.output_text.delta":
+			if usage.TimeToFirstToken == 0 {
+				usage.TimeToFirstToken = time.Since(start)
+			}
+			streamed.WriteString(event.Delta)
 			onToken(event.Delta)
+		case "response.function_call_arguments.delta":
+			streamed.WriteString(event.Delta)
+		case "response.completed", "response.incomplete":
+			resp = event.Response
+			counted = true
+			usage.InputTokens += event.Response.Usage.InputTokens
+			usage.OutputTokens += event.Response.Usage.OutputTokens
 		}
 	}
 
+	// a request refused outright was never run, so costs nothing
+	if (started || ctx.Err() != nil) && !counted {
+		usage.Estimated = true
+		usage.InputTokens += promptTokens(params)
+		usage.OutputTokens += estimateTokens(streamed.String())
+	}
 	if err := stream.Err(); err != nil {
-		return err
+		return resp, err
+	}
+
+	return resp, nil
+}
+
+// promptTokens estimates the tokens of a request's instructions and input.
+// Later tool rounds also bill the context of the responses before them,
+// which this leaves out.
+func promptTokens(params responses.ResponseNewParams) int64 {
+	input := params.Input.OfString.Or("")
+	if len(params.Input.OfInputItemList) > 0 {
+		raw, _ := json.Marshal(params.Input.OfInputItemList)
+		input = string(raw)
 	}
+	return estimateTokens(params.Instructions.Or("")) + estimateTokens(input)
+}
 
-	return nil
+func estimateTokens(s string) int64 {
+	return int64((utf8.RuneCountInString(s) + charsPerToken - 1) / charsPerToken)
 }
@@ -0,0 +1,60 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/openai/openai-go/v3/responses"
+)
+
+// sse writes server-sent events the way the Responses API streams them
+func sse(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, e := range events {
+		fmt.Fprintf(w, "data: %s\n\n", e)
+	}
+}
+
+func TestStreamRoundUsage(t *testing.T) {
+	created := `{"type":"response.created","response":{"id":"resp_1"}}`
+	delta := `{"type":"response.output_text.delta","delta":"twelve chars"}`
+	completed := `{"type":"response.completed","response":{"id":"resp_1","usage":{"input_tokens":30,"output_tokens":7}}}`
+
+	tests := []struct {
+		name      string
+		serve     func(w http.ResponseWriter)
+		wantErr   bool
+		input     int64
+		output    int64
+		estimated bool
+	}{
+		{"completed", func(w http.ResponseWriter) { sse(w, created, delta, completed) }, false, 30, 7, false},
+		// 40 characters of input, 12 streamed
+		{"cut short", func(w http.ResponseWriter) { sse(w, created, delta, delta) }, false, 10, 6, true},
+		{"refused", func(w http.ResponseWriter) { http.Error(w, `{"error":{"message":"bad key"}}`, http.StatusUnauthorized) }, true, 0, 0, false},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { tt.serve(w) }))
+		client := openai.NewClient(option.WithBaseURL(srv.URL), option.WithAPIKey("test"), option.WithMaxRetries(0))
+		params := responses.ResponseNewParams{
+			Model:        DefaultModel,
+			Instructions: openai.String(strings.Repeat("i", 20)),
+			Input:        responses.ResponseNewParamsInputUnion{OfString: openai.String(strings.Repeat("q", 20))},
+		}
+
+		var usage Usage
+		var got strings.Builder
+		_, err := streamRound(context.Background(), &client, params, &usage, time.Now(), func(token string) { got.WriteString(token) })
+		srv.Close()
+		if (err != nil) != tt.wantErr || usage.InputTokens != tt.input || usage.OutputTokens != tt.output || usage.Estimated != tt.estimated {
+			t.Errorf("%s: usage %+v, error %v", tt.name, usage, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package llm
+
+import (
+	"butter-socket/internal/logging"
+	"butter-socket/internal/metrics"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// call runs one tool call the model asked for and returns what the model is
+// told. Failures are reported to the model as {"error": "..."} so it can
+// explain or retry instead of the reply failing.
+func (b *Toolbox) call(ctx context.Context, callID, name, arguments string) string {
+	rec := ToolCall{
+		ID:             uuid.New().String(),
+		CompanyID:      b.companyID,
+		ConversationID: b.conversationID,
+		Tool:           name,
+		Arguments:      rawArguments(arguments),
+		CreatedAt:      time.Now().UTC(),
+	}
+	start := time.Now()
+	output, err := b.run(ctx, &rec, arguments)
+	rec.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		rec.Error = err.Error()
+		output = toolError(err)
+	}
+	rec.OutputBytes = len(output)
+
+	b.registry.audit(rec)
+	metrics.ToolCalls.WithLabelValues(rec.Result).Inc()
+	level := slog.LevelInfo
+	if rec.Result != ToolOK {
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "tool call",
+		logging.KeyEvent, "tool_call",
+		logging.KeyCompany, b.companyID,
+		logging.KeyConversation, b.conversationID,
+		"tool", name,
+		"call_id", callID,
+		"result", rec.Result,
+		"status_code", rec.StatusCode,
+		"duration_ms", rec.DurationMS,
+		"error", rec.Error)
+	return output
+}
+
+// run validates the arguments and POSTs them to the tool, filling in rec
+func (b *Toolbox) run(ctx context.Context, rec *ToolCall, arguments string) (string, error) {
+	t, ok := b.tools[rec.Tool]
+	if !ok {
+		rec.Result = ToolUnknown
+		return "", fmt.Errorf("%w: %s", ErrToolNotFound, rec.Tool)
+	}
+	rec.ToolID = t.ID
+
+	var args any
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		rec.Result = ToolInvalid
+		return "", fmt.Errorf("arguments are not JSON: %v", err)
+	}
+	if err := validate(t.Parameters, args, "arguments"); err != nil {
+		rec.Result = ToolInvalid
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader([]byte(arguments)))
+	if err != nil {
+		rec.Result = ToolFailed
+		return "", err
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "butter-socket-tools")
+	req.Header.Set("X-Butter-Conversation", b.conversationID)
+	req.Header.Set("X-Butter-Tool-Call", rec.ID)
+
+	resp, err := b.registry.client.Do(req)
+	if err != nil {
+		rec.Result = ToolFailed
+		return "", err
+	}
+	defer resp.Body.Close()
+	rec.StatusCode = resp.StatusCode
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxToolOutput+1))
+	if err != nil {
+		rec.Result = ToolFailed
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		rec.Result = ToolFailed
+		return "", fmt.Errorf("tool answered %s", resp.Status)
+	}
+
+	rec.Result = ToolOK
+	if len(body) > maxToolOutput {
+		return string(body[:maxToolOutput]) + "\n[truncated]", nil
+	}
+	return string(body), nil
+}
+
+// rawArguments keeps the model's arguments as JSON in the audit log, quoting
+// them when they aren't
+func rawArguments(arguments string) json.RawMessage {
+	if json.Valid([]byte(arguments)) {
+		return json.RawMessage(arguments)
+	}
+	quoted, _ := json.Marshal(arguments)
+	return quoted
+}
+
+func toolError(err error) string {
+	out, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(out)
+}
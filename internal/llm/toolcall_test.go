@@ -0,0 +1,96 @@
+package llm
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToolboxCall(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Butter-Conversation") != "conv-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "X") {
+			http.Error(w, `{"error":"order not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status":"shipped"}`))
+	}))
+	defer srv.Close()
+
+	r := NewToolRegistry(true)
+	_, err := r.Register(Tool{
+		CompanyID:   "acme",
+		Name:        "lookup_order",
+		Description: "Look up an order",
+		Parameters: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"order_id": map[string]any{"type": "string"}},
+			"required":   []any{"order_id"},
+		},
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := r.For("acme", "conv-1")
+
+	tests := []struct {
+		name       string
+		tool, args string
+		result     string
+		output     string
+	}{
+		{"ok", "lookup_order", `{"order_id":"10452"}`, ToolOK, `{"status":"shipped"}`},
+		{"not JSON", "lookup_order", `order 10452`, ToolInvalid, `{"error":"arguments are not JSON`},
+		{"fails the schema", "lookup_order", `{"order":"10452"}`, ToolInvalid, `{"error":"arguments.order_id is required"}`},
+		{"tool errors", "lookup_order", `{"order_id":"X1"}`, ToolFailed, `{"error":"tool answered 404 Not Found"}`},
+		{"unknown tool", "cancel_order", `{}`, ToolUnknown, `{"error":"tool not found: cancel_order"}`},
+	}
+	for _, tt := range tests {
+		output := box.call(context.Background(), "call-"+tt.name, tt.tool, tt.args)
+		if !strings.HasPrefix(output, tt.output) {
+			t.Errorf("%s: output %s, want %s", tt.name, output, tt.output)
+		}
+		if calls := r.Calls("acme"); len(calls) == 0 || calls[0].Result != tt.result || calls[0].ConversationID != "conv-1" {
+			t.Errorf("%s: audit %+v, want result %s", tt.name, calls, tt.result)
+		}
+	}
+	if r.For("other", "conv-2") != nil {
+		t.Error("another company got acme's tools")
+	}
+}
+
+func TestRegisterRejects(t *testing.T) {
+	valid := Tool{CompanyID: "acme", Name: "lookup_order", Description: "Look up an order", URL: "https://tools.example.com/lookup"}
+	tests := []struct {
+		name string
+		edit func(*Tool)
+	}{
+		{"no company", func(t *Tool) { t.CompanyID = "" }},
+		{"bad name", func(t *Tool) { t.Name = "look up" }},
+		{"no description", func(t *Tool) { t.Description = "" }},
+		{"plain http", func(t *Tool) { t.URL = "http://tools.example.com/lookup" }},
+		{"relative url", func(t *Tool) { t.URL = "/lookup" }},
+		{"long timeout", func(t *Tool) { t.TimeoutMS = 60000 }},
+		{"array root", func(t *Tool) { t.Parameters = map[string]any{"type": "array"} }},
+	}
+	r := NewToolRegistry(true)
+	if _, err := r.Register(valid); err != nil {
+		t.Fatalf("valid tool rejected: %v", err)
+	}
+	for _, tt := range tests {
+		tool := valid
+		tt.edit(&tool)
+		if _, err := r.Register(tool); err == nil {
+			t.Errorf("%s: registered", tt.name)
+		}
+	}
+}
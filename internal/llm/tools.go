@@ -0,0 +1,307 @@
+package llm
+
+import (
+	"butter-socket/internal/logging"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/responses"
+)
+
+const (
+	// Timeout for a tool that doesn't set one, and the most any tool may ask for
+	defaultToolTimeout = 10 * time.Second
+	maxToolTimeout     = 30 * time.Second
+
+	// Bytes of a tool's response passed back to the model
+	maxToolOutput = 16 << 10
+
+	// Tool calls kept per company for inspection
+	toolAuditSize = 1000
+)
+
+// Tool call results, as audited
+const (
+	ToolOK      = "ok"
+	ToolInvalid = "invalid" // -> the model sent arguments that don't match the schema
+	ToolFailed  = "failed"  // -> the tool's endpoint errored or timed out
+	ToolUnknown = "unknown" // -> the model named a tool the company doesn't have
+)
+
+var (
+	ErrToolNotFound = errors.New("tool not found")
+	ErrInvalidTool  = errors.New("invalid tool")
+)
+
+// toolName is what the provider accepts as a function name
+var toolName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// Tool is a company's HTTP endpoint the AI may call while answering, e.g. an
+// order status lookup. The model's arguments are POSTed to URL as JSON and
+// the response body is handed back to the model.
+type Tool struct {
+	ID          string            `json:"id"`
+	CompanyID   string            `json:"company_id"`
+	Name        string            `json:"name"` // -> what the model calls, e.g. lookup_order
+	Description string            `json:"description"`
+	Parameters  map[string]any    `json:"parameters,omitempty"` // -> JSON schema of the arguments object
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"` // -> e.g. Authorization; values are hidden when listed
+	TimeoutMS   int64             `json:"timeout_ms,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// timeout is how long one call of the tool may take
+func (t Tool) timeout() time.Duration {
+	if t.TimeoutMS <= 0 {
+		return defaultToolTimeout
+	}
+	return min(time.Duration(t.TimeoutMS)*time.Millisecond, maxToolTimeout)
+}
+
+// ToolCall is the audit record of one tool call made by the AI
+type ToolCall struct {
+	ID             string          `json:"id"`
+	CompanyID      string          `json:"company_id"`
+	ConversationID string          `json:"conversation_id"`
+	ToolID         string          `json:"tool_id,omitempty"`
+	Tool           string          `json:"tool"`
+	Arguments      json.RawMessage `json:"arguments"`
+	Result         string          `json:"result"`
+	StatusCode     int             `json:"status_code,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	OutputBytes    int             `json:"output_bytes"`
+	DurationMS     int64           `json:"duration_ms"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// ToolRegistry keeps each company's tools and the audit log of their calls
+type ToolRegistry struct {
+	client        *http.Client
+	allowInsecure bool
+
+	mu    sync.RWMutex
+	tools map[string]map[string]Tool // -> company ID, tool name
+	calls map[string][]ToolCall      // -> company ID, oldest first, at most toolAuditSize
+}
+
+// NewToolRegistry creates an empty registry. allowInsecure also accepts plain
+// http URLs on loopback hosts, for local stand-ins.
+func NewToolRegistry(allowInsecure bool) *ToolRegistry {
+	return &ToolRegistry{
+		client: &http.Client{
+			// a redirect could carry the auth headers somewhere unexpected
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		allowInsecure: allowInsecure,
+		tools:         make(map[string]map[string]Tool),
+		calls:         make(map[string][]ToolCall),
+	}
+}
+
+// Register validates t and makes it available to the company's AI replies,
+// replacing the company's tool of the same name
+func (r *ToolRegistry) Register(t Tool) (Tool, error) {
+	if t.CompanyID == "" {
+		return Tool{}, fmt.Errorf("%w: company_id is required", ErrInvalidTool)
+	}
+	if !toolName.MatchString(t.Name) {
+		return Tool{}, fmt.Errorf("%w: name must be 1-64 letters, digits, _ or -", ErrInvalidTool)
+	}
+	if t.Description == "" {
+		return Tool{}, fmt.Errorf("%w: description is required so the model knows when to call it", ErrInvalidTool)
+	}
+	if err := r.checkURL(t.URL); err != nil {
+		return Tool{}, err
+	}
+	if t.TimeoutMS < 0 || time.Duration(t.TimeoutMS)*time.Millisecond > maxToolTimeout {
+		return Tool{}, fmt.Errorf("%w: timeout_ms must be at most %d", ErrInvalidTool, maxToolTimeout.Milliseconds())
+	}
+	if t.Parameters == nil {
+		t.Parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	if err := checkSchema(t.Parameters); err != nil {
+		return Tool{}, fmt.Errorf("%w: parameters: %v", ErrInvalidTool, err)
+	}
+	t.ID = uuid.New().String()
+	t.CreatedAt = time.Now().UTC()
+
+	r.mu.Lock()
+	company := r.tools[t.CompanyID]
+	if company == nil {
+		company = make(map[string]Tool)
+		r.tools[t.CompanyID] = company
+	}
+	company[t.Name] = t
+	r.mu.Unlock()
+
+	slog.Info("tool registered", logging.KeyCompany, t.CompanyID, "tool_id", t.ID, "tool", t.Name, "url", t.URL)
+	return t, nil
+}
+
+func (r *ToolRegistry) checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: url must be absolute", ErrInvalidTool)
+	}
+	switch {
+	case u.Scheme == "https":
+		return nil
+	case u.Scheme == "http" && r.allowInsecure && isLoopback(u.Hostname()):
+		return nil
+	}
+	return fmt.Errorf("%w: url must be https", ErrInvalidTool)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Remove unregisters a tool; replies already streaming may still call it
+func (r *ToolRegistry) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for companyID, company := range r.tools {
+		for name, t := range company {
+			if t.ID != id {
+				continue
+			}
+			delete(company, name)
+			if len(company) == 0 {
+				delete(r.tools, companyID)
+			}
+			return nil
+		}
+	}
+	return ErrToolNotFound
+}
+
+// Tools lists a company's tools by name, with header values hidden
+func (r *ToolRegistry) Tools(companyID string) []Tool {
+	r.mu.RLock()
+	out := make([]Tool, 0, len(r.tools[companyID]))
+	for _, t := range r.tools[companyID] {
+		if len(t.Headers) > 0 {
+			hidden := make(map[string]string, len(t.Headers))
+			for k := range t.Headers {
+				hidden[k] = "********"
+			}
+			t.Headers = hidden
+		}
+		out = append(out, t)
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(out, func(a, b Tool) int { return cmp.Compare(a.Name, b.Name) })
+	return out
+}
+
+// Calls returns a company's tool call audit log, newest first
+func (r *ToolRegistry) Calls(companyID string) []ToolCall {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	log := r.calls[companyID]
+	out := make([]ToolCall, len(log))
+	for i, c := range log {
+		out[len(log)-1-i] = c
+	}
+	return out
+}
+
+// audit records a finished tool call
+func (r *ToolRegistry) audit(c ToolCall) {
+	r.mu.Lock()
+	log := append(r.calls[c.CompanyID], c)
+	if len(log) > toolAuditSize {
+		log = slices.Delete(log, 0, len(log)-toolAuditSize)
+	}
+	r.calls[c.CompanyID] = log
+	r.mu.Unlock()
+}
+
+// LoadFile registers the tools listed in a JSON file, an array of Tool. An
+// empty path registers nothing.
+func (r *ToolRegistry) LoadFile(path string) (int, error) {
+	if path == "" {
+		return 0, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var tools []Tool
+	if err := json.Unmarshal(data, &tools); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, t := range tools {
+		if _, err := r.Register(t); err != nil {
+			return i, fmt.Errorf("%s: tool %q: %w", path, t.Name, err)
+		}
+	}
+	return len(tools), nil
+}
+
+// For returns the tools one conversation's AI replies may call, or nil when
+// the company has none
+func (r *ToolRegistry) For(companyID, conversationID string) *Toolbox {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	company := r.tools[companyID]
+	if len(company) == 0 {
+		return nil
+	}
+	box := &Toolbox{
+		registry:       r,
+		companyID:      companyID,
+		conversationID: conversationID,
+		tools:          make(map[string]Tool, len(company)),
+	}
+	for name, t := range company {
+		box.tools[name] = t
+	}
+	return box
+}
+
+// Toolbox is a snapshot of a company's tools, bound to the conversation that
+// tool calls are audited against
+type Toolbox struct {
+	registry       *ToolRegistry
+	companyID      string
+	conversationID string
+	tools          map[string]Tool
+}
+
+// params describes the tools to the provider
+func (b *Toolbox) params() []responses.ToolUnionParam {
+	names := make([]string, 0, len(b.tools))
+	for name := range b.tools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	out := make([]responses.ToolUnionParam, 0, len(names))
+	for _, name := range names {
+		t := b.tools[name]
+		// company schemas rarely meet strict mode's rules; we validate ourselves
+		p := responses.ToolParamOfFunction(t.Name, t.Parameters, false)
+		p.OfFunction.Description = openai.String(t.Description)
+		out = append(out, p)
+	}
+	return out
+}
@@ -0,0 +1,179 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// checkSchema accepts a tool's parameter schema: a JSON schema whose root is
+// an object, using the keywords validate understands
+func checkSchema(schema map[string]any) error {
+	if schema["type"] != "object" {
+		return errors.New(`root must have "type": "object"`)
+	}
+	return checkNode(schema, "parameters")
+}
+
+func checkNode(node map[string]any, path string) error {
+	switch t := node["type"].(type) {
+	case nil:
+	case string:
+		if !knownType(t) {
+			return fmt.Errorf("%s: unknown type %q", path, t)
+		}
+	case []any:
+		for _, v := range t {
+			if s, ok := v.(string); !ok || !knownType(s) {
+				return fmt.Errorf("%s: unknown type %v", path, v)
+			}
+		}
+	default:
+		return fmt.Errorf("%s: type must be a string or list", path)
+	}
+
+	if props, ok := node["properties"]; ok {
+		m, ok := props.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: properties must be an object", path)
+		}
+		for name, sub := range m {
+			s, ok := sub.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s.%s: schema must be an object", path, name)
+			}
+			if err := checkNode(s, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	if req, ok := node["required"]; ok {
+		list, ok := req.([]any)
+		if !ok {
+			return fmt.Errorf("%s: required must be a list of names", path)
+		}
+		for _, v := range list {
+			if _, ok := v.(string); !ok {
+				return fmt.Errorf("%s: required must be a list of names", path)
+			}
+		}
+	}
+	if enum, ok := node["enum"]; ok {
+		if _, ok := enum.([]any); !ok {
+			return fmt.Errorf("%s: enum must be a list", path)
+		}
+	}
+	if items, ok := node["items"]; ok {
+		s, ok := items.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: items must be a schema", path)
+		}
+		if err := checkNode(s, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func knownType(t string) bool {
+	switch t {
+	case "object", "array", "string", "number", "integer", "boolean", "null":
+		return true
+	}
+	return false
+}
+
+// validate checks a decoded JSON value against a schema node, covering type,
+// properties, required, additionalProperties: false, enum and items
+func validate(schema any, v any, path string) error {
+	node, ok := schema.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	if t, ok := node["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []any:
+			for _, x := range t {
+				if s, ok := x.(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+		if !slices.ContainsFunc(types, func(t string) bool { return hasType(v, t) }) {
+			return fmt.Errorf("%s must be %s", path, strings.Join(types, " or "))
+		}
+	}
+
+	if enum, ok := node["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return equalJSON(e, v) }) {
+		return fmt.Errorf("%s must be one of %v", path, enum)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		props, _ := node["properties"].(map[string]any)
+		if req, ok := node["required"].([]any); ok {
+			for _, name := range req {
+				if s, ok := name.(string); ok {
+					if _, present := v[s]; !present {
+						return fmt.Errorf("%s.%s is required", path, s)
+					}
+				}
+			}
+		}
+		for name, value := range v {
+			sub, known := props[name]
+			if !known {
+				if node["additionalProperties"] == false {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := validate(sub, value, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if items, ok := node["items"]; ok {
+			for i, item := range v {
+				if err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasType reports whether a decoded JSON value is of a JSON schema type
+func hasType(v any, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || (t == "integer" && v == math.Trunc(v))
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	}
+	return false
+}
+
+// equalJSON compares scalar JSON values, which is all enums hold in practice
+func equalJSON(a, b any) bool {
+	switch a.(type) {
+	case nil, bool, string, float64:
+		return a == b
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
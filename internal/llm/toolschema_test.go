@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func schema(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var out map[string]any
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCheckSchema(t *testing.T) {
+	tests := []struct {
+		schema  string
+		wantErr string
+	}{
+		{`{"type":"object","properties":{"id":{"type":"string"}},"required":["id"]}`, ""},
+		{`{"type":"object","properties":{"tags":{"type":"array","items":{"type":["string","null"]}}}}`, ""},
+		{`{"type":"array"}`, `root must have "type": "object"`},
+		{`{"type":"object","properties":{"id":{"type":"uuid"}}}`, `parameters.id: unknown type "uuid"`},
+		{`{"type":"object","properties":{"id":"string"}}`, "parameters.id: schema must be an object"},
+		{`{"type":"object","required":"id"}`, "parameters: required must be a list of names"},
+		{`{"type":"object","properties":{"s":{"enum":"a"}}}`, "parameters.s: enum must be a list"},
+		{`{"type":"object","properties":{"l":{"type":"array","items":{"type":"date"}}}}`, `parameters.l[]: unknown type "date"`},
+	}
+	for _, tt := range tests {
+		err := checkSchema(schema(t, tt.schema))
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkSchema(%s) = %v, want %q", tt.schema, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	params := schema(t, `{
+		"type": "object",
+		"properties": {
+			"order_id": {"type": "string"},
+			"quantity": {"type": "integer"},
+			"reason":   {"type": "string", "enum": ["changed_mind", "other"]},
+			"items":    {"type": "array", "items": {"type": "string"}}
+		},
+		"required": ["order_id"],
+		"additionalProperties": false
+	}`)
+
+	tests := []struct {
+		args    string
+		wantErr string
+	}{
+		{`{"order_id":"10452"}`, ""},
+		{`{"order_id":"10452","quantity":2,"reason":"other","items":["a","b"]}`, ""},
+		{`{}`, "arguments.order_id is required"},
+		{`{"order_id":10452}`, "arguments.order_id must be string"},
+		{`{"order_id":"1","quantity":1.5}`, "arguments.quantity must be integer"},
+		{`{"order_id":"1","reason":"bored"}`, "arguments.reason must be one of"},
+		{`{"order_id":"1","items":["a",2]}`, "arguments.items[1] must be string"},
+		{`{"order_id":"1","coupon":"FREE"}`, "arguments.coupon is not allowed"},
+		{`["10452"]`, "arguments must be object"},
+	}
+	for _, tt := range tests {
+		var args any
+		json.Unmarshal([]byte(tt.args), &args)
+		err := validate(params, args, "arguments")
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+			t.Errorf("validate(%s) = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Package logging configures the process wide structured logger.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attribute keys shared by every log line that concerns a connection
+const (
+	KeyConnID       = "conn_id"
+	KeyClientType   = "client_type"
+	KeyCompany      = "company_id"
+	KeyConversation = "conversation_id"
+	KeyCustomer     = "customer_id"
+	KeyUser         = "user_id"
+	KeyEvent        = "event"
+)
+
+// Config selects the log level and output format
+type Config struct {
+	Level string // debug, info, warn or error
+	JSON  bool
+}
+
+// ConfigFromEnv reads LOG_LEVEL and LOG_FORMAT (text or json)
+func ConfigFromEnv() Config {
+	return Config{
+		Level: os.Getenv("LOG_LEVEL"),
+		JSON:  strings.EqualFold(os.Getenv("LOG_FORMAT"), "json"),
+	}
+}
+
+// Setup builds the logger described by cfg and installs it as the slog default.
+// The standard library log package is routed through it as well.
+func Setup(cfg Config, w io.Writer) (*slog.Logger, error) {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if cfg.JSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+
+	logger := slog.New(h)
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Labels stay within values the server defines. Company IDs customers send
+// are unchecked, so the only metric labelled by company is
+// butter_company_connected_clients, and only with companies the auth
+// service vouched for by logging an agent in.
+var (
+	// ConnectedClients counts live sockets by client type (customer/user)
+	ConnectedClients = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "butter_connected_clients",
+		Help: "Currently connected WebSocket clients.",
+	}, []string{"type"})
+
+	// companyConnected is served by WatchCompanies
+	companyConnected = prometheus.NewDesc(
+		"butter_company_connected_clients",
+		"Currently connected WebSocket clients by company and type (customer/user). Companies without an agent online are summed as \"other\".",
+		[]string{"company", "type"}, nil)
+
+	// EventsIn counts WebSocket events received from clients
+	EventsIn = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_ws_events_in_total",
+		Help: "WebSocket events received from clients.",
+	}, []string{"type"})
+
+	// EventsRejected counts WebSocket events dropped before reaching their handler
+	EventsRejected = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_ws_events_rejected_total",
+		Help: "WebSocket events rejected before their handler, by type and reason (forbidden, rate_limited, invalid).",
+	}, []string{"type", "reason"})
+
+	// EventsOut counts WebSocket events queued for clients
+	EventsOut = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_ws_events_out_total",
+		Help: "WebSocket events queued for clients.",
+	}, []string{"type"})
+
+	// DroppedMessages counts events lost because a client's Send queue was full
+	DroppedMessages = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_ws_dropped_messages_total",
+		Help: "Events dropped because the client send queue was full.",
+	}, []string{"type"})
+
+	// SendQueueActions counts what send policies did with full client queues
+	SendQueueActions = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_ws_send_queue_actions_total",
+		Help: "Send policy actions on full client queues, by policy and action (blocked, timed_out, evicted_oldest, evicted_non_critical, rejected, disconnected).",
+	}, []string{"policy", "action"})
+
+	// BroadcastRecipients counts broadcast recipients by final delivery state
+	BroadcastRecipients = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_broadcast_recipients_total",
+		Help: "Broadcast recipients by delivery state (delivered, delayed, missed, gone).",
+	}, []string{"state"})
+
+	// LLMStreamSeconds measures full AI reply duration
+	LLMStreamSeconds = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "butter_llm_stream_seconds",
+		Help: "Duration of a streamed AI reply.",
+	}, []string{"model"})
+
+	// LLMTimeToFirstToken measures how long customers wait for the first token
+	LLMTimeToFirstToken = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "butter_llm_time_to_first_token_seconds",
+		Help: "Time from request to the first streamed AI token.",
+	}, []string{"model"})
+
+	// TransferWaitSeconds measures how long a customer waits for a human to accept
+	TransferWaitSeconds = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "butter_transfer_wait_seconds",
+		Help:    "Time between transfer_chat and a human accepting the chat.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	})
+
+	// AuthFailures counts rejected connection attempts
+	AuthFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_auth_failures_total",
+		Help: "Rejected WebSocket connection attempts.",
+	}, []string{"endpoint", "reason"})
+
+	// Commands counts backend commands consumed from the broker by outcome
+	Commands = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_commands_total",
+		Help: "Backend commands consumed, by type and result (ok, invalid, failed).",
+	}, []string{"type", "result"})
+
+	// BusDropped counts envelopes dropped because the bus queue was full
+	BusDropped = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_bus_dropped_total",
+		Help: "Envelopes for other nodes dropped because the bus queue was full, by kind.",
+	}, []string{"kind"})
+
+	// PresenceDropped counts connection changes never written to the presence registry
+	PresenceDropped = factory.NewCounter(prometheus.CounterOpts{
+		Name: "butter_presence_dropped_total",
+		Help: "Presence registry updates dropped because the registry fell behind.",
+	})
+
+	// OutboxRelays counts outbox entries relayed to the broker
+	OutboxRelays = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_outbox_relays_total",
+		Help: "Outbox relay attempts, by event type and result (sent, failed).",
+	}, []string{"type", "result"})
+
+	// WebhookDeliveries counts finished webhook deliveries by state
+	WebhookDeliveries = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_webhook_deliveries_total",
+		Help: "Webhook deliveries by final state (succeeded, failed, dropped).",
+	}, []string{"state"})
+
+	// ToolCalls counts tool calls made by the AI by result
+	ToolCalls = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_tool_calls_total",
+		Help: "AI tool calls by result (ok, invalid, failed, unknown).",
+	}, []string{"result"})
+
+	// ModerationFindings counts moderated content by kind and the action taken
+	ModerationFindings = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "butter_moderation_findings_total",
+		Help: "Content found by moderation, by kind (profanity, abuse, card, email, phone) and action (flag, mask, block).",
+	}, []string{"kind", "action"})
+)
@@ -0,0 +1,77 @@
+// Package metrics defines the Prometheus metrics of the socket server.
+package metrics
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every metric served on /metrics, with the Go runtime and
+// process metrics
+var Registry = prometheus.NewRegistry()
+
+// factory registers the server's metrics in Registry
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// CompanyConnections is how many clients of one company are connected
+type CompanyConnections struct {
+	CompanyID string
+	Customers int
+	Users     int
+}
+
+// companyCollector reads connection counts when scraped, so a company's
+// series go away with its last connection
+type companyCollector struct {
+	list func() []CompanyConnections
+}
+
+func (c companyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- companyConnected
+}
+
+func (c companyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, cc := range c.list() {
+		ch <- prometheus.MustNewConstMetric(companyConnected, prometheus.GaugeValue, float64(cc.Customers), cc.CompanyID, "customer")
+		ch <- prometheus.MustNewConstMetric(companyConnected, prometheus.GaugeValue, float64(cc.Users), cc.CompanyID, "user")
+	}
+}
+
+// WatchCompanies serves butter_company_connected_clients from list, which is
+// called on every scrape
+func WatchCompanies(list func() []CompanyConnections) {
+	Registry.MustRegister(companyCollector{list: list})
+}
+
+// Handler serves Registry. With a token set, scrapers must send
+// "Authorization: Bearer <token>".
+func Handler(token string) http.Handler {
+	scrape := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return scrape
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			AuthFailures.WithLabelValues("metrics", "unauthorized").Inc()
+			slog.Warn("metrics scrape rejected", "remote_addr", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		scrape.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	WatchCompanies(func() []CompanyConnections {
+		return []CompanyConnections{{CompanyID: "acme", Customers: 3, Users: 1}}
+	})
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{"open without a token", "", "", http.StatusOK},
+		{"right token", "s3cret", "Bearer s3cret", http.StatusOK},
+		{"wrong token", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"no token sent", "s3cret", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		Handler(tt.token).ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		body, _ := io.ReadAll(rec.Body)
+		if tt.status == http.StatusOK && !strings.Contains(string(body), `butter_company_connected_clients{company="acme",type="customer"} 3`) {
+			t.Errorf("%s: no per company gauge in\n%s", tt.name, body)
+		}
+	}
+}
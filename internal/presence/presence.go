@@ -0,0 +1,179 @@
+// Package presence records which node holds which customer and user connection.
+package presence
+
+import (
+	"butter-socket/models"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long a node stays alive without a heartbeat
+const DefaultTTL = 30 * time.Second
+
+// purgeAfter is how many TTLs a dead node stays listed, so every node sees it
+// dead and drops its clients before its record goes
+const purgeAfter = 10
+
+// Entry is one live connection
+type Entry struct {
+	ConnID         string           `json:"conn_id"`
+	Node           string           `json:"node"`
+	ClientType     string           `json:"client_type"` // customer or user
+	ClientID       string           `json:"client_id"`   // customer ID or user ID
+	CompanyID      string           `json:"company_id"`
+	ConversationID string           `json:"conversation_id,omitempty"`
+	Customer       *models.Customer `json:"customer,omitempty"`
+	User           *models.User     `json:"user,omitempty"`
+	ConnectedAt    time.Time        `json:"connected_at"`
+}
+
+// Node is a server instance as seen through its heartbeats
+type Node struct {
+	ID       string    `json:"id"`
+	LastSeen time.Time `json:"last_seen"`
+	Alive    bool      `json:"alive"`
+}
+
+// Registry is the shared view of connections across nodes. Entries only
+// count while their node heartbeats; once a node misses the TTL its entries
+// are treated as gone.
+type Registry interface {
+	// Register records a connection, replacing any older one for the same client
+	Register(ctx context.Context, e Entry) error
+	// Unregister removes e, unless the client has since reconnected elsewhere
+	Unregister(ctx context.Context, e Entry) error
+	// Lookup finds the live connection of a customer or user
+	Lookup(ctx context.Context, clientType, clientID string) (Entry, bool, error)
+	// List returns the live connections of a company; empty clientType lists both kinds
+	List(ctx context.Context, companyID, clientType string) ([]Entry, error)
+	// Heartbeat marks node alive
+	Heartbeat(ctx context.Context, node string) error
+	// Nodes lists every node the registry has heard from
+	Nodes(ctx context.Context) ([]Node, error)
+	// Expire drops the entries of dead nodes and returns how many were
+	// removed. Nodes dead for purgeAfter TTLs are forgotten.
+	Expire(ctx context.Context) (int, error)
+}
+
+func entryKey(clientType, clientID string) string {
+	return clientType + "/" + clientID
+}
+
+// Memory is a Registry for a single process
+type Memory struct {
+	ttl time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]Entry
+	nodes   map[string]time.Time
+}
+
+// NewMemory creates an in-memory registry. ttl <= 0 uses DefaultTTL.
+func NewMemory(ttl time.Duration) *Memory {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Memory{
+		ttl:     ttl,
+		entries: make(map[string]Entry),
+		nodes:   make(map[string]time.Time),
+	}
+}
+
+func (m *Memory) Register(ctx context.Context, e Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e.ConnectedAt.IsZero() {
+		e.ConnectedAt = time.Now()
+	}
+	m.entries[entryKey(e.ClientType, e.ClientID)] = e
+	return nil
+}
+
+func (m *Memory) Unregister(ctx context.Context, e Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := entryKey(e.ClientType, e.ClientID)
+	if current, ok := m.entries[key]; ok && current.ConnID == e.ConnID {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *Memory) Lookup(ctx context.Context, clientType, clientID string) (Entry, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.entries[entryKey(clientType, clientID)]
+	if !ok || !m.aliveLocked(e.Node) {
+		return Entry{}, false, nil
+	}
+	return e, true, nil
+}
+
+func (m *Memory) List(ctx context.Context, companyID, clientType string) ([]Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Entry
+	for _, e := range m.entries {
+		if e.CompanyID != companyID || (clientType != "" && e.ClientType != clientType) {
+			continue
+		}
+		if m.aliveLocked(e.Node) {
+			out = append(out, e)
+		}
+	}
+	sortEntries(out)
+	return out, nil
+}
+
+func (m *Memory) Heartbeat(ctx context.Context, node string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes[node] = time.Now()
+	return nil
+}
+
+func (m *Memory) Nodes(ctx context.Context) ([]Node, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]Node, 0, len(m.nodes))
+	for id, seen := range m.nodes {
+		out = append(out, Node{ID: id, LastSeen: seen, Alive: m.aliveLocked(id)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (m *Memory) Expire(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for key, e := range m.entries {
+		if !m.aliveLocked(e.Node) {
+			delete(m.entries, key)
+			removed++
+		}
+	}
+	for node, seen := range m.nodes {
+		if time.Since(seen) >= purgeAfter*m.ttl {
+			delete(m.nodes, node)
+		}
+	}
+	return removed, nil
+}
+
+func (m *Memory) aliveLocked(node string) bool {
+	seen, ok := m.nodes[node]
+	return ok && time.Now().Sub(seen) < m.ttl
+}
+
+func sortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ClientType != entries[j].ClientType {
+			return entries[i].ClientType < entries[j].ClientType
+		}
+		return entries[i].ClientID < entries[j].ClientID
+	})
+}
@@ -0,0 +1,83 @@
+package presence
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const testTTL = 50 * time.Millisecond
+
+// registries runs a test against every Registry implementation
+func registries(t *testing.T, test func(t *testing.T, r Registry)) {
+	t.Helper()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, r := range map[string]Registry{
+		"memory": NewMemory(testTTL),
+		"store":  NewStoreRegistry(store, testTTL),
+	} {
+		t.Run(name, func(t *testing.T) { test(t, r) })
+	}
+}
+
+func TestRegisterLookup(t *testing.T) {
+	registries(t, func(t *testing.T, r Registry) {
+		ctx := context.Background()
+		r.Heartbeat(ctx, "node-a")
+		r.Heartbeat(ctx, "node-b")
+		first := Entry{ConnID: "c1", Node: "node-a", ClientType: "customer", ClientID: "cust-1", CompanyID: "acme"}
+		moved := Entry{ConnID: "c2", Node: "node-b", ClientType: "customer", ClientID: "cust-1", CompanyID: "acme"}
+		r.Register(ctx, first)
+		r.Register(ctx, moved)
+
+		tests := []struct {
+			name   string
+			action func()
+			found  bool
+			node   string
+		}{
+			{"newest connection wins", func() {}, true, "node-b"},
+			{"stale unregister keeps it", func() { r.Unregister(ctx, first) }, true, "node-b"},
+			{"own unregister removes it", func() { r.Unregister(ctx, moved) }, false, ""},
+		}
+		for _, tt := range tests {
+			tt.action()
+			e, ok, err := r.Lookup(ctx, "customer", "cust-1")
+			if err != nil || ok != tt.found || e.Node != tt.node {
+				t.Errorf("%s: Lookup = %+v, %v, %v", tt.name, e, ok, err)
+			}
+		}
+	})
+}
+
+func TestExpire(t *testing.T) {
+	registries(t, func(t *testing.T, r Registry) {
+		ctx := context.Background()
+		r.Heartbeat(ctx, "dead")
+		r.Register(ctx, Entry{ConnID: "c1", Node: "dead", ClientType: "user", ClientID: "u1", CompanyID: "acme"})
+		time.Sleep(testTTL)
+		r.Heartbeat(ctx, "live")
+		r.Register(ctx, Entry{ConnID: "c2", Node: "live", ClientType: "user", ClientID: "u2", CompanyID: "acme"})
+
+		if entries, _ := r.List(ctx, "acme", "user"); len(entries) != 1 || entries[0].ClientID != "u2" {
+			t.Errorf("List = %+v, want only the live node's user", entries)
+		}
+		if removed, err := r.Expire(ctx); err != nil || removed != 1 {
+			t.Errorf("Expire = %d, %v, want 1", removed, err)
+		}
+		if nodes, _ := r.Nodes(ctx); len(nodes) != 2 || nodes[0].Alive || !nodes[1].Alive {
+			t.Errorf("Nodes = %+v, want dead still listed next to live", nodes)
+		}
+
+		// long dead nodes are forgotten
+		time.Sleep(purgeAfter * testTTL)
+		r.Heartbeat(ctx, "live")
+		r.Expire(ctx)
+		if nodes, _ := r.Nodes(ctx); len(nodes) != 1 || nodes[0].ID != "live" {
+			t.Errorf("Nodes = %+v, want only live", nodes)
+		}
+	})
+}
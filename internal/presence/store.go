@@ -0,0 +1,227 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store is the minimal key/value API a shared registry needs, the shape of
+// a Redis or etcd client
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+	Keys(ctx context.Context, prefix string) ([]string, error)
+}
+
+const (
+	connPrefix = "presence/conn/"
+	nodePrefix = "presence/node/"
+)
+
+// StoreRegistry is a Registry shared by every node through a Store
+type StoreRegistry struct {
+	store Store
+	ttl   time.Duration
+}
+
+// NewStoreRegistry creates a registry on top of store. ttl <= 0 uses DefaultTTL.
+func NewStoreRegistry(store Store, ttl time.Duration) *StoreRegistry {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &StoreRegistry{store: store, ttl: ttl}
+}
+
+func (r *StoreRegistry) Register(ctx context.Context, e Entry) error {
+	if e.ConnectedAt.IsZero() {
+		e.ConnectedAt = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return r.store.Set(ctx, connPrefix+entryKey(e.ClientType, e.ClientID), data)
+}
+
+// Unregister is a read-then-delete; a store with transactions would do it atomically
+func (r *StoreRegistry) Unregister(ctx context.Context, e Entry) error {
+	key := connPrefix + entryKey(e.ClientType, e.ClientID)
+	current, ok, err := r.readEntry(ctx, key)
+	if err != nil || !ok || current.ConnID != e.ConnID {
+		return err
+	}
+	return r.store.Delete(ctx, key)
+}
+
+func (r *StoreRegistry) Lookup(ctx context.Context, clientType, clientID string) (Entry, bool, error) {
+	e, ok, err := r.readEntry(ctx, connPrefix+entryKey(clientType, clientID))
+	if err != nil || !ok {
+		return Entry{}, false, err
+	}
+	alive, err := r.alive(ctx, e.Node)
+	if err != nil || !alive {
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+func (r *StoreRegistry) List(ctx context.Context, companyID, clientType string) ([]Entry, error) {
+	entries, err := r.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := r.liveSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Entry
+	for _, e := range entries {
+		if e.CompanyID != companyID || (clientType != "" && e.ClientType != clientType) {
+			continue
+		}
+		if nodes[e.Node] {
+			out = append(out, e)
+		}
+	}
+	sortEntries(out)
+	return out, nil
+}
+
+func (r *StoreRegistry) Heartbeat(ctx context.Context, node string) error {
+	data, _ := json.Marshal(time.Now())
+	return r.store.Set(ctx, nodePrefix+node, data)
+}
+
+func (r *StoreRegistry) Nodes(ctx context.Context) ([]Node, error) {
+	keys, err := r.store.Keys(ctx, nodePrefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Node, 0, len(keys))
+	for _, key := range keys {
+		seen, ok, err := r.lastSeen(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		out = append(out, Node{
+			ID:       strings.TrimPrefix(key, nodePrefix),
+			LastSeen: seen,
+			Alive:    time.Since(seen) < r.ttl,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (r *StoreRegistry) Expire(ctx context.Context) (int, error) {
+	entries, err := r.all(ctx)
+	if err != nil {
+		return 0, err
+	}
+	nodes, err := r.liveSet(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.purgeNodes(ctx); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if nodes[e.Node] {
+			continue
+		}
+		if err := r.store.Delete(ctx, connPrefix+entryKey(e.ClientType, e.ClientID)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// purgeNodes deletes the records of nodes dead for purgeAfter TTLs
+func (r *StoreRegistry) purgeNodes(ctx context.Context) error {
+	nodes, err := r.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if time.Since(n.LastSeen) >= purgeAfter*r.ttl {
+			if err := r.store.Delete(ctx, nodePrefix+n.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *StoreRegistry) alive(ctx context.Context, node string) (bool, error) {
+	seen, ok, err := r.lastSeen(ctx, nodePrefix+node)
+	if err != nil || !ok {
+		return false, err
+	}
+	return time.Since(seen) < r.ttl, nil
+}
+
+func (r *StoreRegistry) liveSet(ctx context.Context) (map[string]bool, error) {
+	nodes, err := r.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		live[n.ID] = n.Alive
+	}
+	return live, nil
+}
+
+func (r *StoreRegistry) lastSeen(ctx context.Context, key string) (time.Time, bool, error) {
+	data, ok, err := r.store.Get(ctx, key)
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+	var seen time.Time
+	if err := json.Unmarshal(data, &seen); err != nil {
+		return time.Time{}, false, fmt.Errorf("decode %s: %w", key, err)
+	}
+	return seen, true, nil
+}
+
+func (r *StoreRegistry) readEntry(ctx context.Context, key string) (Entry, bool, error) {
+	data, ok, err := r.store.Get(ctx, key)
+	if err != nil || !ok {
+		return Entry{}, false, err
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Entry{}, false, fmt.Errorf("decode %s: %w", key, err)
+	}
+	return e, true, nil
+}
+
+func (r *StoreRegistry) all(ctx context.Context) ([]Entry, error) {
+	keys, err := r.store.Keys(ctx, connPrefix)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		e, ok, err := r.readEntry(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,412 @@
+package store
+
+import (
+	"bufio"
+	"butter-socket/internal/events"
+	"butter-socket/internal/usage"
+	"butter-socket/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// minCompactSize is the journal size below which it is never rewritten for
+// growing
+const minCompactSize = 16 << 20
+
+// Journal operations, one per write a Store makes
+const (
+	opConversation = "conversation"
+	opMessage      = "message"
+	opSent         = "sent"
+	opFailed       = "failed"
+	opUsage        = "usage"
+	opAudit        = "audit"
+	opOutbox       = "outbox" // -> an entry carried over by compaction
+	opSeq          = "seq"    // -> the outbox sequence at compaction
+)
+
+// journalRecord is one line of the journal
+type journalRecord struct {
+	Op           string               `json:"op"`
+	At           time.Time            `json:"at"`
+	Conversation *models.Conversation `json:"conversation,omitempty"`
+	Message      *models.Message      `json:"message,omitempty"`
+	Audit        *events.Event        `json:"audit,omitempty"`
+	Events       []events.Event       `json:"events,omitempty"`
+	Seq          int64                `json:"seq,omitempty"`
+	Cause        string               `json:"cause,omitempty"`
+	RetryAt      *time.Time           `json:"retry_at,omitempty"`
+	Entry        *OutboxEntry         `json:"entry,omitempty"`
+	Usage        *usage.Totals        `json:"usage,omitempty"`
+	Keys         []string             `json:"keys,omitempty"`
+}
+
+// File is a Store that survives restarts. Every write is appended to a
+// journal file before it is applied in memory, and returns once the journal
+// is synced, so a change and its outbox entries are on disk together or not
+// at all. Writers waiting at once share one sync. The journal is replayed on
+// open and rewritten to just the live state on open, on every Prune and
+// whenever it has grown to twice that size.
+type File struct {
+	mem  *Memory // -> mem.mu also guards the journal and the counts below
+	path string
+	f    *os.File
+
+	written int64 // -> records appended since open
+	needed  int64 // -> the last record Pending must see synced
+	synced  int64 // -> records known to be on disk
+	syncMu  sync.Mutex
+
+	size      int64 // -> journal bytes
+	compactAt int64 // -> the size that triggers a rewrite
+}
+
+var _ Store = (*File)(nil)
+
+// OpenFile opens the journal at path, creating it and its directory if needed
+func OpenFile(path string) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	s := &File{mem: NewMemory(), path: path}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *File) SaveConversation(ctx context.Context, conv models.Conversation, evs ...events.Event) error {
+	conv.Messages = nil
+	rec := journalRecord{Op: opConversation, At: time.Now(), Conversation: &conv, Events: evs}
+
+	s.mem.mu.Lock()
+	n, err := s.writeLocked(rec)
+	if err != nil {
+		s.mem.mu.Unlock()
+		return err
+	}
+	s.mem.saveLocked(conv, evs, rec.At)
+	s.mem.mu.Unlock()
+	return s.sync(n)
+}
+
+func (s *File) AppendMessage(ctx context.Context, msg models.Message, evs ...events.Event) error {
+	rec := journalRecord{Op: opMessage, At: time.Now(), Message: &msg, Events: evs}
+
+	s.mem.mu.Lock()
+	if _, ok := s.mem.conversations[msg.ConversationId]; !ok {
+		s.mem.mu.Unlock()
+		return ErrNotFound
+	}
+	n, err := s.writeLocked(rec)
+	if err == nil {
+		err = s.mem.appendLocked(msg, evs, rec.At)
+	}
+	s.mem.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.sync(n)
+}
+
+func (s *File) Conversation(ctx context.Context, id string) (models.Conversation, bool, error) {
+	return s.mem.Conversation(ctx, id)
+}
+
+// Pending lists only entries already on disk, so no event is relayed for a
+// change a crash could still undo
+func (s *File) Pending(ctx context.Context, now time.Time, limit int) ([]OutboxEntry, error) {
+	s.mem.mu.Lock()
+	n := s.needed
+	s.mem.mu.Unlock()
+	if err := s.sync(n); err != nil {
+		return nil, err
+	}
+	return s.mem.Pending(ctx, now, limit)
+}
+
+// MarkSent doesn't wait for the journal to be synced: if a crash loses the
+// record the event goes out again, and consumers dedupe on its ID
+func (s *File) MarkSent(ctx context.Context, seq int64) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if _, err := s.writeLocked(journalRecord{Op: opSent, At: time.Now(), Seq: seq}); err != nil {
+		return err
+	}
+	s.mem.markSentLocked(seq)
+	return nil
+}
+
+func (s *File) MarkFailed(ctx context.Context, seq int64, cause string, retryAt time.Time) error {
+	s.mem.mu.Lock()
+	n, err := s.writeLocked(journalRecord{Op: opFailed, At: time.Now(), Seq: seq, Cause: cause, RetryAt: &retryAt})
+	if err != nil {
+		s.mem.mu.Unlock()
+		return err
+	}
+	s.mem.markFailedLocked(seq, cause, retryAt)
+	s.mem.mu.Unlock()
+	return s.sync(n)
+}
+
+func (s *File) AppendAudit(ctx context.Context, ev events.Event) error {
+	rec := journalRecord{Op: opAudit, At: time.Now(), Audit: &ev, Events: []events.Event{ev}}
+
+	s.mem.mu.Lock()
+	n, err := s.writeLocked(rec)
+	if err != nil {
+		s.mem.mu.Unlock()
+		return err
+	}
+	s.mem.auditLocked(ev, rec.Events)
+	s.mem.mu.Unlock()
+	return s.sync(n)
+}
+
+func (s *File) Audit(ctx context.Context, companyID string, limit int) ([]events.Event, error) {
+	return s.mem.Audit(ctx, companyID, limit)
+}
+
+func (s *File) AddUsage(ctx context.Context, delta usage.Totals, at time.Time, keys ...string) error {
+	s.mem.mu.Lock()
+	n, err := s.writeLocked(journalRecord{Op: opUsage, At: at, Usage: &delta, Keys: keys})
+	if err == nil {
+		err = s.mem.usage.AddUsage(ctx, delta, at, keys...)
+	}
+	s.mem.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.sync(n)
+}
+
+func (s *File) Usage(ctx context.Context, key string) (usage.Totals, bool, error) {
+	return s.mem.Usage(ctx, key)
+}
+
+// PruneUsage drops old totals; the journal sheds them at the next Prune
+func (s *File) PruneUsage(ctx context.Context, prefix string, before time.Time) (int, error) {
+	return s.mem.PruneUsage(ctx, prefix, before)
+}
+
+// Prune drops idle conversations and old audit records and rewrites the
+// journal without them
+func (s *File) Prune(ctx context.Context, before time.Time) (int, error) {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	n := s.mem.pruneLocked(before)
+	return n, s.compactLocked()
+}
+
+// OutboxLen reports how many events are waiting to be relayed
+func (s *File) OutboxLen() int {
+	return s.mem.OutboxLen()
+}
+
+// Close syncs and closes the journal
+func (s *File) Close() error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	if err == nil {
+		s.synced = s.written
+	}
+	return err
+}
+
+// writeLocked appends one record to the journal, unsynced, and returns its
+// number for sync. A journal grown to twice its live size is rewritten first.
+func (s *File) writeLocked(rec journalRecord) (int64, error) {
+	if s.f == nil {
+		return 0, errors.New("store: journal is closed")
+	}
+	if s.size >= s.compactAt {
+		if err := s.compactLocked(); err != nil {
+			return 0, err
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, fmt.Errorf("store: encode journal record: %w", err)
+	}
+	n, err := s.f.Write(append(line, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return 0, fmt.Errorf("store: write journal: %w", err)
+	}
+	s.written++
+	if rec.Op != opSent {
+		s.needed = s.written
+	}
+	return s.written, nil
+}
+
+// sync returns once record n is on disk. One caller syncs the journal for
+// every record written so far while the others wait their turn and find
+// their records synced with it.
+func (s *File) sync(n int64) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	s.mem.mu.Lock()
+	f, target, done := s.f, s.written, s.synced >= n
+	s.mem.mu.Unlock()
+	if done {
+		return nil
+	}
+	if f == nil {
+		return errors.New("store: journal is closed")
+	}
+
+	err := f.Sync()
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if s.synced >= n {
+		return nil // -> a compaction rewrote the journal meanwhile
+	}
+	if err != nil {
+		return fmt.Errorf("store: sync journal: %w", err)
+	}
+	s.synced = target
+	return nil
+}
+
+// replay applies the journal to the empty in-memory state. A torn last line
+// from a crash mid-write is dropped; compaction then cuts it off.
+func (s *File) replay() error {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m := s.mem
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for n := 1; ; n++ {
+		var rec journalRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("store journal ends in a bad record, dropping the rest", "path", s.path, "record", n, "error", err)
+			return nil
+		}
+		switch rec.Op {
+		case opConversation:
+			m.saveLocked(*rec.Conversation, rec.Events, rec.At)
+		case opMessage:
+			if err := m.appendLocked(*rec.Message, rec.Events, rec.At); err != nil {
+				slog.Warn("store journal has a message without its conversation", "path", s.path, "record", n)
+			}
+		case opSent:
+			m.markSentLocked(rec.Seq)
+		case opFailed:
+			m.markFailedLocked(rec.Seq, rec.Cause, *rec.RetryAt)
+		case opAudit:
+			m.auditLocked(*rec.Audit, rec.Events)
+		case opUsage:
+			m.usage.AddUsage(context.Background(), *rec.Usage, rec.At, rec.Keys...)
+		case opOutbox:
+			m.outbox = append(m.outbox, *rec.Entry)
+		case opSeq:
+			m.seq = rec.Seq
+		default:
+			return fmt.Errorf("store: journal record %d: unknown op %q", n, rec.Op)
+		}
+	}
+}
+
+// compactLocked rewrites the journal as the records of the live state and
+// reopens it for appending
+func (s *File) compactLocked() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	write := func(rec journalRecord) {
+		if err == nil {
+			err = enc.Encode(rec)
+		}
+	}
+	m := s.mem
+	for _, row := range m.conversations {
+		conv := row.conv
+		write(journalRecord{Op: opConversation, At: row.updated, Conversation: &conv})
+		for i := range row.messages {
+			write(journalRecord{Op: opMessage, At: row.updated, Message: &row.messages[i]})
+		}
+	}
+	for i := range m.audit {
+		write(journalRecord{Op: opAudit, At: m.audit[i].OccurredAt, Audit: &m.audit[i]})
+	}
+	m.usage.Each(func(key string, totals usage.Totals, updated time.Time) {
+		write(journalRecord{Op: opUsage, At: updated, Usage: &totals, Keys: []string{key}})
+	})
+	for i := range m.outbox {
+		write(journalRecord{Op: opOutbox, Entry: &m.outbox[i]})
+	}
+	write(journalRecord{Op: opSeq, Seq: m.seq})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("store: compact journal: %w", err)
+	}
+
+	if s.f != nil {
+		s.f.Close()
+	}
+	err = os.Rename(tmp, s.path)
+	// keep appending to whichever journal is in place
+	var ferr error
+	s.f, ferr = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("store: compact journal: %w", err)
+	}
+	if ferr != nil {
+		return ferr
+	}
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	s.synced = s.written
+	s.size = info.Size()
+	s.compactAt = max(2*s.size, minCompactSize)
+	return nil
+}
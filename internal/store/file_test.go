@@ -0,0 +1,234 @@
+package store
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/usage"
+	"butter-socket/models"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.journal")
+
+	s, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SaveConversation(ctx, models.Conversation{Id: "a", Summary: "refund"}, event("a1", "a"))
+	s.AppendMessage(ctx, models.Message{Id: "m1", ConversationId: "a", Content: "hi"}, event("a2", "a"))
+	s.SaveConversation(ctx, models.Conversation{Id: "b"}, event("b1", "b"))
+	pending, _ := s.Pending(ctx, time.Now(), batchSize)
+	s.MarkSent(ctx, pending[0].Seq)
+	s.MarkFailed(ctx, pending[1].Seq, "broker down", time.Now().Add(time.Hour))
+	s.Close()
+
+	for _, name := range []string{"replayed", "compacted"} {
+		s, err = OpenFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		conv, ok, _ := s.Conversation(ctx, "a")
+		if !ok || conv.Summary != "refund" || len(conv.Messages) != 1 {
+			t.Errorf("%s: conversation a = %+v, %v", name, conv, ok)
+		}
+		// a2 failed and holds nothing back from b
+		pending, _ = s.Pending(ctx, time.Now(), batchSize)
+		if len(pending) != 1 || pending[0].Event.ID != "b1" {
+			t.Errorf("%s: pending %+v, want b1", name, pending)
+		}
+		if s.OutboxLen() != 2 {
+			t.Errorf("%s: outbox holds %d entries, want 2", name, s.OutboxLen())
+		}
+		s.Close()
+	}
+
+	// new entries carry on the sequence
+	s, _ = OpenFile(path)
+	defer s.Close()
+	s.SaveConversation(ctx, models.Conversation{Id: "c"}, event("c1", "c"))
+	pending, _ = s.Pending(ctx, time.Now().Add(2*time.Hour), batchSize)
+	if last := pending[len(pending)-1]; last.Event.ID != "c1" || last.Seq <= pending[0].Seq {
+		t.Errorf("pending %+v, want c1 last with the highest seq", pending)
+	}
+}
+
+func TestFileDropsTornRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.journal")
+	s, _ := OpenFile(path)
+	s.SaveConversation(ctx, models.Conversation{Id: "a"})
+	s.Close()
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"op":"conversation","conversation":{"id":"b"`)
+	f.Close()
+
+	s, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok, _ := s.Conversation(ctx, "a"); !ok {
+		t.Error("conversation a lost")
+	}
+	if _, ok, _ := s.Conversation(ctx, "b"); ok {
+		t.Error("torn conversation b replayed")
+	}
+	if err := s.SaveConversation(ctx, models.Conversation{Id: "c"}); err != nil {
+		t.Errorf("write after recovery: %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.journal")
+	s, _ := OpenFile(path)
+	s.SaveConversation(ctx, models.Conversation{Id: "idle"})
+	s.SaveConversation(ctx, models.Conversation{Id: "unrelayed"}, events.Event{ID: "u1", ConversationID: "unrelayed"})
+	cutoff := time.Now().Add(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	s.SaveConversation(ctx, models.Conversation{Id: "live"})
+
+	n, err := s.Prune(ctx, cutoff)
+	if err != nil || n != 1 {
+		t.Fatalf("Prune = %d, %v, want 1", n, err)
+	}
+	s.Close()
+
+	s, _ = OpenFile(path)
+	defer s.Close()
+	for id, want := range map[string]bool{"idle": false, "unrelayed": true, "live": true} {
+		if _, ok, _ := s.Conversation(ctx, id); ok != want {
+			t.Errorf("conversation %s kept = %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestFileKeepsUsage(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.journal")
+	s, _ := OpenFile(path)
+	at := time.Now()
+	s.AddUsage(ctx, usage.Totals{Requests: 1, InputTokens: 10}, at, "company/acme", "conversation/a")
+	s.AddUsage(ctx, usage.Totals{Requests: 1, InputTokens: 5}, at, "company/acme")
+	s.Close()
+
+	for _, name := range []string{"replayed", "compacted"} {
+		s, _ = OpenFile(path)
+		got, ok, _ := s.Usage(ctx, "company/acme")
+		if !ok || got.Requests != 2 || got.InputTokens != 15 {
+			t.Errorf("%s: company usage = %+v, %v", name, got, ok)
+		}
+		s.Close()
+	}
+}
+
+func TestFileKeepsAudit(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.journal")
+	s, _ := OpenFile(path)
+	old := events.Event{ID: "old", Type: events.ChatMonitored, CompanyID: "acme", ConversationID: "a", OccurredAt: time.Now().Add(-time.Hour)}
+	s.AppendAudit(ctx, old)
+	for _, ev := range []events.Event{event("acme-1", "a"), event("globex-1", "b"), event("acme-2", "a")} {
+		if ev.ID == "globex-1" {
+			ev.CompanyID = "globex"
+		}
+		ev.OccurredAt = time.Now()
+		s.AppendAudit(ctx, ev)
+	}
+	if n := s.OutboxLen(); n != 4 {
+		t.Errorf("outbox holds %d entries, want every audit record raised", n)
+	}
+	s.Close()
+
+	tests := []struct {
+		companyID string
+		limit     int
+		want      string
+	}{
+		{"acme", 10, "acme-2,acme-1,old"},
+		{"acme", 1, "acme-2"},
+		{"", 10, "acme-2,globex-1,acme-1,old"},
+		{"initech", 10, ""},
+	}
+	for _, name := range []string{"replayed", "compacted"} {
+		s, _ = OpenFile(path)
+		for _, tt := range tests {
+			evs, err := s.Audit(ctx, tt.companyID, tt.limit)
+			var ids []string
+			for _, ev := range evs {
+				ids = append(ids, ev.ID)
+			}
+			if err != nil || strings.Join(ids, ",") != tt.want {
+				t.Errorf("%s: Audit(%q, %d) = %v, %v, want %s", name, tt.companyID, tt.limit, ids, err, tt.want)
+			}
+		}
+		s.Close()
+	}
+
+	// old records go with the conversations
+	s, _ = OpenFile(path)
+	defer s.Close()
+	s.Prune(ctx, time.Now().Add(-time.Minute))
+	if evs, _ := s.Audit(ctx, "acme", 10); len(evs) != 2 {
+		t.Errorf("Audit after Prune = %+v, want the two recent records", evs)
+	}
+}
+
+func TestFileConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.journal")
+	s, _ := OpenFile(path)
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20 {
+				id := fmt.Sprintf("%d-%d", w, i)
+				if err := s.SaveConversation(ctx, models.Conversation{Id: id}, event(id, id)); err != nil {
+					t.Errorf("save %s: %v", id, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	s.Close()
+
+	s, _ = OpenFile(path)
+	defer s.Close()
+	if n := s.OutboxLen(); n != 160 {
+		t.Errorf("outbox holds %d entries after reopening, want 160", n)
+	}
+}
+
+func TestFileCompactsAsItGrows(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.journal")
+	s, _ := OpenFile(path)
+	s.compactAt = 4 << 10 // -> rather than minCompactSize
+	for i := range 50 {
+		s.SaveConversation(ctx, models.Conversation{Id: "a", Summary: fmt.Sprint(i)}, event(fmt.Sprint(i), "a"))
+		pending, _ := s.Pending(ctx, time.Now(), batchSize)
+		s.MarkSent(ctx, pending[0].Seq)
+	}
+	s.Close()
+
+	journal, _ := os.ReadFile(path)
+	if lines := strings.Count(string(journal), "\n"); lines >= 100 {
+		t.Errorf("journal holds %d records, want it rewritten along the way", lines)
+	}
+	s, _ = OpenFile(path)
+	defer s.Close()
+	if conv, _, _ := s.Conversation(ctx, "a"); conv.Summary != "49" || s.OutboxLen() != 0 {
+		t.Errorf("after reopening: conversation %+v, %d pending", conv, s.OutboxLen())
+	}
+}
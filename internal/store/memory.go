@@ -0,0 +1,219 @@
+package store
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/usage"
+	"butter-socket/models"
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when writing to a conversation that was never saved
+var ErrNotFound = errors.New("conversation not found")
+
+// Memory is a Store kept in process memory only: conversations and pending
+// outbox entries are lost on restart, so it suits tests and single dev
+// instances. One mutex makes every write and its outbox entries a single
+// transaction.
+type Memory struct {
+	mu            sync.Mutex
+	conversations map[string]*conversationRow
+	outbox        []OutboxEntry // -> ordered by Seq
+	seq           int64
+	audit         []events.Event // -> oldest first
+	usage         *usage.MemoryStore
+}
+
+type conversationRow struct {
+	conv     models.Conversation
+	messages []models.Message
+	updated  time.Time // -> last write, for retention
+}
+
+var _ Store = (*Memory)(nil)
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{conversations: make(map[string]*conversationRow), usage: usage.NewMemoryStore()}
+}
+
+func (m *Memory) SaveConversation(ctx context.Context, conv models.Conversation, evs ...events.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saveLocked(conv, evs, time.Now())
+	return nil
+}
+
+func (m *Memory) AppendMessage(ctx context.Context, msg models.Message, evs ...events.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.appendLocked(msg, evs, time.Now())
+}
+
+func (m *Memory) Conversation(ctx context.Context, id string) (models.Conversation, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	row, ok := m.conversations[id]
+	if !ok {
+		return models.Conversation{}, false, nil
+	}
+	conv := row.conv
+	conv.Messages = append([]models.Message(nil), row.messages...)
+	return conv, true, nil
+}
+
+func (m *Memory) Pending(ctx context.Context, now time.Time, limit int) ([]OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blocked := make(map[string]bool)
+	var out []OutboxEntry
+	for _, e := range m.outbox {
+		if len(out) == limit {
+			break
+		}
+		conv := e.Event.ConversationID
+		if blocked[conv] {
+			continue
+		}
+		if e.NextAttempt.After(now) {
+			blocked[conv] = true
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (m *Memory) MarkSent(ctx context.Context, seq int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.markSentLocked(seq)
+	return nil
+}
+
+func (m *Memory) MarkFailed(ctx context.Context, seq int64, cause string, retryAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.markFailedLocked(seq, cause, retryAt)
+	return nil
+}
+
+func (m *Memory) AppendAudit(ctx context.Context, ev events.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.auditLocked(ev, []events.Event{ev})
+	return nil
+}
+
+func (m *Memory) Audit(ctx context.Context, companyID string, limit int) ([]events.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []events.Event{}
+	for i := len(m.audit) - 1; i >= 0 && len(out) < limit; i-- {
+		if companyID == "" || m.audit[i].CompanyID == companyID {
+			out = append(out, m.audit[i])
+		}
+	}
+	return out, nil
+}
+
+// Prune drops conversations last written before the cutoff, unless they
+// still have events waiting in the outbox, and audit records older than it
+func (m *Memory) Prune(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pruneLocked(before), nil
+}
+
+func (m *Memory) AddUsage(ctx context.Context, delta usage.Totals, at time.Time, keys ...string) error {
+	return m.usage.AddUsage(ctx, delta, at, keys...)
+}
+
+func (m *Memory) Usage(ctx context.Context, key string) (usage.Totals, bool, error) {
+	return m.usage.Usage(ctx, key)
+}
+
+func (m *Memory) PruneUsage(ctx context.Context, prefix string, before time.Time) (int, error) {
+	return m.usage.PruneUsage(ctx, prefix, before)
+}
+
+// OutboxLen reports how many events are waiting to be relayed
+func (m *Memory) OutboxLen() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.outbox)
+}
+
+func (m *Memory) saveLocked(conv models.Conversation, evs []events.Event, at time.Time) {
+	conv.Messages = nil
+	if row, ok := m.conversations[conv.Id]; ok {
+		row.conv = conv
+		row.updated = at
+	} else {
+		m.conversations[conv.Id] = &conversationRow{conv: conv, updated: at}
+	}
+	m.enqueueLocked(evs)
+}
+
+func (m *Memory) appendLocked(msg models.Message, evs []events.Event, at time.Time) error {
+	row, ok := m.conversations[msg.ConversationId]
+	if !ok {
+		return ErrNotFound
+	}
+	row.messages = append(row.messages, msg)
+	row.updated = at
+	m.enqueueLocked(evs)
+	return nil
+}
+
+func (m *Memory) auditLocked(ev events.Event, evs []events.Event) {
+	m.audit = append(m.audit, ev)
+	m.enqueueLocked(evs)
+}
+
+func (m *Memory) markSentLocked(seq int64) {
+	if i, ok := m.findLocked(seq); ok {
+		m.outbox = append(m.outbox[:i], m.outbox[i+1:]...)
+	}
+}
+
+func (m *Memory) markFailedLocked(seq int64, cause string, retryAt time.Time) {
+	if i, ok := m.findLocked(seq); ok {
+		m.outbox[i].Attempts++
+		m.outbox[i].LastError = cause
+		m.outbox[i].NextAttempt = retryAt
+	}
+}
+
+func (m *Memory) pruneLocked(before time.Time) int {
+	pending := make(map[string]bool)
+	for _, e := range m.outbox {
+		pending[e.Event.ConversationID] = true
+	}
+	pruned := 0
+	for id, row := range m.conversations {
+		if row.updated.Before(before) && !pending[id] {
+			delete(m.conversations, id)
+			pruned++
+		}
+	}
+	m.audit = slices.DeleteFunc(m.audit, func(ev events.Event) bool { return ev.OccurredAt.Before(before) })
+	return pruned
+}
+
+func (m *Memory) enqueueLocked(evs []events.Event) {
+	for _, ev := range evs {
+		m.seq++
+		m.outbox = append(m.outbox, OutboxEntry{Seq: m.seq, Event: ev})
+	}
+}
+
+// findLocked locates seq in the outbox, which is sorted by Seq
+func (m *Memory) findLocked(seq int64) (int, bool) {
+	i := sort.Search(len(m.outbox), func(i int) bool { return m.outbox[i].Seq >= seq })
+	return i, i < len(m.outbox) && m.outbox[i].Seq == seq
+}
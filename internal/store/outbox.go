@@ -0,0 +1,126 @@
+package store
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/metrics"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the dispatcher looks for new outbox entries
+	pollInterval = 100 * time.Millisecond
+
+	// Entries relayed per poll
+	batchSize = 256
+
+	// Retry backoff bounds for an entry the broker refused
+	retryBase = time.Second
+	retryMax  = time.Minute
+
+	// Upper bound for one publish
+	relayTimeout = 10 * time.Second
+)
+
+// Dispatcher relays the outbox to a Publisher. Entries of one conversation
+// are published strictly in order: a failed entry holds back the ones after
+// it until its retry succeeds. Other conversations keep flowing.
+type Dispatcher struct {
+	store Store
+	pub   events.Publisher
+
+	mu sync.Mutex // -> one relay at a time, or Run and Flush could reorder a conversation
+}
+
+// NewDispatcher relays s to pub once Run is called
+func NewDispatcher(s Store, pub events.Publisher) *Dispatcher {
+	return &Dispatcher{store: s, pub: pub}
+}
+
+// Run relays until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		d.relay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush relays everything due until the outbox is empty, only failing
+// entries are left or ctx is done, and reports how many entries are left
+// undelivered
+func (d *Dispatcher) Flush(ctx context.Context) (int, error) {
+	for ctx.Err() == nil {
+		if d.relay(ctx) == 0 {
+			return d.store.OutboxLen(), nil
+		}
+	}
+	return d.store.OutboxLen(), ctx.Err()
+}
+
+// relay publishes one batch and returns how many entries were sent
+func (d *Dispatcher) relay(ctx context.Context) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entries, err := d.store.Pending(ctx, time.Now(), batchSize)
+	if err != nil {
+		slog.Error("outbox read failed", "error", err)
+		return 0
+	}
+
+	sent := 0
+	failed := make(map[string]bool) // -> conversations with an entry held back
+	for _, e := range entries {
+		conv := e.Event.ConversationID
+		if failed[conv] {
+			continue
+		}
+
+		pubCtx, cancel := context.WithTimeout(ctx, relayTimeout)
+		err := d.pub.Publish(pubCtx, e.Event)
+		cancel()
+
+		if err != nil {
+			failed[conv] = true
+			retryAt := time.Now().Add(backoff(e.Attempts))
+			metrics.OutboxRelays.WithLabelValues(e.Event.Type, "failed").Inc()
+			slog.Warn("outbox relay failed",
+				"event_type", e.Event.Type,
+				"event_id", e.Event.ID,
+				"conversation_id", conv,
+				"attempts", e.Attempts+1,
+				"retry_at", retryAt,
+				"error", err)
+			if err := d.store.MarkFailed(ctx, e.Seq, err.Error(), retryAt); err != nil {
+				slog.Error("outbox update failed", "event_id", e.Event.ID, "error", err)
+			}
+			continue
+		}
+
+		metrics.OutboxRelays.WithLabelValues(e.Event.Type, "sent").Inc()
+		if err := d.store.MarkSent(ctx, e.Seq); err != nil {
+			// the event goes out again on the next poll; consumers dedupe on its ID
+			slog.Error("outbox update failed", "event_id", e.Event.ID, "error", err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// backoff doubles from retryBase per attempt up to retryMax
+func backoff(attempts int) time.Duration {
+	wait := retryBase
+	for i := 0; i < attempts && wait < retryMax; i++ {
+		wait *= 2
+	}
+	return min(wait, retryMax)
+}
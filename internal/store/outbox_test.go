@@ -0,0 +1,132 @@
+package store
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/models"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a Publisher that fails the events it is told to
+type recorder struct {
+	mu        sync.Mutex
+	published []string
+	failing   map[string]bool // -> event IDs to refuse
+}
+
+func (r *recorder) Publish(ctx context.Context, e events.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failing[e.ID] {
+		return errors.New("broker down")
+	}
+	r.published = append(r.published, e.ID)
+	return nil
+}
+
+func event(id, conv string) events.Event {
+	return events.Event{ID: id, Type: events.MessageCreated, CompanyID: "acme", ConversationID: conv}
+}
+
+func TestDispatcherOrdersPerConversation(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  []events.Event
+		failing []string
+		want    []string
+		pending int
+	}{
+		{
+			name:   "all sent in order",
+			events: []events.Event{event("a1", "a"), event("b1", "b"), event("a2", "a")},
+			want:   []string{"a1", "b1", "a2"},
+		},
+		{
+			name:    "failure holds back its conversation only",
+			events:  []events.Event{event("a1", "a"), event("b1", "b"), event("a2", "a"), event("b2", "b")},
+			failing: []string{"a1"},
+			want:    []string{"b1", "b2"},
+			pending: 2,
+		},
+		{
+			name:    "later failure keeps earlier entries sent",
+			events:  []events.Event{event("a1", "a"), event("a2", "a"), event("a3", "a")},
+			failing: []string{"a2"},
+			want:    []string{"a1"},
+			pending: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewMemory()
+			for _, ev := range tt.events {
+				if err := s.SaveConversation(ctx, models.Conversation{Id: ev.ConversationID}, ev); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pub := &recorder{failing: make(map[string]bool)}
+			for _, id := range tt.failing {
+				pub.failing[id] = true
+			}
+
+			left, err := NewDispatcher(s, pub).Flush(ctx)
+			if err != nil || left != tt.pending {
+				t.Fatalf("Flush = %d, %v, want %d left", left, err, tt.pending)
+			}
+			if !slices.Equal(pub.published, tt.want) {
+				t.Errorf("published %v, want %v", pub.published, tt.want)
+			}
+			if got := s.OutboxLen(); got != tt.pending {
+				t.Errorf("outbox holds %d entries, want %d", got, tt.pending)
+			}
+		})
+	}
+}
+
+func TestDispatcherRetriesAfterBackoff(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+	s.SaveConversation(ctx, models.Conversation{Id: "a"}, event("a1", "a"), event("a2", "a"))
+	pub := &recorder{failing: map[string]bool{"a1": true}}
+	d := NewDispatcher(s, pub)
+
+	d.relay(ctx)
+	entries, _ := s.Pending(ctx, time.Now(), batchSize)
+	if len(entries) != 0 {
+		t.Fatalf("entries due right after a failure: %v", entries)
+	}
+	entries, _ = s.Pending(ctx, time.Now().Add(retryMax), batchSize)
+	if len(entries) != 2 || entries[0].Attempts != 1 || entries[0].LastError == "" {
+		t.Fatalf("after backoff got %+v, want both entries with the failure recorded", entries)
+	}
+
+	// the broker is back and the retry is due
+	pub.failing = nil
+	s.MarkFailed(ctx, entries[0].Seq, "broker down", time.Now().Add(-time.Second))
+	d.relay(ctx)
+	if want := []string{"a1", "a2"}; !slices.Equal(pub.published, want) {
+		t.Errorf("published %v, want %v", pub.published, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, retryBase},
+		{1, 2 * retryBase},
+		{3, 8 * retryBase},
+		{20, retryMax},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
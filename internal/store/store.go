@@ -0,0 +1,82 @@
+// Package store persists conversations, their messages and the outbox of
+// domain events raised while changing them, and the LLM usage totals
+// budgets are checked against.
+package store
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/usage"
+	"butter-socket/models"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// pruneInterval is how often Retain looks for conversations to drop
+const pruneInterval = time.Hour
+
+// OutboxEntry is a domain event waiting to be relayed to the broker
+type OutboxEntry struct {
+	Seq         int64        `json:"seq"` // -> insertion order, the relay order within a conversation
+	Event       events.Event `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"` // -> zero until the first failure
+	LastError   string       `json:"last_error,omitempty"`
+}
+
+// Store is the conversation persistence layer. Every write takes the events it
+// raises and records them in the outbox in the same transaction, so an event
+// exists if and only if the change it describes was saved.
+type Store interface {
+	// SaveConversation inserts or updates a conversation; its Messages are ignored
+	SaveConversation(ctx context.Context, conv models.Conversation, evs ...events.Event) error
+	// AppendMessage adds a message to an existing conversation
+	AppendMessage(ctx context.Context, msg models.Message, evs ...events.Event) error
+	// Conversation loads a conversation with its messages
+	Conversation(ctx context.Context, id string) (models.Conversation, bool, error)
+
+	// Pending lists outbox entries due at now in Seq order, leaving out any
+	// entry queued behind an earlier one of the same conversation that is not due
+	Pending(ctx context.Context, now time.Time, limit int) ([]OutboxEntry, error)
+	// MarkSent removes a relayed entry from the outbox
+	MarkSent(ctx context.Context, seq int64) error
+	// MarkFailed records a failed relay and when to try again
+	MarkFailed(ctx context.Context, seq int64, cause string, retryAt time.Time) error
+	// OutboxLen reports how many events are waiting to be relayed
+	OutboxLen() int
+
+	// AppendAudit records an action taken on a conversation that must be
+	// accounted for, such as a supervisor barging in, and raises it as an event
+	AppendAudit(ctx context.Context, ev events.Event) error
+	// Audit lists recorded actions newest first, at most limit of them; an
+	// empty companyID lists every company's
+	Audit(ctx context.Context, companyID string, limit int) ([]events.Event, error)
+
+	// Prune drops conversations not written since before, with their
+	// messages, unless events of theirs are still waiting in the outbox,
+	// and audit records older than before
+	Prune(ctx context.Context, before time.Time) (int, error)
+
+	// usage totals by company, conversation, day and month
+	usage.Store
+}
+
+// Retain prunes conversations idle for longer than keep from s every
+// pruneInterval until ctx is done
+func Retain(ctx context.Context, s Store, keep time.Duration) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		n, err := s.Prune(ctx, time.Now().Add(-keep))
+		if err != nil {
+			slog.Error("conversation pruning failed", "error", err)
+		} else if n > 0 {
+			slog.Info("conversations pruned", "conversations", n, "idle_for", keep)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
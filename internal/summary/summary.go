@@ -0,0 +1,121 @@
+// Package summary writes short conversation summaries for the humans who take
+// over or review a chat.
+package summary
+
+import (
+	"butter-socket/internal/llm"
+	"butter-socket/internal/usage"
+	"butter-socket/models"
+	"context"
+	"errors"
+	"strings"
+)
+
+// maxTranscript bounds the transcript sent to the model; older messages are
+// dropped first
+const maxTranscript = 16 << 10
+
+// ErrOverBudget is returned when the company has no AI budget left for a summary
+var ErrOverBudget = errors.New("company is over its AI budget")
+
+const instructions = `You summarize customer support chats for the human agent who takes over or reviews them.
+Reply with at most four short lines, in the language the customer wrote in:
+Issue: what the customer needs help with.
+Intent: what outcome the customer wants.
+Tried: what the assistant or agent already answered or attempted, or "nothing yet".
+Next: the open question or the step the agent should take.
+Only state what the transcript says. Leave out greetings, and repeat order numbers or other identifiers exactly.`
+
+// Summarizer summarizes conversations with the LLM and books the tokens to
+// the conversation's company
+type Summarizer struct {
+	model string
+	usage *usage.Tracker
+}
+
+// New creates a summarizer using model, or llm.DefaultModel when empty. A nil
+// tracker skips budgets and accounting.
+func New(model string, tracker *usage.Tracker) *Summarizer {
+	return &Summarizer{model: model, usage: tracker}
+}
+
+// Summarize returns a summary of the conversation's messages, or "" when it
+// has none worth summarizing
+func (s *Summarizer) Summarize(ctx context.Context, conv models.Conversation) (string, error) {
+	text := transcript(conv.Messages)
+	if text == "" {
+		return "", nil
+	}
+
+	req := llm.Request{Model: s.model, Input: text, Instructions: instructions}
+	if s.usage != nil && req.Model == "" {
+		decision := s.usage.Decide(conv.CompanyId)
+		if decision.Handoff {
+			return "", ErrOverBudget
+		}
+		req.Model = decision.Model
+	}
+
+	out, used, err := llm.Complete(ctx, req)
+	if s.usage != nil {
+		s.usage.Record(usage.Record{
+			CompanyID:      conv.CompanyId,
+			ConversationID: conv.Id,
+			Model:          used.Model,
+			InputTokens:    used.InputTokens,
+			OutputTokens:   used.OutputTokens,
+			Latency:        used.Latency,
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// transcript renders messages as "Speaker: text" lines, keeping the latest
+// that fit in maxTranscript. Internal notes are left out, they are the
+// agents' own words about the chat rather than part of it.
+func transcript(messages []models.Message) string {
+	var lines []string
+	size := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := messages[i]
+		if m.Internal {
+			continue
+		}
+		content := strings.Join(strings.Fields(m.Content), " ")
+		if content == "" {
+			continue
+		}
+		line := speaker(m.SenderType) + ": " + content
+		if size == 0 && len(line) > maxTranscript {
+			line = strings.ToValidUTF8(line[:maxTranscript], "")
+		}
+		if size+len(line) > maxTranscript {
+			lines = append(lines, "[earlier messages left out]")
+			break
+		}
+		size += len(line) + 1
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func speaker(senderType string) string {
+	switch senderType {
+	case "customer":
+		return "Customer"
+	case "AI-AGENT":
+		return "Assistant"
+	case "user":
+		return "Agent"
+	}
+	return "System"
+}
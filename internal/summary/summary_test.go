@@ -0,0 +1,59 @@
+package summary
+
+import (
+	"butter-socket/models"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTranscript(t *testing.T) {
+	long := strings.Repeat("a", maxTranscript/2)
+	tests := []struct {
+		name     string
+		messages []models.Message
+		want     string
+	}{
+		{"empty", nil, ""},
+		{
+			"speakers and whitespace",
+			[]models.Message{
+				{SenderType: "customer", Content: "where is\n my   order?"},
+				{SenderType: "AI-AGENT", Content: "Let me check."},
+				{SenderType: "user", Content: "It shipped."},
+				{SenderType: "system", Content: "chat closed"},
+			},
+			"Customer: where is my order?\nAssistant: Let me check.\nAgent: It shipped.\nSystem: chat closed",
+		},
+		{
+			"internal notes and blanks left out",
+			[]models.Message{
+				{SenderType: "customer", Content: "hi"},
+				{SenderType: "user", Content: "VIP, be nice", Internal: true},
+				{SenderType: "user", Content: "   "},
+			},
+			"Customer: hi",
+		},
+		{
+			"oldest dropped first",
+			[]models.Message{
+				{SenderType: "customer", Content: "first " + long},
+				{SenderType: "customer", Content: "second " + long},
+				{SenderType: "customer", Content: "third"},
+			},
+			"[earlier messages left out]\nCustomer: second " + long + "\nCustomer: third",
+		},
+	}
+	for _, tt := range tests {
+		if got := transcript(tt.messages); got != tt.want {
+			t.Errorf("%s: transcript = %.120q, want %.120q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTranscriptCutsOneHugeMessage(t *testing.T) {
+	got := transcript([]models.Message{{SenderType: "customer", Content: strings.Repeat("é", maxTranscript)}})
+	if len(got) > maxTranscript || !strings.HasPrefix(got, "Customer: éé") || !utf8.ValidString(got) {
+		t.Errorf("transcript of %d bytes, valid UTF-8 %v", len(got), utf8.ValidString(got))
+	}
+}
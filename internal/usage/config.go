@@ -0,0 +1,89 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Actions taken once a company runs past its monthly budget
+const (
+	ActionDegrade = "degrade" // keep answering on the fallback model
+	ActionHandoff = "handoff" // stop answering and hand the chat to a human
+)
+
+// Budget caps what a company may spend on AI replies in a calendar month
+type Budget struct {
+	MonthlyUSD    float64 `json:"monthly_usd"`
+	Action        string  `json:"action"`
+	FallbackModel string  `json:"fallback_model"`
+}
+
+// Price is the provider list price of a model, in USD per million tokens
+type Price struct {
+	InputPerMillion  float64 `json:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// Config is the budgets file: a default budget, per company overrides and
+// the price table used to turn tokens into money
+type Config struct {
+	Default   Budget            `json:"default"`
+	Companies map[string]Budget `json:"companies"`
+	Prices    map[string]Price  `json:"prices"`
+}
+
+// DefaultPrices covers the models the server ships with
+var DefaultPrices = map[string]Price{
+	"gpt-5.2":    {InputPerMillion: 1.75, OutputPerMillion: 14},
+	"gpt-5-mini": {InputPerMillion: 0.25, OutputPerMillion: 2},
+}
+
+// LoadConfig reads a budgets file. An empty path yields an unlimited config.
+func LoadConfig(path string) (Config, error) {
+	cfg := Config{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("read budgets file: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parse budgets file: %w", err)
+		}
+	}
+
+	if cfg.Prices == nil {
+		cfg.Prices = make(map[string]Price)
+	}
+	for model, price := range DefaultPrices {
+		if _, ok := cfg.Prices[model]; !ok {
+			cfg.Prices[model] = price
+		}
+	}
+
+	if err := cfg.Default.validate(); err != nil {
+		return cfg, fmt.Errorf("default budget: %w", err)
+	}
+	for companyID, b := range cfg.Companies {
+		if err := b.validate(); err != nil {
+			return cfg, fmt.Errorf("budget for company %s: %w", companyID, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (b Budget) validate() error {
+	if b.MonthlyUSD <= 0 {
+		return nil
+	}
+	switch b.Action {
+	case ActionHandoff:
+	case ActionDegrade, "":
+		if b.FallbackModel == "" {
+			return fmt.Errorf("action %q needs a fallback_model", ActionDegrade)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", b.Action)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package usage
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store kept in process memory: totals are per node and
+// start over on restart
+type MemoryStore struct {
+	mu     sync.Mutex
+	totals map[string]*storedTotals
+}
+
+type storedTotals struct {
+	totals  Totals
+	updated time.Time // -> last added to, for pruning
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{totals: make(map[string]*storedTotals)}
+}
+
+func (m *MemoryStore) AddUsage(ctx context.Context, delta Totals, at time.Time, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		t, ok := m.totals[key]
+		if !ok {
+			t = &storedTotals{}
+			m.totals[key] = t
+		}
+		t.totals.Merge(delta)
+		if at.After(t.updated) {
+			t.updated = at
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Usage(ctx context.Context, key string) (Totals, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.totals[key]; ok {
+		return t.totals, true, nil
+	}
+	return Totals{}, false, nil
+}
+
+func (m *MemoryStore) PruneUsage(ctx context.Context, prefix string, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pruned := 0
+	for key, t := range m.totals {
+		if strings.HasPrefix(key, prefix) && t.updated.Before(before) {
+			delete(m.totals, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// Each calls fn with every key's totals and when they were last added to,
+// e.g. to write them out
+func (m *MemoryStore) Each(fn func(key string, totals Totals, updated time.Time)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, t := range m.totals {
+		fn(key, t.totals, t.updated)
+	}
+}
@@ -0,0 +1,221 @@
+package usage
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Record is the accounting entry for a single LLM response
+type Record struct {
+	CompanyID      string        `json:"company_id"`
+	ConversationID string        `json:"conversation_id"`
+	Model          string        `json:"model"`
+	InputTokens    int64         `json:"input_tokens"`
+	OutputTokens   int64         `json:"output_tokens"`
+	Latency        time.Duration `json:"latency"`
+	At             time.Time     `json:"at"`
+}
+
+// Totals aggregates a set of records
+type Totals struct {
+	Requests     int64         `json:"requests"`
+	InputTokens  int64         `json:"input_tokens"`
+	OutputTokens int64         `json:"output_tokens"`
+	CostUSD      float64       `json:"cost_usd"`
+	Latency      time.Duration `json:"latency"`
+}
+
+func (t *Totals) add(r Record, cost float64) {
+	t.Requests++
+	t.InputTokens += r.InputTokens
+	t.OutputTokens += r.OutputTokens
+	t.CostUSD += cost
+	t.Latency += r.Latency
+}
+
+// Merge adds other into t
+func (t *Totals) Merge(other Totals) {
+	t.Requests += other.Requests
+	t.InputTokens += other.InputTokens
+	t.OutputTokens += other.OutputTokens
+	t.CostUSD += other.CostUSD
+	t.Latency += other.Latency
+}
+
+// Decision tells the caller how to serve the next AI reply for a company
+type Decision struct {
+	// Handoff is set when the company is over budget and the chat must go
+	// to a human instead of the model
+	Handoff bool
+	// Model overrides the default model when non-empty
+	Model string
+}
+
+// Usage kept after the fact: daily totals for dayRetention, a conversation's
+// for conversationRetention after its last reply
+const (
+	dayRetention          = 90 * 24 * time.Hour
+	conversationRetention = 30 * 24 * time.Hour
+
+	// How often Run prunes, and the bound on one store call
+	pruneInterval = time.Hour
+	storeTimeout  = 2 * time.Second
+)
+
+// Key prefixes of the aggregates a record belongs to
+const (
+	keyCompany      = "company/"
+	keyConversation = "conversation/"
+	keyDay          = "day/"
+	keyMonth        = "month/"
+)
+
+// Store keeps usage totals by key. Totals in a store every node shares add
+// up across the cluster and survive restarts.
+type Store interface {
+	// AddUsage adds delta to the totals under each key
+	AddUsage(ctx context.Context, delta Totals, at time.Time, keys ...string) error
+	// Usage returns the totals under key
+	Usage(ctx context.Context, key string) (Totals, bool, error)
+	// PruneUsage drops the totals under keys with prefix last added to before the cutoff
+	PruneUsage(ctx context.Context, prefix string, before time.Time) (int, error)
+}
+
+// Tracker aggregates usage per company, conversation, day and month in a
+// Store, and enforces monthly budgets
+type Tracker struct {
+	cfg   Config
+	store Store
+}
+
+// NewTracker creates a tracker enforcing the given budgets. Its totals live
+// in process memory until UseStore gives it a store.
+func NewTracker(cfg Config) *Tracker {
+	return &Tracker{cfg: cfg, store: NewMemoryStore()}
+}
+
+// UseStore keeps totals in s. Call before recording.
+func (t *Tracker) UseStore(s Store) {
+	t.store = s
+}
+
+// Cost prices a record using the configured price table. Unknown models are free.
+func (t *Tracker) Cost(r Record) float64 {
+	p := t.cfg.Prices[r.Model]
+	return float64(r.InputTokens)*p.InputPerMillion/1e6 +
+		float64(r.OutputTokens)*p.OutputPerMillion/1e6
+}
+
+// Record adds a response to every aggregate it belongs to
+func (t *Tracker) Record(r Record) {
+	if r.At.IsZero() {
+		r.At = time.Now()
+	}
+	var delta Totals
+	delta.add(r, t.Cost(r))
+	keys := []string{keyCompany + r.CompanyID, dayKey(r.CompanyID, r.At), monthKey(r.CompanyID, r.At)}
+	if r.ConversationID != "" {
+		keys = append(keys, keyConversation+r.ConversationID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := t.store.AddUsage(ctx, delta, r.At, keys...); err != nil {
+		slog.Error("usage record failed", "company_id", r.CompanyID, "conversation_id", r.ConversationID, "error", err)
+	}
+}
+
+// Decide checks the company's spend this month against its budget
+func (t *Tracker) Decide(companyID string) Decision {
+	budget := t.Budget(companyID)
+	if budget.MonthlyUSD <= 0 {
+		return Decision{}
+	}
+
+	spent := t.MonthTotals(companyID, time.Now()).CostUSD
+	if spent < budget.MonthlyUSD {
+		return Decision{}
+	}
+
+	if budget.Action == ActionHandoff {
+		return Decision{Handoff: true}
+	}
+	return Decision{Model: budget.FallbackModel}
+}
+
+// CompanyTotals returns everything a company has consumed
+func (t *Tracker) CompanyTotals(companyID string) Totals {
+	return t.get(keyCompany + companyID)
+}
+
+// ConversationTotals returns what a single conversation has consumed
+func (t *Tracker) ConversationTotals(conversationID string) Totals {
+	return t.get(keyConversation + conversationID)
+}
+
+// DayTotals returns a company's consumption on the day containing at
+func (t *Tracker) DayTotals(companyID string, at time.Time) Totals {
+	return t.get(dayKey(companyID, at))
+}
+
+// MonthTotals returns a company's consumption in the month containing at
+func (t *Tracker) MonthTotals(companyID string, at time.Time) Totals {
+	return t.get(monthKey(companyID, at))
+}
+
+// Budget returns the budget that applies to a company
+func (t *Tracker) Budget(companyID string) Budget {
+	if b, ok := t.cfg.Companies[companyID]; ok {
+		return b
+	}
+	return t.cfg.Default
+}
+
+// Prune drops daily totals older than dayRetention and the totals of
+// conversations without a reply for conversationRetention
+func (t *Tracker) Prune(ctx context.Context, now time.Time) (int, error) {
+	days, err := t.store.PruneUsage(ctx, keyDay, now.Add(-dayRetention))
+	if err != nil {
+		return days, err
+	}
+	convs, err := t.store.PruneUsage(ctx, keyConversation, now.Add(-conversationRetention))
+	return days + convs, err
+}
+
+// Run prunes every pruneInterval until ctx is done
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := t.Prune(ctx, time.Now()); err != nil {
+			slog.Error("usage pruning failed", "error", err)
+		} else if n > 0 {
+			slog.Info("usage totals pruned", "totals", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// get reads totals from the store; a store that can't answer counts as no usage
+func (t *Tracker) get(key string) Totals {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	totals, _, err := t.store.Usage(ctx, key)
+	if err != nil {
+		slog.Error("usage read failed", "key", key, "error", err)
+	}
+	return totals
+}
+
+func dayKey(companyID string, at time.Time) string {
+	return keyDay + companyID + "/" + at.UTC().Format("2006-01-02")
+}
+
+func monthKey(companyID string, at time.Time) string {
+	return keyMonth + companyID + "/" + at.UTC().Format("2006-01")
+}
@@ -0,0 +1,82 @@
+package usage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDecide(t *testing.T) {
+	prices := map[string]Price{"gpt-5.2": {InputPerMillion: 1_000_000, OutputPerMillion: 0}} // -> $1 per input token
+	tests := []struct {
+		name   string
+		budget Budget
+		spent  int64 // -> input tokens this month
+		want   Decision
+	}{
+		{"no budget", Budget{}, 100, Decision{}},
+		{"under budget", Budget{MonthlyUSD: 10, Action: ActionHandoff}, 9, Decision{}},
+		{"handoff at budget", Budget{MonthlyUSD: 10, Action: ActionHandoff}, 10, Decision{Handoff: true}},
+		{"degrade over budget", Budget{MonthlyUSD: 10, Action: ActionDegrade, FallbackModel: "gpt-5-mini"}, 11, Decision{Model: "gpt-5-mini"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker(Config{Companies: map[string]Budget{"acme": tt.budget}, Prices: prices})
+			tr.Record(Record{CompanyID: "acme", Model: "gpt-5.2", InputTokens: tt.spent})
+			if got := tr.Decide("acme"); got != tt.want {
+				t.Errorf("Decide = %+v, want %+v", got, tt.want)
+			}
+			// last month's spend doesn't count
+			old := NewTracker(Config{Companies: map[string]Budget{"acme": tt.budget}, Prices: prices})
+			old.Record(Record{CompanyID: "acme", Model: "gpt-5.2", InputTokens: tt.spent, At: time.Now().AddDate(0, -1, -1)})
+			if got := old.Decide("acme"); got != (Decision{}) {
+				t.Errorf("Decide on last month's spend = %+v, want none", got)
+			}
+		})
+	}
+}
+
+func TestTrackerSharesStore(t *testing.T) {
+	s := NewMemoryStore()
+	a, b := NewTracker(Config{}), NewTracker(Config{})
+	a.UseStore(s)
+	b.UseStore(s)
+	a.Record(Record{CompanyID: "acme", ConversationID: "c1", InputTokens: 5})
+	b.Record(Record{CompanyID: "acme", ConversationID: "c1", OutputTokens: 7})
+
+	got := b.ConversationTotals("c1")
+	if got.Requests != 2 || got.InputTokens != 5 || got.OutputTokens != 7 {
+		t.Errorf("ConversationTotals = %+v, want both records", got)
+	}
+	if got := a.CompanyTotals("acme").Requests; got != 2 {
+		t.Errorf("CompanyTotals requests = %d, want 2", got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+	tr := NewTracker(Config{})
+	tr.Record(Record{CompanyID: "acme", ConversationID: "old", InputTokens: 1, At: now.Add(-dayRetention - time.Hour)})
+	tr.Record(Record{CompanyID: "acme", ConversationID: "recent", InputTokens: 1, At: now.Add(-time.Hour)})
+
+	n, err := tr.Prune(context.Background(), now)
+	if err != nil || n != 2 {
+		t.Fatalf("Prune = %d, %v, want the old day and conversation", n, err)
+	}
+	tests := []struct {
+		name string
+		got  Totals
+		kept bool
+	}{
+		{"old day", tr.DayTotals("acme", now.Add(-dayRetention-time.Hour)), false},
+		{"old conversation", tr.ConversationTotals("old"), false},
+		{"recent day", tr.DayTotals("acme", now.Add(-time.Hour)), true},
+		{"recent conversation", tr.ConversationTotals("recent"), true},
+		{"company", tr.CompanyTotals("acme"), true},
+	}
+	for _, tt := range tests {
+		if kept := tt.got.Requests > 0; kept != tt.kept {
+			t.Errorf("%s kept = %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package webhook
+
+import "time"
+
+// Circuit states reported for an endpoint
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// breaker stops hammering an endpoint after threshold consecutive failures.
+// Once cooldown passes one attempt is let through; success closes the circuit,
+// failure opens it again. Not safe for concurrent use.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+}
+
+// wait is how long until the next attempt may be made
+func (b *breaker) wait(now time.Time) time.Duration {
+	if b.failures < b.threshold {
+		return 0
+	}
+	return max(b.openUntil.Sub(now), 0)
+}
+
+func (b *breaker) success() {
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+func (b *breaker) failure(now time.Time) {
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+func (b *breaker) state(now time.Time) string {
+	switch {
+	case b.failures < b.threshold:
+		return CircuitClosed
+	case now.Before(b.openUntil):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
@@ -0,0 +1,444 @@
+// Package webhook delivers conversation events to HTTPS endpoints registered
+// by companies that don't consume from our broker.
+package webhook
+
+import (
+	"butter-socket/internal/events"
+	"butter-socket/internal/metrics"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Attempts per delivery before it is given up and left for replay
+	maxAttempts = 8
+
+	// Retry backoff bounds between attempts of one delivery
+	retryBase = time.Second
+	retryMax  = 5 * time.Minute
+
+	// Consecutive failures that open an endpoint's circuit, and how long it stays open
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+
+	// Deliveries waiting per endpoint before new ones are dropped
+	queueSize = 1024
+
+	// Deliveries kept per endpoint for inspection and replay
+	logSize = 500
+
+	// Upper bound for one HTTP attempt
+	requestTimeout = 10 * time.Second
+)
+
+// Delivery states
+const (
+	StatePending   = "pending"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateDropped   = "dropped"
+)
+
+var (
+	ErrEndpointNotFound = errors.New("webhook endpoint not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidEndpoint  = errors.New("invalid webhook endpoint")
+)
+
+// Endpoint is a URL a company wants its conversation events posted to
+type Endpoint struct {
+	ID        string    `json:"id"`
+	CompanyID string    `json:"company_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"` // -> event types to send; empty sends all
+	Secret    string    `json:"secret,omitempty"` // -> only returned when the endpoint is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EndpointInfo is an endpoint with its delivery health, without the secret
+type EndpointInfo struct {
+	Endpoint
+	Circuit  string `json:"circuit"`
+	Queued   int    `json:"queued"`
+	Failures int    `json:"consecutive_failures"`
+}
+
+// Delivery is one event sent to one endpoint, across all of its attempts
+type Delivery struct {
+	ID         string    `json:"id"`
+	EndpointID string    `json:"endpoint_id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	ReplayOf   string    `json:"replay_of,omitempty"`
+	State      string    `json:"state"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	body []byte
+}
+
+// Manager keeps the registered endpoints and delivers to each from its own
+// worker, so a slow or dead endpoint only holds up its own queue
+type Manager struct {
+	client        *http.Client
+	allowInsecure bool
+
+	mu        sync.RWMutex
+	endpoints map[string]*endpoint
+}
+
+type endpoint struct {
+	Endpoint
+	queue chan *Delivery
+	stop  chan struct{}
+
+	mu      sync.Mutex
+	breaker breaker
+	log     []*Delivery // -> oldest first, at most logSize
+}
+
+var _ events.Publisher = (*Manager)(nil)
+
+// NewManager creates a manager. allowInsecure also accepts plain http URLs on
+// loopback hosts, for local stand-ins.
+func NewManager(allowInsecure bool) *Manager {
+	return &Manager{
+		client: &http.Client{
+			Timeout: requestTimeout,
+			// a redirect could bounce a signed payload somewhere unexpected
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		allowInsecure: allowInsecure,
+		endpoints:     make(map[string]*endpoint),
+	}
+}
+
+// Register validates and starts delivering to ep. A secret is generated when
+// ep has none. The returned endpoint is the only place the secret is shown.
+func (m *Manager) Register(ep Endpoint) (Endpoint, error) {
+	if ep.CompanyID == "" {
+		return Endpoint{}, fmt.Errorf("%w: company_id is required", ErrInvalidEndpoint)
+	}
+	if err := m.checkURL(ep.URL); err != nil {
+		return Endpoint{}, err
+	}
+	ep.ID = uuid.New().String()
+	if ep.Secret == "" {
+		ep.Secret = NewSecret()
+	}
+	ep.CreatedAt = time.Now().UTC()
+
+	e := &endpoint{
+		Endpoint: ep,
+		queue:    make(chan *Delivery, queueSize),
+		stop:     make(chan struct{}),
+		breaker:  breaker{threshold: breakerThreshold, cooldown: breakerCooldown},
+	}
+	m.mu.Lock()
+	m.endpoints[ep.ID] = e
+	m.mu.Unlock()
+	go m.work(e)
+
+	slog.Info("webhook endpoint registered", "company_id", ep.CompanyID, "endpoint_id", ep.ID, "url", ep.URL)
+	return ep, nil
+}
+
+func (m *Manager) checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: url must be absolute", ErrInvalidEndpoint)
+	}
+	switch {
+	case u.Scheme == "https":
+		return nil
+	case u.Scheme == "http" && m.allowInsecure && isLoopback(u.Hostname()):
+		return nil
+	}
+	return fmt.Errorf("%w: url must be https", ErrInvalidEndpoint)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Remove stops delivering to an endpoint; queued deliveries are abandoned
+func (m *Manager) Remove(id string) error {
+	m.mu.Lock()
+	e, ok := m.endpoints[id]
+	delete(m.endpoints, id)
+	m.mu.Unlock()
+	if !ok {
+		return ErrEndpointNotFound
+	}
+	close(e.stop)
+	return nil
+}
+
+// Endpoints lists a company's endpoints, or every endpoint for an empty companyID
+func (m *Manager) Endpoints(companyID string) []EndpointInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	out := make([]EndpointInfo, 0, len(m.endpoints))
+	for _, e := range m.endpoints {
+		if companyID != "" && e.CompanyID != companyID {
+			continue
+		}
+		e.mu.Lock()
+		info := EndpointInfo{
+			Endpoint: e.Endpoint,
+			Circuit:  e.breaker.state(now),
+			Queued:   len(e.queue),
+			Failures: e.breaker.failures,
+		}
+		e.mu.Unlock()
+		info.Secret = ""
+		out = append(out, info)
+	}
+	slices.SortFunc(out, func(a, b EndpointInfo) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return out
+}
+
+// Deliveries returns an endpoint's delivery log, newest first
+func (m *Manager) Deliveries(endpointID string) ([]Delivery, error) {
+	e, err := m.endpoint(endpointID)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]Delivery, 0, len(e.log))
+	for i := len(e.log) - 1; i >= 0; i-- {
+		out = append(out, *e.log[i])
+	}
+	return out, nil
+}
+
+// Replay sends a logged delivery's payload again as a new delivery
+func (m *Manager) Replay(endpointID, deliveryID string) (Delivery, error) {
+	e, err := m.endpoint(endpointID)
+	if err != nil {
+		return Delivery{}, err
+	}
+	e.mu.Lock()
+	var original *Delivery
+	for _, d := range e.log {
+		if d.ID == deliveryID {
+			original = d
+			break
+		}
+	}
+	e.mu.Unlock()
+	if original == nil {
+		return Delivery{}, ErrDeliveryNotFound
+	}
+
+	d := m.enqueue(e, original.EventID, original.EventType, original.ID, original.body)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return *d, nil
+}
+
+// Publish queues ev for every endpoint of its company that wants it. It never
+// fails: delivery problems are retried per endpoint and show in the log.
+func (m *Manager) Publish(ctx context.Context, ev events.Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, e := range m.endpoints {
+		if e.CompanyID != ev.CompanyID {
+			continue
+		}
+		if len(e.Events) > 0 && !slices.Contains(e.Events, ev.Type) {
+			continue
+		}
+		m.enqueue(e, ev.ID, ev.Type, "", body)
+	}
+	return nil
+}
+
+// Close stops every endpoint worker
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, e := range m.endpoints {
+		close(e.stop)
+		delete(m.endpoints, id)
+	}
+}
+
+func (m *Manager) endpoint(id string) (*endpoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.endpoints[id]
+	if !ok {
+		return nil, ErrEndpointNotFound
+	}
+	return e, nil
+}
+
+// enqueue logs a new delivery and hands it to the endpoint's worker
+func (m *Manager) enqueue(e *endpoint, eventID, eventType, replayOf string, body []byte) *Delivery {
+	now := time.Now().UTC()
+	d := &Delivery{
+		ID:         uuid.New().String(),
+		EndpointID: e.ID,
+		EventID:    eventID,
+		EventType:  eventType,
+		ReplayOf:   replayOf,
+		State:      StatePending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		body:       body,
+	}
+
+	e.mu.Lock()
+	e.log = append(e.log, d)
+	if len(e.log) > logSize {
+		e.log = e.log[len(e.log)-logSize:]
+	}
+	e.mu.Unlock()
+
+	select {
+	case e.queue <- d:
+	default:
+		e.mu.Lock()
+		d.State = StateDropped
+		d.LastError = "delivery queue full"
+		e.mu.Unlock()
+		metrics.WebhookDeliveries.WithLabelValues(StateDropped).Inc()
+		slog.Warn("webhook queue full, dropping delivery", "company_id", e.CompanyID, "endpoint_id", e.ID, "event_id", eventID)
+	}
+	return d
+}
+
+func (m *Manager) work(e *endpoint) {
+	for {
+		select {
+		case <-e.stop:
+			return
+		case d := <-e.queue:
+			m.deliver(e, d)
+		}
+	}
+}
+
+// deliver attempts d until it succeeds, runs out of attempts or the endpoint is removed
+func (m *Manager) deliver(e *endpoint, d *Delivery) {
+	for attempt := 1; ; attempt++ {
+		e.mu.Lock()
+		wait := e.breaker.wait(time.Now())
+		e.mu.Unlock()
+		if wait > 0 && !e.sleep(wait) {
+			return
+		}
+
+		start := time.Now()
+		status, err := m.send(e, d)
+		elapsed := time.Since(start)
+
+		e.mu.Lock()
+		d.Attempts = attempt
+		d.StatusCode = status
+		d.DurationMS = elapsed.Milliseconds()
+		d.UpdatedAt = time.Now().UTC()
+		if err == nil {
+			d.State = StateSucceeded
+			d.LastError = ""
+			e.breaker.success()
+		} else {
+			d.LastError = err.Error()
+			e.breaker.failure(time.Now())
+			if attempt == maxAttempts {
+				d.State = StateFailed
+			}
+		}
+		e.mu.Unlock()
+
+		logger := slog.Default().With("company_id", e.CompanyID, "endpoint_id", e.ID, "delivery_id", d.ID, "event_id", d.EventID, "attempt", attempt)
+		switch {
+		case err == nil:
+			metrics.WebhookDeliveries.WithLabelValues(StateSucceeded).Inc()
+			logger.Debug("webhook delivered", "status", status, "duration", elapsed)
+			return
+		case attempt == maxAttempts:
+			metrics.WebhookDeliveries.WithLabelValues(StateFailed).Inc()
+			logger.Error("webhook delivery failed, giving up", "status", status, "error", err)
+			return
+		}
+		logger.Warn("webhook attempt failed, retrying", "status", status, "error", err)
+		if !e.sleep(backoff(attempt)) {
+			return
+		}
+	}
+}
+
+// send makes one signed POST and returns its status code
+func (m *Manager) send(e *endpoint, d *Delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "butter-socket-webhooks")
+	req.Header.Set("X-Butter-Event", d.EventType)
+	req.Header.Set("X-Butter-Event-Id", d.EventID)
+	req.Header.Set("X-Butter-Delivery", d.ID)
+	req.Header.Set(SignatureHeader, Sign(e.Secret, time.Now(), d.body))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// sleep waits for d, returning false if the endpoint is removed meanwhile
+func (e *endpoint) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-e.stop:
+		return false
+	}
+}
+
+// backoff doubles from retryBase per attempt up to retryMax
+func backoff(attempt int) time.Duration {
+	wait := retryBase
+	for i := 1; i < attempt && wait < retryMax; i++ {
+		wait *= 2
+	}
+	return min(wait, retryMax)
+}
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"message.created"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		secret    string
+		header    string
+		body      []byte
+		tolerance time.Duration
+		want      error
+	}{
+		{"valid", "s1", Sign("s1", now, body), body, time.Minute, nil},
+		{"wrong secret", "s2", Sign("s1", now, body), body, time.Minute, ErrBadSignature},
+		{"tampered body", "s1", Sign("s1", now, body), []byte(`{}`), time.Minute, ErrBadSignature},
+		{"stale", "s1", Sign("s1", now.Add(-time.Hour), body), body, time.Minute, ErrStaleSignature},
+		{"future", "s1", Sign("s1", now.Add(time.Hour), body), body, time.Minute, ErrStaleSignature},
+		{"stale without tolerance", "s1", Sign("s1", now.Add(-time.Hour), body), body, 0, nil},
+		{"missing mac", "s1", "t=123", body, 0, ErrBadSignature},
+		{"malformed", "s1", "garbage", body, 0, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		err := Verify(tt.secret, tt.header, tt.body, tt.tolerance)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	start := time.Now()
+	b := &breaker{threshold: 2, cooldown: time.Minute}
+
+	steps := []struct {
+		name  string
+		act   func()
+		at    time.Time
+		state string
+		wait  time.Duration
+	}{
+		{"fresh", func() {}, start, CircuitClosed, 0},
+		{"one failure", func() { b.failure(start) }, start, CircuitClosed, 0},
+		{"threshold reached", func() { b.failure(start) }, start, CircuitOpen, time.Minute},
+		{"cooling down", func() {}, start.Add(20 * time.Second), CircuitOpen, 40 * time.Second},
+		{"cooldown over", func() {}, start.Add(time.Minute), CircuitHalfOpen, 0},
+		{"probe fails", func() { b.failure(start.Add(time.Minute)) }, start.Add(time.Minute), CircuitOpen, time.Minute},
+		{"probe succeeds", func() { b.success() }, start.Add(3 * time.Minute), CircuitClosed, 0},
+	}
+	for _, s := range steps {
+		s.act()
+		if got := b.state(s.at); got != s.state {
+			t.Errorf("%s: state = %s, want %s", s.name, got, s.state)
+		}
+		if got := b.wait(s.at); got != s.wait {
+			t.Errorf("%s: wait = %v, want %v", s.name, got, s.wait)
+		}
+	}
+}
@@ -10,6 +10,7 @@ type Customer struct {
 	Name       string `json:"name"`
 	Source     string `json:"source"`
 	CompanyId  string `json:"company_id"`
+	Segment    string `json:"segment,omitempty"`
 }
 
 type Message struct {
@@ -20,22 +21,35 @@ type Message struct {
 	SenderType     string `json:"sender_type"`
 	Content        string `json:"content"`
 	ContentType    string `json:"content_type"`
+	Internal       bool   `json:"internal,omitempty"` // -> an agent-only note the customer never sees
 }
 
 type Conversation struct {
-	*MetaData    `json:"metadata"`
-	*Customer    `json:"customer"`
-	*User        `json:"user"`
-	Messages     []Message `json:"messages"`
-	Id           string    `json:"id"`
-	Status       string    `json:"status"`
-	Provider     string    `json:"provider"`
-	Summary      string    `json:"summary"`
-	Tags         []string  `json:"tags"`
-	CompanyId    string    `json:"company_id"`
-	DepartmentId string    `json:"department_id"`
-	AssignedTo   string    `json:"assigned_to"`
-	Source       string    `json:"source"`
+	*MetaData      `json:"metadata"`
+	*Customer      `json:"customer"`
+	*User          `json:"user"`
+	Messages       []Message       `json:"messages"`
+	Id             string          `json:"id"`
+	Status         string          `json:"status"`
+	Provider       string          `json:"provider"`
+	Summary        string          `json:"summary"`
+	Notes          []Message       `json:"notes,omitempty"` // -> internal notes left by agents, oldest first
+	Tags           []string        `json:"tags"`
+	Classification *Classification `json:"classification,omitempty"`
+	CompanyId      string          `json:"company_id"`
+	DepartmentId   string          `json:"department_id"`
+	AssignedTo     string          `json:"assigned_to"`
+	Source         string          `json:"source"`
+}
+
+// Classification is what the AI made of a conversation, within the company's taxonomy
+type Classification struct {
+	Intent       string `json:"intent"`
+	Topic        string `json:"topic"`
+	Language     string `json:"language"` // -> ISO 639-1, "und" when unclear
+	Sentiment    string `json:"sentiment"`
+	Urgency      string `json:"urgency"`
+	DepartmentID string `json:"department_id,omitempty"` // -> where the taxonomy routes it
 }
 
 // WebSocket message types
@@ -46,13 +60,25 @@ type WSMessage struct {
 
 // payload for -> trigger: message
 type MsgInOut struct {
-	SenderId    string `json:"sender_id"`
-	SenderType  string `json:"sender_type"`
-	ReceiverId  string `json:"receiver_id,omitempty"`
-	Typing      string `json:"typing,omitempty"`
-	Content     string `json:"content"`
-	ContentType string `json:"content_type"`
-	CreatedAt   string `json:"created_at,omitempty"`
+	MessageId   string     `json:"message_id,omitempty"`
+	SenderId    string     `json:"sender_id"`
+	SenderType  string     `json:"sender_type"`
+	ReceiverId  string     `json:"receiver_id,omitempty"`
+	Typing      string     `json:"typing,omitempty"`
+	Content     string     `json:"content"`
+	ContentType string     `json:"content_type"`
+	CreatedAt   string     `json:"created_at,omitempty"`
+	Citations   []Citation `json:"citations,omitempty"`
+	Internal    bool       `json:"internal,omitempty"` // -> an agent-only note
+}
+
+// Citation points an AI answer at the knowledge base passage it drew on
+type Citation struct {
+	Index      int    `json:"index"` // -> the [n] marker in the reply
+	DocumentID string `json:"document_id"`
+	Title      string `json:"title"`
+	Heading    string `json:"heading,omitempty"`
+	Source     string `json:"source,omitempty"`
 }
 
 // payload for -> trigger: transfer_chat
@@ -74,6 +100,7 @@ type User struct {
 	UserID      string       `json:"userId"`
 	CompanyID   string       `json:"companyId"`
 	Departments []Department `json:"departments"`
+	Role        string       `json:"role,omitempty"` // -> agent, supervisor or admin; empty is an agent
 }
 
 type Department struct {
@@ -0,0 +1,124 @@
+package rabbitmq
+
+import (
+	"butter-socket/internal/bus"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultBusExchange is the topic exchange hubs talk over
+const DefaultBusExchange = "butter.hub"
+
+const (
+	broadcastKey = "hub.all"
+	nodeKeyFmt   = "hub.node.%s"
+)
+
+// Bus is a bus.Bus over a RabbitMQ topic exchange. Every node consumes from
+// its own exclusive queue bound to the broadcast key and to its node key, and
+// redeclares it after the broker comes back.
+type Bus struct {
+	conn *Connection
+	pub  *Publisher
+}
+
+var _ bus.Bus = (*Bus)(nil)
+
+// NewBus declares the hub exchange on conn
+func NewBus(conn *Connection, exchange string) (*Bus, error) {
+	pub, err := NewPublisher(conn, exchange)
+	if err != nil {
+		return nil, err
+	}
+	return &Bus{conn: conn, pub: pub}, nil
+}
+
+// Publish routes env to its target node, or to every node when it has none
+func (b *Bus) Publish(ctx context.Context, env bus.Envelope) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	key := broadcastKey
+	if env.Target != "" {
+		key = fmt.Sprintf(nodeKeyFmt, env.Target)
+	}
+	return b.pub.Publish(ctx, key, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	})
+}
+
+// Subscribe declares the node's queue and hands every envelope to handle.
+// The first subscription must succeed; later ones are retried until Close.
+func (b *Bus) Subscribe(nodeID string, handle func(bus.Envelope)) error {
+	deliveries, err := b.consume(nodeID)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			for d := range deliveries {
+				var env bus.Envelope
+				if err := json.Unmarshal(d.Body, &env); err != nil {
+					slog.Warn("dropping malformed bus message", "error", err)
+					continue
+				}
+				if env.Origin == nodeID {
+					continue
+				}
+				handle(env)
+			}
+			if b.conn.Closed() {
+				return
+			}
+			slog.Warn("bus subscription lost, resubscribing", "node", nodeID)
+			ok := b.conn.retry("bus subscribe", func() error {
+				var err error
+				deliveries, err = b.consume(nodeID)
+				return err
+			})
+			if !ok {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *Bus) consume(nodeID string) (<-chan amqp.Delivery, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("declare node queue: %w", err)
+	}
+	for _, key := range []string{broadcastKey, fmt.Sprintf(nodeKeyFmt, nodeID)} {
+		if err := ch.QueueBind(q.Name, key, b.pub.exchange, false, nil); err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("bind %s: %w", key, err)
+		}
+	}
+
+	deliveries, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("consume node queue: %w", err)
+	}
+	return deliveries, nil
+}
+
+// Close closes the publishing channel; the shared connection is closed by its owner
+func (b *Bus) Close() error {
+	return b.pub.Close()
+}
@@ -0,0 +1,113 @@
+// Package rabbitmq carries hub traffic, domain events and commands over RabbitMQ.
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrClosed is returned once a Connection has been closed
+var ErrClosed = errors.New("rabbitmq: connection closed")
+
+const (
+	// Reconnect backoff bounds for consumers waiting on the broker
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// Connection is a broker connection shared by publishers and consumers. It
+// redials on the next Channel call after the broker drops it.
+type Connection struct {
+	url string
+
+	mu     sync.Mutex
+	conn   *amqp.Connection
+	closed bool
+}
+
+// NewConnection dials url once so a bad address fails at startup
+func NewConnection(url string) (*Connection, error) {
+	c := &Connection{url: url}
+	if _, err := c.dial(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Channel opens a channel, redialing first if the connection is gone
+func (c *Connection) Channel() (*amqp.Channel, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("open channel: %w", err)
+	}
+	return ch, nil
+}
+
+func (c *Connection) dial() (*amqp.Connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil && !c.conn.IsClosed() {
+		return c.conn, nil
+	}
+
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("connect RabbitMQ: %w", err)
+	}
+	if c.conn != nil {
+		slog.Info("reconnected to RabbitMQ")
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// Close shuts the connection for good
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Closed reports whether Close has been called
+func (c *Connection) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// retry runs open until it succeeds or the connection is closed, backing off
+// between attempts. It is how consumers come back after the broker goes away.
+func (c *Connection) retry(what string, open func() error) bool {
+	backoff := minBackoff
+	for {
+		err := open()
+		if err == nil {
+			return true
+		}
+		if c.Closed() {
+			return false
+		}
+		slog.Warn("RabbitMQ unavailable, retrying", "what", what, "retry_in", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
@@ -1 +1,174 @@
-package rabbitmq
\ No newline at end of file
+package rabbitmq
+
+import (
+	"butter-socket/internal/commands"
+	"butter-socket/internal/metrics"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DefaultCommandQueue is where backend systems send commands for live chats
+const DefaultCommandQueue = "butter.commands"
+
+// commandPrefetch is how many unacked commands a node holds at once
+const commandPrefetch = 32
+
+// Consumer reads commands from a durable queue and hands them to a handler.
+// A command is acked once handled; malformed, invalid and failed commands are
+// rejected without requeue and land in the dead-letter queue "<queue>.dead".
+type Consumer struct {
+	conn   *Connection
+	queue  string
+	handle func(commands.Command) error
+
+	mu     sync.Mutex
+	ch     *amqp.Channel
+	closed bool
+}
+
+// NewConsumer declares the command queue and its dead-letter queue and starts
+// consuming. Every node can run one; the broker spreads commands between them.
+func NewConsumer(conn *Connection, queue string, handle func(commands.Command) error) (*Consumer, error) {
+	c := &Consumer{conn: conn, queue: queue, handle: handle}
+	deliveries, err := c.consume()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(deliveries)
+	return c, nil
+}
+
+// consume (re)declares the topology and opens a consuming channel
+func (c *Consumer) consume() (<-chan amqp.Delivery, error) {
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	dlx := c.queue + ".dlx"
+	dead := c.queue + ".dead"
+	if err := ch.ExchangeDeclare(dlx, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("declare exchange %s: %w", dlx, err)
+	}
+	if _, err := ch.QueueDeclare(dead, true, false, false, false, nil); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("declare queue %s: %w", dead, err)
+	}
+	if err := ch.QueueBind(dead, "", dlx, false, nil); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("bind %s: %w", dead, err)
+	}
+	if _, err := ch.QueueDeclare(c.queue, true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange": dlx,
+	}); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("declare queue %s: %w", c.queue, err)
+	}
+	if err := ch.Qos(commandPrefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("set prefetch: %w", err)
+	}
+
+	deliveries, err := ch.Consume(c.queue, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("consume %s: %w", c.queue, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		ch.Close()
+		return nil, ErrClosed
+	}
+	c.ch = ch
+	return deliveries, nil
+}
+
+func (c *Consumer) run(deliveries <-chan amqp.Delivery) {
+	for {
+		for d := range deliveries {
+			c.process(d)
+		}
+		if c.isClosed() || c.conn.Closed() {
+			return
+		}
+		slog.Warn("command consumer lost its channel, resubscribing", "queue", c.queue)
+		ok := c.conn.retry("command consumer", func() error {
+			var err error
+			deliveries, err = c.consume()
+			if errors.Is(err, ErrClosed) {
+				return nil
+			}
+			return err
+		})
+		if !ok || c.isClosed() {
+			return
+		}
+	}
+}
+
+// process handles one delivery and settles it
+func (c *Consumer) process(d amqp.Delivery) {
+	var cmd commands.Command
+	if err := json.Unmarshal(d.Body, &cmd); err != nil {
+		metrics.Commands.WithLabelValues("malformed", "invalid").Inc()
+		slog.Warn("rejecting malformed command", "message_id", d.MessageId, "error", err)
+		d.Nack(false, false)
+		return
+	}
+	logger := slog.Default().With("command_id", cmd.ID, "command_type", cmd.Type, "company_id", cmd.CompanyID)
+
+	if err := cmd.Validate(); err != nil {
+		metrics.Commands.WithLabelValues(commandLabel(cmd.Type), "invalid").Inc()
+		logger.Warn("rejecting invalid command", "error", err)
+		d.Nack(false, false)
+		return
+	}
+	if err := c.handle(cmd); err != nil {
+		metrics.Commands.WithLabelValues(cmd.Type, "failed").Inc()
+		logger.Warn("command failed, dead-lettering", "error", err)
+		d.Nack(false, false)
+		return
+	}
+
+	metrics.Commands.WithLabelValues(cmd.Type, "ok").Inc()
+	if err := d.Ack(false); err != nil {
+		logger.Error("command ack failed", "error", err)
+	}
+}
+
+// commandLabel keeps unknown command types from exploding metric cardinality
+func commandLabel(t string) string {
+	switch t {
+	case commands.SendMessage, commands.NotifyAgent, commands.CloseConversation, commands.BroadcastCompany:
+		return t
+	}
+	return "unknown"
+}
+
+func (c *Consumer) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Close stops consuming; unacked commands go back to the queue
+func (c *Consumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.ch == nil {
+		return nil
+	}
+	return c.ch.Close()
+}
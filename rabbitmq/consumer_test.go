@@ -0,0 +1,72 @@
+package rabbitmq
+
+import (
+	"butter-socket/internal/commands"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// settlement records how the consumer settled a delivery, standing in for the
+// channel
+type settlement struct {
+	acked, nacked, requeued bool
+}
+
+func (s *settlement) Ack(tag uint64, multiple bool) error {
+	s.acked = true
+	return nil
+}
+
+func (s *settlement) Nack(tag uint64, multiple, requeue bool) error {
+	s.nacked, s.requeued = true, requeue
+	return nil
+}
+
+func (s *settlement) Reject(tag uint64, requeue bool) error {
+	return s.Nack(tag, false, requeue)
+}
+
+func TestProcess(t *testing.T) {
+	failing := errors.New("customer is not connected")
+	tests := []struct {
+		name    string
+		body    string
+		handled error // -> what the handler returns
+		acked   bool  // -> otherwise dead-lettered
+	}{
+		{"handled", `{"id":"1","type":"close_conversation","company_id":"acme","customer_id":"cust-1"}`, nil, true},
+		{"malformed", `{"id":`, nil, false},
+		{"invalid", `{"id":"1","type":"send_message","company_id":"acme"}`, nil, false},
+		{"unknown type", `{"id":"1","type":"reboot","company_id":"acme"}`, nil, false},
+		{"handler failed", `{"id":"1","type":"close_conversation","company_id":"acme","customer_id":"cust-1"}`, failing, false},
+	}
+	for _, tt := range tests {
+		var handled []commands.Command
+		c := &Consumer{queue: DefaultCommandQueue, handle: func(cmd commands.Command) error {
+			handled = append(handled, cmd)
+			return tt.handled
+		}}
+		s := &settlement{}
+		c.process(amqp.Delivery{Acknowledger: s, Body: []byte(tt.body)})
+
+		if tt.acked && (!s.acked || s.nacked) {
+			t.Errorf("%s: acked %v, nacked %v, want acked", tt.name, s.acked, s.nacked)
+		}
+		if !tt.acked && (s.acked || !s.nacked || s.requeued) {
+			t.Errorf("%s: acked %v, nacked %v, requeued %v, want nacked without requeue", tt.name, s.acked, s.nacked, s.requeued)
+		}
+		if wantHandled := tt.acked || tt.handled != nil; wantHandled != (len(handled) == 1) {
+			t.Errorf("%s: handler called %d times", tt.name, len(handled))
+		}
+	}
+}